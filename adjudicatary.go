@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ==== /adjudicatary: directorio de adxudicatarios e ficha de cada un ====
+// Os adxudicatarios saen da columna co rol adx de cada táboa (roles.go), resoltos a provedores
+// co índice de suppliers.go: as variantes do mesmo nome ou NIF contan como un só.
+//
+//	/adjudicatary?q=...&order=importe|count|name   directorio, con busca por nome ou NIF
+//	/adjudicatary/<id>                              ficha (o id de /api/suppliers)
+//
+// A ficha ten o importe total e o número de contratos, as táboas e órganos que os adxudicaron
+// (coa parte do gasto de cada órgano que foi a este provedor), os meses, os tipos e a lista de
+// expedientes cos PDFs. Os meses van pola data de adxudicación ou, se non a hai, pola de
+// publicación. /api/adjudicatary... dá o mesmo en JSON.
+
+const adxPerPage = 50
+
+// adxAmount: contratos e importe dunha táboa, órgano, mes ou tipo
+type adxAmount struct {
+	Key     string  `json:"key"`
+	Count   int     `json:"count"`
+	Importe float64 `json:"importe"`
+}
+
+type adxOrgano struct {
+	adxAmount
+	OrganoImporte float64 `json:"organoImporte"` // gasto de todo o órgano
+	Share         float64 `json:"share"`         // % dese gasto adxudicado a este provedor
+}
+
+type adxFile struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type adxContract struct {
+	Table      string    `json:"table"`
+	Expediente string    `json:"expediente"`
+	Obxecto    string    `json:"obxecto"`
+	Tipo       string    `json:"tipo"`
+	Adx        string    `json:"adxudicatario"` // o texto tal como vén na táboa
+	Importe    float64   `json:"importe"`
+	HasImporte bool      `json:"hasImporte"`
+	Data       string    `json:"data"`
+	URL        string    `json:"url"`
+	Files      []adxFile `json:"files"`
+}
+
+// adxEntry: unha liña do directorio
+type adxEntry struct {
+	ID      string  `json:"id"`
+	Label   string  `json:"label"`
+	NIF     string  `json:"nif,omitempty"`
+	Count   int     `json:"count"`
+	Importe float64 `json:"importe"`
+	Tables  int     `json:"tables"`
+	First   string  `json:"first,omitempty"`
+	Last    string  `json:"last,omitempty"`
+	URL     string  `json:"url"`
+	names   string  // textos do provedor, para a busca
+}
+
+type adxProfile struct {
+	ID        string         `json:"id"`
+	Label     string         `json:"label"`
+	NIF       string         `json:"nif,omitempty"`
+	Names     []supplierName `json:"names"`
+	Count     int            `json:"count"`
+	Importe   float64        `json:"importe"`
+	Tables    []adxAmount    `json:"tables"`
+	Organos   []adxOrgano    `json:"organos"`
+	Months    []adxAmount    `json:"months"`
+	Tipos     []adxAmount    `json:"tipos"`
+	Contracts []adxContract  `json:"contracts"`
+}
+
+// adxAcc: acumula adxAmount por clave
+type adxAcc map[string]*adxAmount
+
+func (a adxAcc) add(key string, fr flagRow) {
+	it := a[key]
+	if it == nil {
+		it = &adxAmount{Key: key}
+		a[key] = it
+	}
+	it.Count++
+	if fr.HasImporte {
+		it.Importe += fr.Importe
+	}
+}
+
+// list: de máis a menos importe (e contratos); con byKey, por clave (os meses)
+func (a adxAcc) list(byKey bool) []adxAmount {
+	out := make([]adxAmount, 0, len(a))
+	for _, it := range a {
+		out = append(out, *it)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !byKey {
+			if out[i].Importe != out[j].Importe {
+				return out[i].Importe > out[j].Importe
+			}
+			if out[i].Count != out[j].Count {
+				return out[i].Count > out[j].Count
+			}
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// adxDate: adxudicación ou, se non a hai, publicación
+func adxDate(fr flagRow) string {
+	if fr.DataAdx != "" {
+		return fr.DataAdx
+	}
+	return fr.Data
+}
+
+func adxProfileURL(base, id string) string {
+	return base + "/adjudicatary/" + url.PathEscape(id)
+}
+
+// adxDirectory: os provedores con algún contrato no concello que cumpren q
+func adxDirectory(ctx *flagContext, q, order string) ([]adxEntry, error) {
+	tables, err := listBaseTables(ctx.db)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*adxEntry{}
+	tablesOf := map[string]map[string]bool{}
+	for _, t := range tables {
+		rows, err := ctx.tableRows(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, fr := range rows {
+			if fr.SupplierID == "" {
+				continue
+			}
+			e := byID[fr.SupplierID]
+			if e == nil {
+				e = &adxEntry{ID: fr.SupplierID, Label: fr.Supplier, URL: adxProfileURL(ctx.base, fr.SupplierID)}
+				byID[fr.SupplierID] = e
+				tablesOf[fr.SupplierID] = map[string]bool{}
+			}
+			e.Count++
+			if fr.HasImporte {
+				e.Importe += fr.Importe
+			}
+			tablesOf[fr.SupplierID][t] = true
+			if d := adxDate(fr); d != "" {
+				if e.First == "" || d < e.First {
+					e.First = d
+				}
+				if d > e.Last {
+					e.Last = d
+				}
+			}
+		}
+	}
+	if ctx.sup != nil {
+		for _, sp := range ctx.sup.list {
+			if e := byID[sp.ID]; e != nil {
+				e.NIF = sp.NIF
+				for _, n := range sp.Names {
+					e.names += " " + n.Name
+				}
+			}
+		}
+	}
+
+	q = adxNormKey(q)
+	out := []adxEntry{}
+	for id, e := range byID {
+		e.Tables = len(tablesOf[id])
+		if q != "" && !strings.Contains(adxNormKey(e.Label+" "+e.ID+" "+e.NIF+e.names), q) {
+			continue
+		}
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		switch order {
+		case "count":
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+		case "name":
+			if ka, kb := adxNormKey(a.Label), adxNormKey(b.Label); ka != kb {
+				return ka < kb
+			}
+		default:
+			if a.Importe != b.Importe {
+				return a.Importe > b.Importe
+			}
+		}
+		return a.ID < b.ID
+	})
+	return out, nil
+}
+
+// adxProfileFor: a ficha do provedor id (nil se non ten contratos no concello)
+func adxProfileFor(ctx *flagContext, id string) (*adxProfile, error) {
+	tables, err := listBaseTables(ctx.db)
+	if err != nil {
+		return nil, err
+	}
+	p := &adxProfile{ID: id, Names: []supplierName{}, Contracts: []adxContract{}}
+	byTable, byOrgano, byMonth, byTipo := adxAcc{}, adxAcc{}, adxAcc{}, adxAcc{}
+	organoTotal := map[string]float64{}
+	for _, t := range tables {
+		rows, err := ctx.tableRows(t)
+		if err != nil {
+			return nil, err
+		}
+		org := organoFromTable(t)
+		var files map[string][]string
+		for _, fr := range rows {
+			if fr.HasImporte {
+				organoTotal[org] += fr.Importe
+			}
+			if fr.SupplierID != id {
+				continue
+			}
+			if p.Label == "" {
+				p.Label = fr.Supplier
+			}
+			p.Count++
+			if fr.HasImporte {
+				p.Importe += fr.Importe
+			}
+			byTable.add(t, fr)
+			byOrgano.add(org, fr)
+			d := adxDate(fr)
+			if len(d) >= 7 {
+				byMonth.add(d[:7], fr)
+			}
+			tipo := fr.Tipo
+			if tipo == "" {
+				tipo = "(Sen tipo)"
+			}
+			byTipo.add(tipo, fr)
+
+			if files == nil {
+				if files, err = feedFiles(ctx, t); err != nil {
+					return nil, err
+				}
+				if files == nil {
+					files = map[string][]string{}
+				}
+			}
+			c := adxContract{Table: t, Expediente: fr.Expediente, Obxecto: fr.Obxecto, Tipo: fr.Tipo, Adx: fr.Adx,
+				Importe: fr.Importe, HasImporte: fr.HasImporte, Data: d, URL: fr.URL, Files: []adxFile{}}
+			for _, f := range files[fr.Expediente] {
+				c.Files = append(c.Files, adxFile{Name: f, URL: pdfURL(ctx.base, t, fr.Expediente, f)})
+			}
+			p.Contracts = append(p.Contracts, c)
+		}
+	}
+	if p.Count == 0 {
+		return nil, nil
+	}
+	if ctx.sup != nil {
+		for _, sp := range ctx.sup.list {
+			if sp.ID == id {
+				p.Label, p.NIF, p.Names = sp.Label, sp.NIF, sp.Names
+				break
+			}
+		}
+	}
+
+	p.Tables, p.Months, p.Tipos = byTable.list(false), byMonth.list(true), byTipo.list(false)
+	for _, o := range byOrgano.list(false) {
+		og := adxOrgano{adxAmount: o, OrganoImporte: organoTotal[o.Key]}
+		if og.OrganoImporte > 0 {
+			og.Share = 100 * o.Importe / og.OrganoImporte
+		}
+		p.Organos = append(p.Organos, og)
+	}
+	sort.SliceStable(p.Contracts, func(i, j int) bool { return p.Contracts[i].Data > p.Contracts[j].Data })
+	return p, nil
+}
+
+func (s *server) adxContext(r *http.Request) *flagContext {
+	return newFlagContext(s.concello(r).DB, s.suppliers(), basePath(r))
+}
+
+func (s *server) handleAdjudicatary(w http.ResponseWriter, r *http.Request) {
+	ctx := s.adxContext(r)
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/adjudicatary"), "/"); id != "" {
+		p, err := adxProfileFor(ctx, id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		months := make([]string, len(p.Months))
+		counts := make([]int, len(p.Months))
+		amounts := make([]float64, len(p.Months))
+		for i, m := range p.Months {
+			months[i], counts[i], amounts[i] = m.Key, m.Count, m.Importe
+		}
+		data := map[string]any{
+			"P":           p,
+			"MesLabels":   months,
+			"MesCounts":   counts,
+			"MesImportes": amounts,
+			"FeedURL":     basePath(r) + "/feeds/adxudicatario/" + url.PathEscape(p.ID) + ".atom",
+		}
+		if err := s.tpl.ExecuteTemplate(w, "adjudicatary_profile.gohtml", s.pageData(r, data)); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	order := r.URL.Query().Get("order")
+	list, err := adxDirectory(ctx, q, order)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	pages := (len(list) + adxPerPage - 1) / adxPerPage
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	if pages > 0 && page > pages {
+		page = pages
+	}
+	from := (page - 1) * adxPerPage
+	to := min(from+adxPerPage, len(list))
+	data := map[string]any{
+		"Q":        q,
+		"Order":    order,
+		"Total":    len(list),
+		"Items":    list[from:to],
+		"Page":     page,
+		"Pages":    pages,
+		"PrevPage": page - 1,
+		"NextPage": page + 1,
+	}
+	if err := s.tpl.ExecuteTemplate(w, "adjudicatary.gohtml", s.pageData(r, data)); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *server) handleAPIAdjudicatary(w http.ResponseWriter, r *http.Request) {
+	ctx := s.adxContext(r)
+	var out any
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/adjudicatary"), "/"); id != "" {
+		p, err := adxProfileFor(ctx, id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		out = p
+	} else {
+		list, err := adxDirectory(ctx, strings.TrimSpace(r.URL.Query().Get("q")), r.URL.Query().Get("order"))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		out = map[string]any{"total": len(list), "adjudicatarios": list}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
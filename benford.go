@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// ==== Lei de Benford e importes redondos ====
+// Primeira revisión para xornalistas: en importes "naturais" o primeiro díxito segue
+// log10(1+1/d) (un 1 no 30%, un 9 no 5%). Calculamos a distribución do primeiro díxito e dos
+// dous primeiros por táboa, por órgano e por adxudicatario, e comparámola coa esperada con:
+//
+//   - chi cadrado (con moitos datos case todo sae significativo)
+//   - MAD, desviación media absoluta das proporcións, cos cortes de Nigrini
+//
+// Á parte, cantos importes son redondos. Unha desviación non é proba de nada.
+
+const (
+	benfordMinAdx = 20 // adxudicatarios con menos importes non se amosan
+)
+
+// cortes de MAD de Nigrini (primeiro díxito, dous primeiros)
+var (
+	benfordMADFirst = [3]float64{0.006, 0.012, 0.015}
+	benfordMADTwo   = [3]float64{0.0012, 0.0018, 0.0022}
+)
+
+// valores críticos do chi cadrado ao 5% (8 e 89 graos de liberdade)
+const (
+	benfordChiFirst = 15.507
+	benfordChiTwo   = 112.022
+)
+
+// conformidade segundo o MAD
+const (
+	benfordClose      = "próxima"
+	benfordAcceptable = "aceptable"
+	benfordMarginal   = "marxinal"
+	benfordNonconform = "non conforme"
+)
+
+// proporcións esperadas: díxitos 1..9 e 10..99
+var benfordFirst, benfordTwo = benfordExpected()
+
+func benfordExpected() (first [9]float64, two [90]float64) {
+	for d := 1; d <= 9; d++ {
+		first[d-1] = math.Log10(1 + 1/float64(d))
+	}
+	for d := 10; d <= 99; d++ {
+		two[d-10] = math.Log10(1 + 1/float64(d))
+	}
+	return
+}
+
+// leadingDigits: o primeiro díxito significativo e os dous primeiros (5 € → 5 e 50)
+func leadingDigits(v float64) (first, two int) {
+	if v <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, 0
+	}
+	// en notación científica non hai ceros á esquerda nin problemas cos céntimos; con 12 decimais
+	// non se redondea 1.999,99 a 2.000
+	s := strconv.FormatFloat(v, 'e', 12, 64) // "1.999990000000e+03"
+	first = int(s[0] - '0')
+	two = first*10 + int(s[2]-'0')
+	return first, two
+}
+
+type benfordDist struct {
+	Group         string  `json:"group"` // taboa, organo, adxudicatario
+	Key           string  `json:"key"`
+	Label         string  `json:"label"`
+	N             int     `json:"n"`
+	First         []int   `json:"first"`    // contas dos díxitos 1..9
+	FirstTwo      []int   `json:"firstTwo"` // contas de 10..99
+	ChiFirst      float64 `json:"chiFirst"`
+	MADFirst      float64 `json:"madFirst"`
+	ChiTwo        float64 `json:"chiTwo"`
+	MADTwo        float64 `json:"madTwo"`
+	Conformity    string  `json:"conformity"` // polo MAD do primeiro díxito
+	ConformityTwo string  `json:"conformityTwo"`
+	ChiSig        bool    `json:"chiSignificant"` // chi cadrado por riba do crítico ao 5%
+	ChiTwoSig     bool    `json:"chiTwoSignificant"`
+}
+
+func newBenfordDist(group, key, label string) *benfordDist {
+	return &benfordDist{Group: group, Key: key, Label: label, First: make([]int, 9), FirstTwo: make([]int, 90)}
+}
+
+func (d *benfordDist) add(v float64) {
+	f, t := leadingDigits(v)
+	if f == 0 {
+		return
+	}
+	d.N++
+	d.First[f-1]++
+	d.FirstTwo[t-10]++
+}
+
+// chiMAD: chi cadrado e MAD das contas fronte ás proporcións esperadas
+func chiMAD(counts []int, expected []float64, n int) (chi, mad float64) {
+	if n == 0 {
+		return 0, 0
+	}
+	for i, c := range counts {
+		e := expected[i] * float64(n)
+		chi += (float64(c) - e) * (float64(c) - e) / e
+		mad += math.Abs(float64(c)/float64(n) - expected[i])
+	}
+	return chi, mad / float64(len(counts))
+}
+
+func (d *benfordDist) finish() {
+	d.ChiFirst, d.MADFirst = chiMAD(d.First, benfordFirst[:], d.N)
+	d.ChiTwo, d.MADTwo = chiMAD(d.FirstTwo, benfordTwo[:], d.N)
+	d.ChiSig, d.ChiTwoSig = d.ChiFirst > benfordChiFirst, d.ChiTwo > benfordChiTwo
+	d.Conformity, d.ConformityTwo = madConformity(d.MADFirst, benfordMADFirst), madConformity(d.MADTwo, benfordMADTwo)
+}
+
+func madConformity(mad float64, cuts [3]float64) string {
+	switch {
+	case mad <= cuts[0]:
+		return benfordClose
+	case mad <= cuts[1]:
+		return benfordAcceptable
+	case mad <= cuts[2]:
+		return benfordMarginal
+	}
+	return benfordNonconform
+}
+
+// clases de importe redondo, da máis redonda á menos; cada importe vai na primeira que cumpre
+var roundClasses = []struct {
+	label string
+	mod   float64
+}{
+	{"múltiplo de 1.000", 1000},
+	{"múltiplo de 100", 100},
+	{"múltiplo de 10", 10},
+	{"euros enteiros", 1},
+	{"con céntimos", 0},
+}
+
+func roundClass(v float64) int {
+	cents := math.Round(v * 100)
+	for i, c := range roundClasses {
+		if c.mod == 0 || math.Mod(cents, c.mod*100) == 0 {
+			return i
+		}
+	}
+	return len(roundClasses) - 1
+}
+
+type roundHist struct {
+	Key    string `json:"key"`
+	N      int    `json:"n"`
+	Counts []int  `json:"counts"` // na orde de roundClasses
+}
+
+type benfordReport struct {
+	Expected struct {
+		First    []float64 `json:"first"`
+		FirstTwo []float64 `json:"firstTwo"`
+	} `json:"expected"`
+	Tables      []*benfordDist `json:"tables"`
+	Organos     []*benfordDist `json:"organos"`
+	Adx         []*benfordDist `json:"adxudicatarios"`
+	RoundLabels []string       `json:"roundLabels"`
+	Round       []roundHist    `json:"round"` // por táboa
+}
+
+// benfordAnalysis le os importes (coa mesma lectura que as alertas) e agrupa
+func benfordAnalysis(ctx *flagContext) (*benfordReport, error) {
+	tables, err := listBaseTables(ctx.db)
+	if err != nil {
+		return nil, err
+	}
+	rep := &benfordReport{Tables: []*benfordDist{}, Organos: []*benfordDist{}, Adx: []*benfordDist{}, Round: []roundHist{}}
+	rep.Expected.First, rep.Expected.FirstTwo = benfordFirst[:], benfordTwo[:]
+	for _, c := range roundClasses {
+		rep.RoundLabels = append(rep.RoundLabels, c.label)
+	}
+
+	organos, adx := map[string]*benfordDist{}, map[string]*benfordDist{}
+	for _, t := range tables {
+		rows, err := ctx.tableRows(t)
+		if err != nil {
+			return nil, err
+		}
+		td := newBenfordDist("taboa", t, t)
+		rh := roundHist{Key: t, Counts: make([]int, len(roundClasses))}
+		org := organoFromTable(t)
+		if organos[org] == nil {
+			organos[org] = newBenfordDist("organo", org, org)
+		}
+		for _, fr := range rows {
+			if !fr.HasImporte || fr.Importe <= 0 {
+				continue
+			}
+			td.add(fr.Importe)
+			organos[org].add(fr.Importe)
+			if fr.SupplierID != "" {
+				if adx[fr.SupplierID] == nil {
+					adx[fr.SupplierID] = newBenfordDist("adxudicatario", fr.SupplierID, fr.Supplier)
+				}
+				adx[fr.SupplierID].add(fr.Importe)
+			}
+			rh.N++
+			rh.Counts[roundClass(fr.Importe)]++
+		}
+		if td.N == 0 {
+			continue
+		}
+		td.finish()
+		rep.Tables = append(rep.Tables, td)
+		rep.Round = append(rep.Round, rh)
+	}
+	for _, d := range organos {
+		if d.N > 0 {
+			d.finish()
+			rep.Organos = append(rep.Organos, d)
+		}
+	}
+	for _, d := range adx {
+		if d.N >= benfordMinAdx {
+			d.finish()
+			rep.Adx = append(rep.Adx, d)
+		}
+	}
+	// os que máis se afastan primeiro
+	for _, ds := range [][]*benfordDist{rep.Organos, rep.Adx} {
+		sort.Slice(ds, func(i, j int) bool {
+			if ds[i].MADFirst != ds[j].MADFirst {
+				return ds[i].MADFirst > ds[j].MADFirst
+			}
+			return ds[i].Key < ds[j].Key
+		})
+	}
+	return rep, nil
+}
+
+// ==== /analysis/benford e /api/analysis/benford ====
+
+func (s *server) benfordReport(r *http.Request) (*benfordReport, error) {
+	c := s.concello(r)
+	return benfordAnalysis(newFlagContext(c.DB, s.suppliers(), basePath(r)))
+}
+
+func (s *server) handleBenford(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.benfordReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var dists []*benfordDist
+	dists = append(append(append(dists, rep.Tables...), rep.Organos...), rep.Adx...)
+	data := map[string]any{
+		"Dists":       dists,
+		"Expected":    rep.Expected.First,
+		"ExpectedTwo": rep.Expected.FirstTwo,
+		"RoundLabels": rep.RoundLabels,
+		"Round":       rep.Round,
+		"MinAdx":      benfordMinAdx,
+	}
+	if err := s.tpl.ExecuteTemplate(w, "benford.gohtml", s.pageData(r, data)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *server) handleAPIBenford(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.benfordReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(rep)
+}
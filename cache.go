@@ -0,0 +1,455 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==== Caché tipada (índice sombra) ====
+// O ficheiro do scrapper ábrese en só lectura e todo nel é texto: importes "12.345,67",
+// datas ao final de Estado/Fechas... Para non reparsear en cada consulta, construímos un
+// SQLite compañeiro (<db>.cache.sqlite) cunha táboa lb_<táboa> por cada táboa base, con:
+//
+//	src_rowid    rowid da fila orixinal (para o JOIN)
+//	lb_importe   REAL
+//	lb_data_pub  data de publicación ISO (YYYY-MM-DD)
+//	lb_data_fin  fin do prazo de presentación ISO
+//	lb_data_adx  data de adxudicación ISO
+//	lb_adx_key   adxudicatario normalizado
+//	lb_table     táboa de orixe
+//	lb_organo    órgano (Alcaldia, Pleno, Xunta de Goberno...) tirado do nome da táboa
+//
+// Ademais, lb_fts_<táboa> é o índice de texto completo da busca (ver search.go).
+// A caché anéxase (ATTACH ... AS lbcache) en cada conexión, e os handlers consultan as
+// columnas tipadas con typedSource. Se non hai caché, caese ás expresións de texto de sempre.
+
+const (
+	cacheSchema  = "lbcache"
+	typedAlias   = "lb"
+	cacheVersion = 4
+)
+
+// ruta da caché, ao lado do ficheiro orixinal
+func cachePath(dbPath string) string {
+	return stripExt(dbPath) + ".cache.sqlite"
+}
+
+func isCacheFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".cache.sqlite")
+}
+
+func typedTableName(table string) string { return "lb_" + table }
+
+// órgano a partir do nome da táboa: "Xunta_de_Goberno_licitacions" -> "Xunta de Goberno"
+func organoFromTable(table string) string {
+	low := strings.ToLower(table)
+	for _, suf := range []string{"_contratos_menores", "_licitacions"} {
+		if strings.HasSuffix(low, suf) {
+			table = table[:len(table)-len(suf)]
+			break
+		}
+	}
+	return strings.ReplaceAll(table, "_", " ")
+}
+
+// chave normalizada do adxudicatario: sen acentos, minúsculas e espazos colapsados
+func adxNormKey(s string) string {
+	return strings.Join(strings.Fields(asciiFold(s)), " ")
+}
+
+// --- construción ---
+
+// cacheSource: tamaño e mtime do .db co que se construíu a caché; ok=false se non hai caché
+// ou se non vale para este binario
+func cacheSource(dbPath string) (size, mtime int64, ok bool) {
+	cache := cachePath(dbPath)
+	if _, err := os.Stat(cache); err != nil {
+		return 0, 0, false
+	}
+	db, err := sql.Open("sqlite3", readOnlyURI(cache))
+	if err != nil {
+		return 0, 0, false
+	}
+	defer db.Close()
+	var version int
+	var fts, roles string
+	err = db.QueryRow(`SELECT size, mtime, version, fts, roles FROM lb_source`).Scan(&size, &mtime, &version, &fts, &roles)
+	// o módulo FTS tamén conta: un índice fts5 non se pode ler cun binario sen fts5;
+	// e os roles de columna (--roles) deciden que columnas se tipan
+	return size, mtime, err == nil && version == cacheVersion && fts == ftsModule() && roles == rolesFingerprint()
+}
+
+// cacheFresh indica se a caché existe e corresponde ao ficheiro orixinal actual
+func cacheFresh(dbPath string) bool {
+	src, err := os.Stat(dbPath)
+	if err != nil {
+		return false
+	}
+	size, mtime, ok := cacheSource(dbPath)
+	return ok && size == src.Size() && mtime == src.ModTime().Unix()
+}
+
+// cacheBuildMu: unha construción de cada vez (servidor, alertas e historial comparten o .tmp)
+var cacheBuildMu sync.Mutex
+
+// ensureCache reconstrúe a caché se falta ou está vella
+func ensureCache(dbPath string) error {
+	cacheBuildMu.Lock()
+	defer cacheBuildMu.Unlock()
+	if cacheFresh(dbPath) {
+		return nil
+	}
+	return buildCache(dbPath)
+}
+
+// buildCache constrúe a caché nun ficheiro temporal e substitúe a anterior
+func buildCache(dbPath string) error {
+	start := time.Now()
+	st, err := os.Stat(dbPath)
+	if err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", readOnlyURI(dbPath))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := cachePath(dbPath) + ".tmp"
+	_ = os.Remove(tmp)
+	dst, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer dst.Close()
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		CREATE TABLE lb_source (path TEXT, size INTEGER, mtime INTEGER, version INTEGER, fts TEXT, roles TEXT, built_at TEXT);
+		CREATE TABLE lb_meta (tabname TEXT PRIMARY KEY, importe_col TEXT, date_col TEXT, adx_col TEXT, fts TEXT, rows INTEGER);
+	`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO lb_source VALUES (?,?,?,?,?,?,?)`,
+		dbPath, st.Size(), st.ModTime().Unix(), cacheVersion, ftsModule(), rolesFingerprint(), time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	bases, err := listBaseTables(src)
+	if err != nil {
+		return err
+	}
+	for _, t := range bases {
+		n, err := buildTypedTable(src, tx, t)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		log.Printf("caché: %s → %d filas", t, n)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cachePath(dbPath)); err != nil {
+		return err
+	}
+	log.Printf("caché %s construída en %s", cachePath(dbPath), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func buildTypedTable(src *sql.DB, tx *sql.Tx, table string) (int, error) {
+	cols, err := tableColumns(src, table)
+	if err != nil {
+		return 0, err
+	}
+	importeCol := roleColumn(table, cols, roleImporte)
+	dateCol := roleColumn(table, cols, roleData)
+	adxCol := roleColumn(table, cols, roleAdx)
+
+	tt := quoteIdent(typedTableName(table))
+	if _, err := tx.Exec(fmt.Sprintf(`
+		CREATE TABLE %[1]s (
+			src_rowid   INTEGER PRIMARY KEY,
+			lb_importe  REAL,
+			lb_data_pub TEXT,
+			lb_data_fin TEXT,
+			lb_data_adx TEXT,
+			lb_adx_key  TEXT,
+			lb_table    TEXT,
+			lb_organo   TEXT
+		);
+		CREATE INDEX %[2]s ON %[1]s (lb_importe);
+		CREATE INDEX %[3]s ON %[1]s (lb_data_pub);
+		CREATE INDEX %[4]s ON %[1]s (lb_adx_key);
+	`, tt,
+		quoteIdent("ix_"+typedTableName(table)+"_imp"),
+		quoteIdent("ix_"+typedTableName(table)+"_pub"),
+		quoteIdent("ix_"+typedTableName(table)+"_adx"),
+	)); err != nil {
+		return 0, err
+	}
+
+	colOrNull := func(name string) string {
+		if name == "" {
+			return "NULL"
+		}
+		return quoteIdent(name)
+	}
+	rows, err := src.Query(fmt.Sprintf(`SELECT rowid, %s, %s, %s FROM %s`,
+		colOrNull(importeCol), colOrNull(dateCol), colOrNull(adxCol), quoteIdent(table)))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	ins, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s VALUES (?,?,?,?,?,?,?,?)`, tt))
+	if err != nil {
+		return 0, err
+	}
+	defer ins.Close()
+
+	organo := organoFromTable(table)
+	nullStr := func(s string) any {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	n := 0
+	for rows.Next() {
+		var rowid int64
+		var imp, date, adx sql.NullString
+		if err := rows.Scan(&rowid, &imp, &date, &adx); err != nil {
+			return n, err
+		}
+		var importe any
+		if f, ok := parseEuroNumber(imp.String); ok {
+			importe = f
+		}
+		dates := extractDates(date.String)
+		pub, fin, adj := pickDate(dates, datePub), pickDate(dates, dateFin), pickDate(dates, dateAdx)
+		if _, err := ins.Exec(rowid, importe, nullStr(pub), nullStr(fin), nullStr(adj), nullStr(adxNormKey(adx.String)), table, organo); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+
+	// índice de texto completo; se o binario non ten FTS, a busca segue con LIKE
+	fts := ftsModule()
+	if fts != "" {
+		if err := buildFTSTable(src, tx, table, cols, fts); err != nil {
+			return n, err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO lb_meta VALUES (?,?,?,?,?,?)`, table, importeCol, dateCol, adxCol, fts, n)
+	return n, err
+}
+
+// --- lectura ---
+
+// typedMeta: columnas orixinais que ten tipadas a caché para unha táboa
+type typedMeta struct {
+	ImporteCol, DateCol, AdxCol string
+	FTS                         string // módulo do índice de texto ("fts5", "fts4" ou "")
+}
+
+// cacheMeta le lb_meta da caché anexada; ok=false se non hai caché para a táboa
+func cacheMeta(db *sql.DB, table string) (typedMeta, bool) {
+	var m typedMeta
+	if dbDialect.Name() != "sqlite" {
+		return m, false // a caché é un SQLite anexado
+	}
+	if st := cacheStateOf(db); st != nil && !st.usable() {
+		return m, false // o .db cambiou: SQL sen caché mentres se reconstrúe
+	}
+	var imp, date, adx, fts sql.NullString
+	err := db.QueryRow(`SELECT importe_col, date_col, adx_col, fts FROM `+cacheSchema+`.lb_meta WHERE tabname = ?`, table).
+		Scan(&imp, &date, &adx, &fts)
+	if err != nil {
+		return m, false
+	}
+	m.ImporteCol, m.DateCol, m.AdxCol, m.FTS = imp.String, date.String, adx.String, fts.String
+	return m, true
+}
+
+// typedSource describe de onde saen os valores tipados dunha táboa base
+type typedSource struct {
+	From    string // FROM, co JOIN á caché se existe
+	Importe string // expresión REAL do importe ("NULL" se non hai columna)
+	Date    string // data de publicación 'YYYY-MM-DD' (NULL se non se recoñece)
+	Month   string // expresión 'YYYY-MM'
+	AdxKey  string // chave normalizada do adxudicatario
+	Typed   bool
+}
+
+func tableSource(db *sql.DB, table string, cols []Column) typedSource {
+	if m, ok := cacheMeta(db, table); ok {
+		src := typedSource{
+			From: fmt.Sprintf(`%[1]s LEFT JOIN %[2]s.%[3]s %[4]s ON %[4]s.src_rowid = %[1]s.rowid`,
+				quoteIdent(table), cacheSchema, quoteIdent(typedTableName(table)), typedAlias),
+			Importe: "NULL", Date: "NULL", Month: "NULL", AdxKey: "NULL",
+			Typed: true,
+		}
+		if m.ImporteCol != "" {
+			src.Importe = typedAlias + ".lb_importe"
+		}
+		if m.DateCol != "" {
+			src.Date = typedAlias + ".lb_data_pub"
+			src.Month = "SUBSTR(" + typedAlias + ".lb_data_pub, 1, 7)"
+		}
+		if m.AdxCol != "" {
+			src.AdxKey = typedAlias + ".lb_adx_key"
+		}
+		return src
+	}
+
+	// sen caché: expresións sobre o texto orixinal
+	src := typedSource{From: quoteIdent(table), Importe: "NULL", Date: "NULL", Month: "NULL", AdxKey: "NULL"}
+	if c := roleColumn(table, cols, roleImporte); c != "" {
+		src.Importe = sqlToRealEuro(quoteIdent(c))
+	}
+	if c := roleColumn(table, cols, roleData); c != "" {
+		src.Date = isoDateExpr(c)
+		src.Month = monthKeyExpr(c)
+	}
+	if c := roleColumn(table, cols, roleAdx); c != "" {
+		src.AdxKey = adxKeyExpr(c)
+	}
+	return src
+}
+
+// typedOrder devolve FROM e expresión de orde tipada se a columna está na caché (importe)
+func typedOrder(db *sql.DB, table, col string) (from, expr string, ok bool) {
+	m, found := cacheMeta(db, table)
+	if !found || m.ImporteCol == "" || !strings.EqualFold(m.ImporteCol, col) {
+		return "", "", false
+	}
+	from = fmt.Sprintf(`%[1]s LEFT JOIN %[2]s.%[3]s %[4]s ON %[4]s.src_rowid = %[1]s.rowid`,
+		quoteIdent(table), cacheSchema, quoteIdent(typedTableName(table)), typedAlias)
+	return from, typedAlias + ".lb_importe", true
+}
+
+// --- caché viva ---
+// O scrapper pode reescribir o .db co servidor funcionando. Os rowid reutilízanse, así que
+// unha caché vella pegaría importes, datas e acertos FTS ás filas que non son. Antes de cada
+// consulta cacheMeta compara o tamaño e a mtime do .db cos da caché anexada: se cambiaron,
+// deixa de usala (SQL sen caché), reconstrúea en segundo plano e, ao acabar, vólvea anexar.
+// Cada cambio sobe a xeración, e as conexións do pool doutra xeración descártanse (cacheConn).
+
+// cacheRetry: tempo de espera antes de reintentar unha reconstrución que fallou
+const cacheRetry = time.Minute
+
+type cacheState struct {
+	dbPath string
+	gen    atomic.Int64
+
+	mu          sync.Mutex
+	attached    bool  // as conexións novas anexan a caché
+	size, mtime int64 // do .db ao que corresponde o anexado (ou do de ao abrir, se non hai caché)
+	live        bool  // reconstruír se cambia o .db (só os concellos do servidor)
+	rebuilding  bool
+	failedAt    time.Time
+}
+
+func newCacheState(dbPath string) *cacheState {
+	st := &cacheState{dbPath: dbPath}
+	if fi, err := os.Stat(dbPath); err == nil {
+		st.size, st.mtime = fi.Size(), fi.ModTime().Unix()
+	}
+	if useCache {
+		if size, mtime, ok := cacheSource(dbPath); ok {
+			// anéxase aínda que estea vella: usable() decide antes de cada consulta
+			st.attached, st.size, st.mtime = true, size, mtime
+		}
+	}
+	return st
+}
+
+// cacheStateOf: o estado da caché dunha base aberta con openSQLite (nil nas outras)
+func cacheStateOf(db *sql.DB) *cacheState {
+	if d, ok := db.Driver().(cacheDriver); ok {
+		return d.st
+	}
+	return nil
+}
+
+// watchCache marca a caché da base para reconstruíla cando cambie o .db
+func watchCache(db *sql.DB) {
+	if st := cacheStateOf(db); st != nil {
+		st.mu.Lock()
+		st.live = true
+		st.mu.Unlock()
+	}
+}
+
+// snapshot: se as conexións novas anexan a caché, e con que xeración
+func (st *cacheState) snapshot() (bool, int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.attached, st.gen.Load()
+}
+
+// usable indica se a caché anexada corresponde ao .db actual; se non, desanéxaa e,
+// se a base está vixiada, lanza a reconstrución
+func (st *cacheState) usable() bool {
+	fi, err := os.Stat(st.dbPath)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		return false
+	}
+	if size, mtime := fi.Size(), fi.ModTime().Unix(); size != st.size || mtime != st.mtime {
+		if st.attached {
+			st.attached = false
+			st.gen.Add(1)
+		}
+		st.size, st.mtime = size, mtime
+	}
+	if st.attached {
+		return true
+	}
+	if st.live && useCache && !st.rebuilding && time.Since(st.failedAt) > cacheRetry {
+		st.rebuilding = true
+		go st.rebuild()
+	}
+	return false
+}
+
+func (st *cacheState) rebuild() {
+	err := ensureCache(st.dbPath)
+	size, mtime, ok := cacheSource(st.dbPath)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.rebuilding = false
+	if err == nil && !ok {
+		err = fmt.Errorf("a caché construída non vale")
+	}
+	if err != nil {
+		log.Printf("WARN: non se puido reconstruír a caché de %s: %v", st.dbPath, err)
+		st.failedAt = time.Now()
+		return
+	}
+	// se o .db volveu cambiar mentres tanto, o seguinte usable() reconstrúe outra vez
+	st.failedAt = time.Time{}
+	st.attached, st.size, st.mtime = true, size, mtime
+	st.gen.Add(1)
+	log.Printf("caché de %s reconstruída", st.dbPath)
+}
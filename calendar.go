@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // Europe/Madrid aínda que o sistema non teña zoneinfo
+)
+
+// ==== /calendar.ics: prazos de presentación das licitacións ====
+// Un VEVENT por licitación aberta (o prazo non pasou e o Estado non a dá por pechada), de
+// xeito que as empresas poden subscribirse ao calendario. Filtros: table, tipo e q (a
+// linguaxe de /table); all=1 inclúe tamén as pechadas e as de prazo vencido.
+//
+// As horas van en hora de Madrid (TZID=Europe/Madrid co seu VTIMEZONE): o prazo remata ás
+// 23:59 se o texto non di outra hora, e o evento é a hora anterior ao peche.
+
+var madrid = mustLoadLocation("Europe/Madrid")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err) // con time/tzdata non debería pasar
+	}
+	return loc
+}
+
+// Europe/Madrid dende 1996: horario de verán do último domingo de marzo ao último de outubro
+const madridVTimezone = `BEGIN:VTIMEZONE
+TZID:Europe/Madrid
+BEGIN:DAYLIGHT
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+TZNAME:CEST
+DTSTART:19700329T020000
+RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU
+END:DAYLIGHT
+BEGIN:STANDARD
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+TZNAME:CET
+DTSTART:19701025T030000
+RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU
+END:STANDARD
+END:VTIMEZONE`
+
+// estados (sen acentos, minúsculas) que pechan a presentación de ofertas
+var closedEstados = []string{"resuelt", "adjudicad", "formalizad", "anulad", "desiert", "desist", "renuncia", "cerrad"}
+
+func isClosedEstado(estado string) bool {
+	e := strings.ToLower(asciiFold(estado))
+	for _, c := range closedEstados {
+		if strings.Contains(e, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// data seguida dunha hora: "03/02/2024 23:59", "03/02/2024 a las 14:00"
+var dateTimeRe = regexp.MustCompile(`(\d{1,2})[/.-](\d{1,2})[/.-](\d{4})\s*(?:a las\s*|as\s*|-\s*)?(\d{1,2}):(\d{2})`)
+
+// deadline: o fin do prazo de presentación en hora de Madrid
+func deadline(fr flagRow) (time.Time, bool) {
+	day, err := time.ParseInLocation("2006-01-02", fr.DataFin, madrid)
+	if err != nil {
+		return time.Time{}, false
+	}
+	h, m := 23, 59
+	for _, g := range dateTimeRe.FindAllStringSubmatch(asciiFold(fr.dataText), -1) {
+		if isoDate(g[1], g[2], g[3]) != fr.DataFin {
+			continue
+		}
+		var hh, mm int
+		if _, err := fmt.Sscanf(g[4]+":"+g[5], "%d:%d", &hh, &mm); err == nil && hh < 24 && mm < 60 {
+			h, m = hh, mm
+		}
+		break
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, madrid), true
+}
+
+// calendarTables: a táboa de ?table= ou todas as de licitacións
+func calendarTables(c *concelloDB, table string) ([]string, error) {
+	if table != "" {
+		if !tableExists(c.DB, table) {
+			return nil, fmt.Errorf("non existe a táboa %s", table)
+		}
+		return []string{table}, nil
+	}
+	bases, err := listBaseTables(c.DB)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, b := range bases {
+		if strings.Contains(strings.ToLower(b), "licitac") {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+// icsEscape: TEXT do RFC 5545
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsWriter escribe liñas con CRLF, dobradas a 75 octetos sen partir caracteres UTF-8
+type icsWriter struct {
+	b strings.Builder
+}
+
+func (iw *icsWriter) line(s string) {
+	for len(s) > 75 {
+		cut := 75
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		iw.b.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+	}
+	iw.b.WriteString(s + "\r\n")
+}
+
+func (iw *icsWriter) prop(name, value string) {
+	iw.line(name + ":" + value)
+}
+
+type calendarEvent struct {
+	fr    flagRow
+	id    string
+	at    time.Time
+	files []string
+}
+
+func (s *server) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	c := s.concello(r)
+	abs := absoluteBase(r) + basePath(r)
+	ctx := newFlagContext(c.DB, s.suppliers(), abs)
+	qv := r.URL.Query()
+
+	q := strings.TrimSpace(qv.Get("q"))
+	if tipo := strings.TrimSpace(qv.Get("tipo")); tipo != "" {
+		q = strings.TrimSpace(q + ` tipo:"` + strings.ReplaceAll(tipo, `"`, "") + `"`)
+	}
+	tables, err := calendarTables(c, strings.TrimSpace(qv.Get("table")))
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err := queryError(c.DB, tables, q); err != nil {
+		writeQueryError(w, q, err)
+		return
+	}
+	all := qv.Get("all") != ""
+
+	now := time.Now().In(madrid)
+	var events []calendarEvent
+	for _, t := range tables {
+		rows, err := ctx.readRows(t, q)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		files, err := feedFiles(ctx, t)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		seen := map[string]int{}
+		for _, fr := range rows {
+			id := feedID(c.Slug, fr, seen)
+			at, ok := deadline(fr)
+			if !ok {
+				continue
+			}
+			if !all && (at.Before(now) || isClosedEstado(fr.Estado)) {
+				continue
+			}
+			events = append(events, calendarEvent{fr: fr, id: id, at: at, files: files[fr.Expediente]})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+
+	// DTSTAMP: a data do .db, para que o ficheiro non cambie mentres non cambian os datos
+	stamp := time.Now().UTC()
+	if st, err := os.Stat(c.DBPath); err == nil {
+		stamp = st.ModTime().UTC()
+	}
+
+	var iw icsWriter
+	iw.prop("BEGIN", "VCALENDAR")
+	iw.prop("VERSION", "2.0")
+	iw.prop("PRODID", "-//licitaberto//prazos//GL")
+	iw.prop("CALSCALE", "GREGORIAN")
+	iw.prop("METHOD", "PUBLISH")
+	iw.prop("X-WR-CALNAME", icsEscape(c.Name+" · prazos de licitacións"))
+	iw.prop("X-WR-TIMEZONE", "Europe/Madrid")
+	for _, l := range strings.Split(madridVTimezone, "\n") {
+		iw.line(l)
+	}
+	for _, ev := range events {
+		fr := ev.fr
+		desc := []string{"Expediente: " + fr.Expediente}
+		if fr.Tipo != "" {
+			desc = append(desc, "Tipo: "+fr.Tipo)
+		}
+		if fr.HasImporte {
+			desc = append(desc, "Importe: "+formatEuroFloat(fr.Importe)+" €")
+		}
+		if fr.Estado != "" {
+			desc = append(desc, "Estado: "+fr.Estado)
+		}
+		desc = append(desc, "Fin de prazo: "+ev.at.Format("02/01/2006 15:04"))
+		if fr.URL != "" {
+			desc = append(desc, "", fr.URL)
+		}
+		if len(ev.files) > 0 {
+			desc = append(desc, "", "Documentos:")
+			for _, f := range ev.files {
+				desc = append(desc, pdfURL(abs, fr.Table, fr.Expediente, f))
+			}
+		}
+		summary := fr.Obxecto
+		if summary == "" {
+			summary = fr.Expediente
+		}
+
+		iw.prop("BEGIN", "VEVENT")
+		iw.prop("UID", strings.TrimPrefix(ev.id, "tag:licitaberto,2024:")+"@licitaberto") // o mesmo id que nos feeds
+		iw.prop("DTSTAMP", stamp.Format("20060102T150405Z"))
+		iw.prop("DTSTART;TZID=Europe/Madrid", ev.at.Add(-time.Hour).Format("20060102T150405"))
+		iw.prop("DTEND;TZID=Europe/Madrid", ev.at.Format("20060102T150405"))
+		iw.prop("SUMMARY", icsEscape("Fin de prazo: "+summary))
+		iw.prop("DESCRIPTION", icsEscape(strings.Join(desc, "\n")))
+		if fr.URL != "" {
+			iw.prop("URL", fr.URL)
+		}
+		iw.prop("CATEGORIES", icsEscape(fr.Table))
+		iw.prop("TRANSP", "TRANSPARENT")
+		// aviso o día anterior
+		iw.prop("BEGIN", "VALARM")
+		iw.prop("ACTION", "DISPLAY")
+		iw.prop("DESCRIPTION", icsEscape("Mañá remata o prazo: "+summary))
+		iw.prop("TRIGGER", "-P1D")
+		iw.prop("END", "VALARM")
+		iw.prop("END", "VEVENT")
+	}
+	iw.prop("END", "VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if _, err := w.Write([]byte(iw.b.String())); err != nil {
+		log.Printf("WARN: calendar.ics: %v", err)
+	}
+}
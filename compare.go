@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ==== Comparación entre concellos (/compare) ====
+// Anexamos (ATTACH DATABASE) os ficheiros dos concellos a unha conexión en memoria e
+// agregamos cada métrica nunha soa consulta sobre todas as táboas base, cunha serie por concello.
+//
+// Non pasa polo summaryEngine (summary.go): o motor fai as consultas táboa a táboa na conexión
+// dun concello (coa súa caché anexada), e aquí cada métrica é unha consulta sobre o UNION de
+// todos os concellos anexados, cunha serie por concello e non por táboa. O que si comparten
+// son as expresións (tipoKeyExpr, monthKeyExpr, adxKeyExpr, sqlToRealEuro), o filtro q
+// (buildFilter) e a resolución de provedores.
+
+// SQLITE_MAX_ATTACHED por defecto: se hai máis concellos, agregamos por lotes
+const maxAttached = 10
+
+type compareResult struct {
+	Q         string   `json:"q"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Concellos []string `json:"concellos"` // nomes das series, na mesma orde cas matrices
+	Slugs     []string `json:"slugs"`
+	SinData   []int    `json:"sinData"` // filas sen data recoñecible, por concello
+
+	// matrices [concello][etiqueta]
+	TiposLabels   []string    `json:"tiposLabels"`
+	TiposCounts   [][]int     `json:"tiposCounts"`
+	TiposImportes [][]float64 `json:"tiposImportes"`
+
+	MesLabels   []string    `json:"mesLabels"`
+	MesCounts   [][]int     `json:"mesCounts"`
+	MesImportes [][]float64 `json:"mesImportes"`
+
+	AdxLabels   []string    `json:"adxLabels"`
+	AdxCounts   [][]int     `json:"adxCounts"`
+	AdxImportes [][]float64 `json:"adxImportes"`
+
+	QErr error `json:"-"` // q non vale para ningunha das táboas
+}
+
+// acumulador dunha métrica: concello -> chave -> (conta, importe)
+type compareCell struct {
+	N   int
+	Imp float64
+}
+
+type compareAgg map[string]map[string]*compareCell
+
+func (a compareAgg) add(slug, key string, n int, imp float64) {
+	m, ok := a[slug]
+	if !ok {
+		m = map[string]*compareCell{}
+		a[slug] = m
+	}
+	v, ok := m[key]
+	if !ok {
+		v = &compareCell{}
+		m[key] = v
+	}
+	v.N += n
+	v.Imp += imp
+}
+
+// concellos seleccionados: ?c=ames&c=teo ou ?c=ames,teo; sen parámetro, todos
+func (s *server) compareSelection(r *http.Request) []*concelloDB {
+	var out []*concelloDB
+	for _, v := range r.URL.Query()["c"] {
+		for _, slug := range strings.Split(v, ",") {
+			if c := s.reg.get(strings.TrimSpace(slug)); c != nil {
+				out = append(out, c)
+			}
+		}
+	}
+	if len(out) == 0 {
+		out = s.reg.list
+	}
+	return out
+}
+
+// compareConcellos agrega tipos, meses e adxudicatarios dos concellos dados
+func compareConcellos(cs []*concelloDB, sup *supplierIndex, q, from, to string, top int) (*compareResult, error) {
+	if dbDialect.Name() != "sqlite" {
+		return nil, fmt.Errorf("a comparación entre concellos só funciona con ficheiros SQLite (ATTACH DATABASE)")
+	}
+	// from/to: aplícase fóra do UNION, sobre a columna data, para poder contar as filas sen data
+	rng, rargs := "1", []any(nil)
+	if from != "" || to != "" {
+		cond, args, err := dateTermSQL(qTerm{Op: "..", Value: from, To: to})
+		if err != nil {
+			return nil, err
+		}
+		rng, rargs = fmt.Sprintf(cond, "data"), args
+	}
+
+	// conexión única: os ATTACH son por conexión
+	mem, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+	mem.SetMaxOpenConns(1)
+	if err := registerSQLiteFuncs(mem); err != nil {
+		return nil, err
+	}
+
+	tipos, meses, adx, sinData := compareAgg{}, compareAgg{}, compareAgg{}, compareAgg{}
+	adxDisplay := map[string]string{}
+	var qErrs []error
+	qOK := false
+
+	for start := 0; start < len(cs); start += maxAttached {
+		batch := cs[start:min(start+maxAttached, len(cs))]
+
+		var aliases []string
+		for i, c := range batch {
+			alias := fmt.Sprintf("c%d", i)
+			if _, err := mem.Exec(fmt.Sprintf("ATTACH DATABASE ? AS %s", quoteIdent(alias)), readOnlyURI(c.DBPath)); err != nil {
+				detachAll(mem, aliases)
+				return nil, fmt.Errorf("%s: %w", c.Name, err)
+			}
+			aliases = append(aliases, alias)
+		}
+
+		union, args, errs := compareUnion(mem, batch, aliases, q)
+		qErrs = append(qErrs, errs...)
+		if union != "" {
+			qOK = true
+			err := compareBatch(mem, union, args, rng, rargs, tipos, meses, adx, sinData, sup, adxDisplay)
+			if err != nil {
+				detachAll(mem, aliases)
+				return nil, err
+			}
+		}
+		detachAll(mem, aliases)
+	}
+
+	out := &compareResult{Q: q, From: from, To: to}
+	// coma no resumo: as táboas que non entenden q quedan fóra; erro só se non a entende ningunha
+	if !qOK && len(qErrs) > 0 {
+		out.QErr = qErrs[0]
+	}
+	for _, c := range cs {
+		out.Concellos = append(out.Concellos, c.Name)
+		out.Slugs = append(out.Slugs, c.Slug)
+		n := 0
+		if v := sinData[c.Slug][""]; v != nil {
+			n = v.N
+		}
+		out.SinData = append(out.SinData, n)
+	}
+
+	// tipos: orde por conta total desc
+	out.TiposLabels = rankKeys(tipos, false, 0)
+	out.TiposCounts, out.TiposImportes = compareMatrix(tipos, out.Slugs, out.TiposLabels)
+
+	// meses: orde cronolóxica
+	out.MesLabels = rankKeys(meses, true, 0)
+	out.MesCounts, out.MesImportes = compareMatrix(meses, out.Slugs, out.MesLabels)
+
+	// top adxudicatarios por conta total
+	adxKeys := rankKeys(adx, false, top)
+	out.AdxCounts, out.AdxImportes = compareMatrix(adx, out.Slugs, adxKeys)
+	for _, k := range adxKeys {
+		out.AdxLabels = append(out.AdxLabels, adxDisplay[k])
+	}
+
+	return out, nil
+}
+
+// URI de só lectura para ATTACH (a conexión ábrese con SQLITE_OPEN_URI)
+func readOnlyURI(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	return "file:" + (&url.URL{Path: filepath.ToSlash(abs)}).EscapedPath() + "?mode=ro"
+}
+
+func detachAll(db *sql.DB, aliases []string) {
+	for _, a := range aliases {
+		_, _ = db.Exec("DETACH DATABASE " + quoteIdent(a))
+	}
+}
+
+// compareUnion constrúe un UNION ALL coas filas (concello, tipo, imp, data, mes, adxkey, adx)
+// de todas as táboas base dos concellos anexados. q vai por buildFilter sobre a conexión da
+// comparación, que non ten a caché: sae o SQL sen caché. As táboas nas que q non vale
+// quedan fóra e o seu erro vai en errs.
+func compareUnion(mem *sql.DB, batch []*concelloDB, aliases []string, q string) (string, []any, []error) {
+	var parts []string
+	var args []any
+	var errs []error
+	for i, c := range batch {
+		bases, err := listBaseTables(c.DB)
+		if err != nil {
+			continue
+		}
+		for _, t := range bases {
+			cols, err := tableColumns(c.DB, t)
+			if err != nil {
+				continue
+			}
+			flt, err := buildFilter(mem, t, cols, q)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			tipoCol := roleColumn(t, cols, roleTipo)
+			importeCol := roleColumn(t, cols, roleImporte)
+			adxCol := roleColumn(t, cols, roleAdx)
+			dateCol := roleColumn(t, cols, roleData)
+
+			tipo, imp, data, mes, adxKey, adxDisp := "NULL", "NULL", "NULL", "NULL", "NULL", "NULL"
+			if tipoCol != "" {
+				tipo = tipoKeyExpr(tipoCol)
+			}
+			if importeCol != "" {
+				imp = sqlToRealEuro(quoteIdent(importeCol))
+			}
+			if dateCol != "" {
+				data = isoDateExpr(dateCol)
+				mes = monthKeyExpr(dateCol)
+			}
+			if adxCol != "" {
+				adxKey = adxKeyExpr(adxCol)
+				adxDisp = fmt.Sprintf("TRIM(CAST(%s AS TEXT))", quoteIdent(adxCol))
+			}
+
+			parts = append(parts, fmt.Sprintf(
+				"SELECT ? AS concello, %s AS tipo, %s AS imp, %s AS data, %s AS mes, %s AS adxkey, %s AS adx FROM %s.%s %s",
+				tipo, imp, data, mes, adxKey, adxDisp, quoteIdent(aliases[i]), quoteIdent(t), flt.Where))
+			args = append(args, c.Slug)
+			args = append(args, flt.Args...)
+		}
+	}
+	return strings.Join(parts, "\nUNION ALL\n"), args, errs
+}
+
+func compareBatch(db *sql.DB, union string, args []any, rng string, rargs []any,
+	tipos, meses, adx, sinData compareAgg, sup *supplierIndex, adxDisplay map[string]string) error {
+	// as consultas con %[1]s levan o rango de datas (e os seus parámetros ao final)
+	scan := func(q string, fn func(rows *sql.Rows) error) error {
+		qargs := args
+		if strings.Contains(q, "%[1]s") {
+			q = fmt.Sprintf(q, rng)
+			qargs = append(append([]any{}, args...), rargs...)
+		}
+		rows, err := db.Query("WITH u AS (\n"+union+"\n) "+q, qargs...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := fn(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	err := scan(`SELECT concello, tipo, COUNT(*), COALESCE(SUM(imp),0) FROM u WHERE tipo IS NOT NULL AND %[1]s GROUP BY 1, 2`,
+		func(rows *sql.Rows) error {
+			var slug, k string
+			var n int
+			var imp float64
+			if err := rows.Scan(&slug, &k, &n, &imp); err != nil {
+				return err
+			}
+			tipos.add(slug, k, n, imp)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	// só filas con data recoñecida; as outras cóntanse á parte
+	err = scan(`SELECT concello, mes, COUNT(*), COALESCE(SUM(imp),0) FROM u
+		WHERE mes GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]' AND %[1]s GROUP BY 1, 2`,
+		func(rows *sql.Rows) error {
+			var slug, k string
+			var n int
+			var imp float64
+			if err := rows.Scan(&slug, &k, &n, &imp); err != nil {
+				return err
+			}
+			meses.add(slug, k, n, imp)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	err = scan(`SELECT concello, COUNT(*) FROM u WHERE mes IS NULL GROUP BY 1`,
+		func(rows *sql.Rows) error {
+			var slug string
+			var n int
+			if err := rows.Scan(&slug, &n); err != nil {
+				return err
+			}
+			sinData.add(slug, "", n, 0)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	// MIN(adx) é NULL se todas as filas do grupo teñen o texto a NULL: entón vale a chave
+	return scan(`SELECT concello, adxkey, COALESCE(MIN(adx), adxkey), COUNT(*), COALESCE(SUM(imp),0) FROM u
+		WHERE adxkey IS NOT NULL AND adxkey <> '' AND %[1]s GROUP BY 1, 2`,
+		func(rows *sql.Rows) error {
+			var slug, k, display string
+			var n int
+			var imp float64
+			if err := rows.Scan(&slug, &k, &display, &n, &imp); err != nil {
+				return err
+			}
+			// por provedor, para contar xuntas as variantes do nome
+			sp := sup.resolve(display)
+			adx.add(slug, sp.ID, n, imp)
+			if _, seen := adxDisplay[sp.ID]; !seen {
+				adxDisplay[sp.ID] = sp.Label
+			}
+			return nil
+		})
+}
+
+// rankKeys ordena as chaves dun acumulador: pola chave (byKey) ou pola conta total desc; top>0 corta
+func rankKeys(a compareAgg, byKey bool, top int) []string {
+	totals := map[string]int{}
+	for _, m := range a {
+		for k, v := range m {
+			totals[k] += v.N
+		}
+	}
+	keys := make([]string, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if byKey || totals[keys[i]] == totals[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return totals[keys[i]] > totals[keys[j]]
+	})
+	if top > 0 && len(keys) > top {
+		keys = keys[:top]
+	}
+	return keys
+}
+
+func compareMatrix(a compareAgg, slugs, keys []string) ([][]int, [][]float64) {
+	counts := make([][]int, len(slugs))
+	imps := make([][]float64, len(slugs))
+	for i, slug := range slugs {
+		counts[i] = make([]int, len(keys))
+		imps[i] = make([]float64, len(keys))
+		for j, k := range keys {
+			if v := a[slug][k]; v != nil {
+				counts[i][j] = v.N
+				imps[i][j] = v.Imp
+			}
+		}
+	}
+	return counts, imps
+}
+
+// /compare: páxina HTML (os datos cárganse desde /api/compare)
+func (s *server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	sel := map[string]bool{}
+	for _, c := range s.compareSelection(r) {
+		sel[c.Slug] = true
+	}
+	_ = s.tpl.ExecuteTemplate(w, "compare.gohtml", map[string]any{
+		"Concellos": s.reg.list,
+		"Selected":  sel,
+		"Q":         strings.TrimSpace(r.URL.Query().Get("q")),
+		"From":      r.URL.Query().Get("from"),
+		"To":        r.URL.Query().Get("to"),
+	})
+}
+
+// /api/compare?c=ames,teo&q=...&top=10
+func (s *server) handleAPICompare(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	from, to := dateRange(r)
+	top, _ := strconv.Atoi(r.URL.Query().Get("top"))
+	if top <= 0 {
+		top = 10
+	}
+	res, err := compareConcellos(s.compareSelection(r), s.suppliers(), q, from, to, top)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if res.QErr != nil {
+		writeQueryError(w, q, res.QErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// ==== Rexistro de concellos ====
+// Cada ficheiro SQLite do scrapper é un concello: ten a súa conexión, o seu
+// directorio de PDFs (PDF/CONCELHO/TABOA/EXPEDIENTE/) e un nome para amosar.
+
+type concelloDB struct {
+	Slug    string // identificador na URL: /{slug}/table/...
+	Name    string // nome para amosar ("Ames")
+	DBPath  string
+	PDFPath string
+	DB      *sql.DB
+}
+
+type registry struct {
+	list   []*concelloDB
+	bySlug map[string]*concelloDB
+}
+
+// extensións que recoñecemos como bases de datos do scrapper
+var sqliteExts = []string{".db", ".sqlite", ".sqlite3"}
+
+// expandDBPaths acepta ficheiros, listas separadas por comas e directorios
+// (dos que collemos todos os ficheiros SQLite) e devolve a lista de ficheiros
+func expandDBPaths(args []string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	for _, arg := range args {
+		for _, p := range strings.Split(arg, ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			if isPostgresDSN(p) {
+				add(p) // cada esquema será un concello (dialect_postgres.go)
+				continue
+			}
+			st, err := os.Stat(p)
+			if err != nil {
+				return nil, err
+			}
+			if !st.IsDir() {
+				add(p)
+				continue
+			}
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			var found []string
+			for _, e := range entries {
+				if e.IsDir() || !isSQLiteFile(e.Name()) {
+					continue
+				}
+				found = append(found, filepath.Join(p, e.Name()))
+			}
+			sort.Strings(found)
+			for _, f := range found {
+				add(f)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("non se atopou ningún ficheiro SQLite en %v", args)
+	}
+	return out, nil
+}
+
+func isSQLiteFile(name string) bool {
+	if isCacheFile(name) || isHistoryFile(name) || isDocsFile(name) {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range sqliteExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// useCache: construír/usar a caché tipada ao abrir cada concello (--cache)
+var useCache = true
+
+// deriva slug, nome e ruta de PDFs a partir da ruta do ficheiro SQLite
+func newConcelloDB(dbPath string) (*concelloDB, error) {
+	base := stripExt(filepath.Base(dbPath))
+
+	// caché tipada ao lado do ficheiro; se non se pode construír, seguimos sen ela
+	if useCache {
+		if err := ensureCache(dbPath); err != nil {
+			log.Printf("WARN: non se puido construír a caché de %s: %v", dbPath, err)
+		}
+	}
+
+	// historial: nova instantánea se o ficheiro cambiou dende a última
+	if useHistory {
+		if err := recordHistory(dbPath); err != nil {
+			log.Printf("WARN: non se puido gardar o historial de %s: %v", dbPath, err)
+		}
+	}
+
+	db, err := openSQLite(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dbPath, err)
+	}
+	if useCache {
+		watchCache(db) // o servidor segue aberto: se o scrapper reescribe o .db, reconstrúese
+	}
+
+	caser := cases.Title(language.EuropeanSpanish) // nh...
+	return &concelloDB{
+		Slug: slugify(base),
+		Name: caser.String(base),
+		// path fisico a PDFs. Hai que reemprazar "TABOA/EXPEDIENTE/" polo que toque "on the fly"
+		DBPath:  dbPath,
+		PDFPath: pdfPathFor(dbPath),
+		DB:      db,
+	}, nil
+}
+
+// PDF/CONCELHO/ ao lado do ficheiro SQLite
+func pdfPathFor(dbPath string) string {
+	return filepath.Join(filepath.Dir(dbPath), "PDF", stripExt(filepath.Base(dbPath)))
+}
+
+// slug apto para URL: minúsculas, sen acentos, só [a-z0-9_-]
+func slugify(s string) string {
+	s = asciiFold(strings.TrimSpace(s))
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r == ' ' || r == '.':
+			return '_'
+		}
+		return -1
+	}, s)
+	if s == "" {
+		s = "concello"
+	}
+	return s
+}
+
+func openRegistry(paths []string) (*registry, error) {
+	// un só motor por proceso: o dialecto é global
+	pg := 0
+	for _, p := range paths {
+		if isPostgresDSN(p) {
+			pg++
+		}
+	}
+	if pg > 0 && pg < len(paths) {
+		return nil, fmt.Errorf("non se poden mesturar ficheiros SQLite e PostgreSQL")
+	}
+	if pg > 0 {
+		dbDialect = pgDialect{}
+	}
+
+	reg := &registry{bySlug: map[string]*concelloDB{}}
+	for _, p := range paths {
+		var cs []*concelloDB
+		if isPostgresDSN(p) {
+			var err error
+			if cs, err = openPostgresConcellos(p); err != nil {
+				reg.Close()
+				return nil, err
+			}
+		} else {
+			c, err := newConcelloDB(p)
+			if err != nil {
+				reg.Close()
+				return nil, err
+			}
+			cs = []*concelloDB{c}
+		}
+		for _, c := range cs {
+			// dous ficheiros co mesmo nome en directorios distintos: desambiguamos
+			slug := c.Slug
+			for i := 2; reg.bySlug[c.Slug] != nil; i++ {
+				c.Slug = fmt.Sprintf("%s-%d", slug, i)
+			}
+			reg.bySlug[c.Slug] = c
+			reg.list = append(reg.list, c)
+		}
+	}
+	return reg, nil
+}
+
+func (reg *registry) Close() {
+	for _, c := range reg.list {
+		_ = c.DB.Close()
+	}
+}
+
+func (reg *registry) get(slug string) *concelloDB { return reg.bySlug[slug] }
+
+// concello por defecto (o primeiro), o que serve as rutas sen prefixo
+func (reg *registry) first() *concelloDB { return reg.list[0] }
+
+// ==== vixilancia dos .db no servidor ====
+// O scrapper reescribe os .db co servidor funcionando. Cada minuto mírase a mtime de cada un e,
+// se cambiou (e ao arrincar), márcase para reconstruír o índice de provedores, apúntase unha
+// instantánea no historial (--history) e avalíanse as buscas gardadas (--searches). Cada tarefa leva a súa mtime: a que falla vólvese tentar na
+// seguinte volta aínda que o ficheiro non cambie. A caché tipada revísase en cada consulta (cache.go).
+
+const watchInterval = time.Minute
+
+type watchTask struct {
+	name string
+	run  func(c *concelloDB, isDefault bool) error
+}
+
+// watchTasks: o que hai que facer cando cambia un .db
+func (s *server) watchTasks() []watchTask {
+	tasks := []watchTask{{"provedores", func(*concelloDB, bool) error {
+		// os adxudicatarios novos resólvense por NIF e semellanza coma os demais
+		s.invalidateSuppliers()
+		return nil
+	}}}
+	if useHistory {
+		tasks = append(tasks, watchTask{"historial", func(c *concelloDB, _ bool) error {
+			return recordHistory(c.DBPath)
+		}})
+	}
+	if savedSearches != nil {
+		tasks = append(tasks, watchTask{"buscas", func(c *concelloDB, isDefault bool) error {
+			return savedSearches.runSearches(c.Slug, c.DBPath, isDefault)
+		}})
+	}
+	return tasks
+}
+
+func (s *server) watchDBs(tasks []watchTask) {
+	done := map[string]time.Time{} // tarefa/slug -> mtime xa procesada
+	for {
+		for i, c := range s.reg.list {
+			if isPostgresDSN(c.DBPath) {
+				continue
+			}
+			fi, err := os.Stat(c.DBPath)
+			if err != nil {
+				continue
+			}
+			for _, t := range tasks {
+				key := t.name + "/" + c.Slug
+				if fi.ModTime().Equal(done[key]) {
+					continue
+				}
+				if err := t.run(c, i == 0); err != nil {
+					log.Printf("WARN: %s de %s: %v", t.name, c.Slug, err)
+					continue
+				}
+				done[key] = fi.ModTime()
+			}
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// ==== concello da petición ====
+
+type ctxKey int
+
+const concelloCtxKey ctxKey = 0
+
+type concelloReq struct {
+	c    *concelloDB
+	base string // prefixo das URLs: "" (rutas sen prefixo), "/{slug}" ou "/{slug}@{asOf}"
+	asOf string // data do historial ("" = agora)
+}
+
+// withConcello resolve o prefixo /{concello}/... e pasa a petición sen el ao mux interno.
+// Se o primeiro segmento non é un concello, úsase o concello por defecto.
+// /{concello}@AAAA-MM-DD/... ou ?asOf=AAAA-MM-DD serven o concello tal como estaba nesa data (history.go).
+func (s *server) withConcello(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		slug, asOf, _ := strings.Cut(first, "@")
+		if q := r.URL.Query().Get("asOf"); q != "" {
+			asOf = q
+		}
+		cr := concelloReq{c: s.reg.get(slug), base: "/" + slug}
+		r2 := r
+		if cr.c != nil {
+			r2 = r.Clone(r.Context())
+			r2.URL.Path = "/" + rest
+			r2.URL.RawPath = ""
+		} else {
+			cr = concelloReq{c: s.reg.first()}
+		}
+		if asOf != "" {
+			ac, release, err := asOfConcello(cr.c, asOf)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			defer release()
+			cr = concelloReq{c: ac, base: "/" + cr.c.Slug + "@" + asOf, asOf: asOf}
+		}
+		next.ServeHTTP(w, r2.WithContext(context.WithValue(r2.Context(), concelloCtxKey, cr)))
+	})
+}
+
+func (s *server) concello(r *http.Request) *concelloDB {
+	if cr, ok := r.Context().Value(concelloCtxKey).(concelloReq); ok {
+		return cr.c
+	}
+	return s.reg.first()
+}
+
+// prefixo para construír URLs do concello actual
+func basePath(r *http.Request) string {
+	cr, _ := r.Context().Value(concelloCtxKey).(concelloReq)
+	return cr.base
+}
+
+// pageData engade aos datos dun template o común a todas as páxinas (concello, prefixo, selector)
+func (s *server) pageData(r *http.Request, data map[string]any) map[string]any {
+	c := s.concello(r)
+	data["concello"] = c.Name
+	data["Slug"] = c.Slug
+	data["Base"] = basePath(r)
+	data["SubPath"] = r.URL.Path
+	data["Concellos"] = s.reg.list
+	data["Searches"] = savedSearches != nil
+	if cr, _ := r.Context().Value(concelloCtxKey).(concelloReq); cr.asOf != "" {
+		data["AsOf"] = cr.asOf
+	}
+	return data
+}
+
+// /pdfs/ do concello actual
+func (s *server) handlePDFs(w http.ResponseWriter, r *http.Request) {
+	c := s.concello(r)
+	http.StripPrefix("/pdfs/", http.FileServer(http.Dir(c.PDFPath))).ServeHTTP(w, r)
+}
+
+// landing: lista de todos os concellos cargados
+func (s *server) handleConcellos(w http.ResponseWriter, r *http.Request) {
+	type item struct {
+		Slug, Name string
+		Tables     int
+	}
+	var items []item
+	for _, c := range s.reg.list {
+		bases, _ := listBaseTables(c.DB)
+		items = append(items, item{Slug: c.Slug, Name: c.Name, Tables: len(bases)})
+	}
+	_ = s.tpl.ExecuteTemplate(w, "concellos.gohtml", map[string]any{"Items": items})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ==== Datas de Estado/Fechas ====
+// O scrapper garda as datas como texto libre: "Resuelta 12/05/2024",
+// "Fin de plazo de presentación: 03/02/2024 23:59 Publicación: 15/01/2024"...
+// extractDates recoñece todas as datas do campo e etiquétaas segundo o texto que as precede.
+
+// etiquetas de data
+const (
+	datePub = "pub" // publicación
+	dateFin = "fin" // fin de prazo de presentación
+	dateAdx = "adx" // adxudicación / resolución / formalización
+)
+
+type labeledDate struct {
+	Kind string // datePub, dateFin, dateAdx ou "" se non hai etiqueta
+	ISO  string // YYYY-MM-DD
+}
+
+var dateMonths = map[string]string{
+	"enero": "1", "xaneiro": "1", "febrero": "2", "febreiro": "2", "marzo": "3", "abril": "4",
+	"mayo": "5", "maio": "5", "junio": "6", "xuno": "6", "julio": "7", "xullo": "7", "agosto": "8",
+	"septiembre": "9", "setiembre": "9", "setembro": "9", "octubre": "10", "outubro": "10",
+	"noviembre": "11", "novembro": "11", "diciembre": "12", "decembro": "12",
+}
+
+// DD/MM/AAAA (tamén con - ou .), AAAA-MM-DD e "12 de marzo de 2024"; o texto xa vén sen acentos
+var dateAnyRe = regexp.MustCompile(`(\d{1,2})[/.-](\d{1,2})[/.-](\d{4})|(\d{4})-(\d{1,2})-(\d{1,2})|(\d{1,2}) de ([a-z]+) (?:de |do )?(\d{4})`)
+
+// palabras que etiquetan a data que segue; gaña a máis próxima á data
+var dateLabels = []struct{ word, kind string }{
+	{"publica", datePub},
+	{"anuncio", datePub},
+	{"plazo", dateFin}, {"prazo", dateFin}, {"presentacion", dateFin}, {"limite", dateFin},
+	{"adjudic", dateAdx}, {"adxudic", dateAdx}, {"resuel", dateAdx}, {"resolu", dateAdx}, {"resolv", dateAdx}, {"formaliz", dateAdx},
+}
+
+// extractDates devolve todas as datas válidas do texto, na orde na que aparecen
+func extractDates(s string) []labeledDate {
+	s = asciiFold(s)
+	var out []labeledDate
+	prev := 0
+	for _, m := range dateAnyRe.FindAllStringSubmatchIndex(s, -1) {
+		g := func(i int) string {
+			if m[2*i] < 0 {
+				return ""
+			}
+			return s[m[2*i]:m[2*i+1]]
+		}
+		var iso string
+		switch {
+		case g(1) != "":
+			iso = isoDate(g(1), g(2), g(3))
+		case g(4) != "":
+			iso = isoDate(g(6), g(5), g(4))
+		default:
+			if mm, ok := dateMonths[g(8)]; ok {
+				iso = isoDate(g(7), mm, g(9))
+			}
+		}
+		if iso == "" {
+			continue
+		}
+
+		// etiqueta: a palabra clave máis próxima no texto entre a data anterior e esta
+		before := s[prev:m[0]]
+		kind, at := "", -1
+		for _, l := range dateLabels {
+			if i := strings.LastIndex(before, l.word); i > at {
+				kind, at = l.kind, i
+			}
+		}
+		out = append(out, labeledDate{Kind: kind, ISO: iso})
+		prev = m[1]
+	}
+	return out
+}
+
+func isoDate(d, m, y string) string {
+	t, err := time.Parse("2/1/2006", d+"/"+m+"/"+y)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// pickDate escolle unha data dunha etiqueta. Para a publicación, se ningunha
+// vén etiquetada, vale a última (o que se usou sempre para os meses)
+func pickDate(dates []labeledDate, kind string) string {
+	for _, d := range dates {
+		if d.Kind == kind {
+			return d.ISO
+		}
+	}
+	if kind == datePub && len(dates) > 0 {
+		return dates[len(dates)-1].ISO
+	}
+	return ""
+}
+
+// lb_date(texto, etiqueta) para SQL: a mesma extracción cando non hai caché
+func sqlDate(s any, kind string) any {
+	str, ok := s.(string)
+	if !ok {
+		return nil
+	}
+	if iso := pickDate(extractDates(str), kind); iso != "" {
+		return iso
+	}
+	return nil
+}
+
+// dateRange le from/to da petición
+func dateRange(r *http.Request) (from, to string) {
+	return strings.TrimSpace(r.URL.Query().Get("from")), strings.TrimSpace(r.URL.Query().Get("to"))
+}
+
+// withDateRange engade from/to a q como un termo data:from..to da linguaxe de consulta.
+// Nas táboas sen columna de data (as _files) o rango non se aplica.
+func withDateRange(table string, cols []Column, q, from, to string) string {
+	if (from == "" && to == "") || !hasDateColumn(table, cols) {
+		return q
+	}
+	return strings.TrimSpace(q + " data:" + from + ".." + to)
+}
+
+// hasDateColumn indica se a táboa ten columna para o rol data
+func hasDateColumn(table string, cols []Column) bool {
+	return roleColumn(table, cols, roleData) != ""
+}
+
+// countUndated conta as filas que cumpren f pero non teñen ningunha data recoñecible
+// (quedan fóra dos meses e dos filtros from/to, e así o amosamos)
+func countUndated(db *sql.DB, table string, cols []Column, f tableFilter) int {
+	src := tableSource(db, table, cols)
+	if src.Date == "NULL" {
+		return 0
+	}
+	var n int
+	q := fmt.Sprintf("SELECT COUNT(*) FROM %s %s", src.From, andWhere(f.Where, src.Date+" IS NULL"))
+	_ = db.QueryRow(q, f.Args...).Scan(&n)
+	return n
+}
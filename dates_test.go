@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractDates(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []labeledDate
+	}{
+		{"", nil},
+		{"Sen data", nil},
+		{"Resuelta 12/05/2024", []labeledDate{{dateAdx, "2024-05-12"}}},
+		{"Fin de plazo de presentación: 03/02/2024 23:59 Publicación: 15/01/2024",
+			[]labeledDate{{dateFin, "2024-02-03"}, {datePub, "2024-01-15"}}},
+		{"Fin de prazo de presentación 3/2/2024 Data de publicación 15-1-2024",
+			[]labeledDate{{dateFin, "2024-02-03"}, {datePub, "2024-01-15"}}},
+		{"Adjudicada 01.07.2023", []labeledDate{{dateAdx, "2023-07-01"}}},
+		{"Formalizado 2024-1-9", []labeledDate{{dateAdx, "2024-01-09"}}},
+		{"Publicado el 12 de marzo de 2024", []labeledDate{{datePub, "2024-03-12"}}},
+		{"Adxudicado o 5 de xullo do 2023", []labeledDate{{dateAdx, "2023-07-05"}}},
+		{"Resolución: 3 de setembro de 2024", []labeledDate{{dateAdx, "2024-09-03"}}},
+		{"Data límite 1 de xuño de 2024", []labeledDate{{dateFin, "2024-06-01"}}},
+		{"Anuncio 20 de decembro 2023", []labeledDate{{datePub, "2023-12-20"}}},
+		{"12/05/2024", []labeledDate{{"", "2024-05-12"}}},
+		// datas que non existen ou meses descoñecidos
+		{"Resuelta 31/02/2024", nil},
+		{"Resuelta 12/13/2024", nil},
+		{"3 de brumario de 2024", nil},
+		// a etiqueta é a máis próxima antes da data, non a primeira
+		{"Publicado, con resolución 10/10/2024", []labeledDate{{dateAdx, "2024-10-10"}}},
+	}
+	for _, tt := range tests {
+		got := extractDates(tt.in)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("extractDates(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPickDate(t *testing.T) {
+	dates := extractDates("Fin de plazo de presentación: 03/02/2024 Resuelta 20/02/2024")
+	tests := []struct {
+		kind, want string
+	}{
+		{dateFin, "2024-02-03"},
+		{dateAdx, "2024-02-20"},
+		// sen data de publicación etiquetada vale a última
+		{datePub, "2024-02-20"},
+	}
+	for _, tt := range tests {
+		if got := pickDate(dates, tt.kind); got != tt.want {
+			t.Errorf("pickDate(%s) = %q, want %q", tt.kind, got, tt.want)
+		}
+	}
+	if got := pickDate(nil, datePub); got != "" {
+		t.Errorf("pickDate(nil) = %q", got)
+	}
+	if got := sqlDate(nil, datePub); got != nil {
+		t.Errorf("sqlDate(nil) = %v", got)
+	}
+	if got := sqlDate("Resuelta 12/05/2024", dateAdx); got != "2024-05-12" {
+		t.Errorf("sqlDate = %v", got)
+	}
+}
+
+func TestWithDateRange(t *testing.T) {
+	menores := []Column{{Name: "Expediente"}, {Name: "Importe"}, {Name: "Estado"}}
+	files := []Column{{Name: "Expediente"}, {Name: "filename"}}
+	tests := []struct {
+		table             string
+		cols              []Column
+		q, from, to, want string
+	}{
+		{"Alcaldia_contratos_menores", menores, "obras", "", "", "obras"},
+		{"Alcaldia_contratos_menores", menores, "obras", "2024-01", "", "obras data:2024-01.."},
+		{"Alcaldia_contratos_menores", menores, "", "", "2024", "data:..2024"},
+		{"Alcaldia_contratos_menores", menores, "tipo:Obras", "2024-01-01", "2024-06-30", "tipo:Obras data:2024-01-01..2024-06-30"},
+		// sen columna de data o rango non se aplica
+		{"Alcaldia_contratos_menores_files", files, "obras", "2024-01-01", "2024-06-30", "obras"},
+	}
+	for _, tt := range tests {
+		if got := withDateRange(tt.table, tt.cols, tt.q, tt.from, tt.to); got != tt.want {
+			t.Errorf("withDateRange(%s, %q, %q, %q) = %q, want %q", tt.table, tt.q, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ==== Dialecto SQL ====
+// O resto do programa escribe SQL portable (COALESCE, NULLIF, TRIM, SUBSTR(x, 1, n), LIMIT/OFFSET,
+// parámetros ?). O que cambia de motor a motor vai aquí: listar táboas e columnas, e as expresións
+// para buscar sen acentos, pasar texto a número e sacar a data dun texto libre.
+//
+// Un proceso traballa cun só motor: SQLite (ficheiros do scrapper) ou PostgreSQL (--db postgres://...).
+
+type dialect interface {
+	Name() string
+	ListTables(db *sql.DB) ([]string, error)
+	TableColumns(db *sql.DB, table string) ([]Column, error)
+
+	// Fold: texto en minúsculas e sen acentos (expr xa é texto)
+	Fold(expr string) string
+	// ToReal: texto numérico a número; euro=true para "12.345,67", false para "12345.67".
+	// Devolve NULL (non erro) se o texto non é un número.
+	ToReal(expr string, euro bool) string
+	// ISODate: 'YYYY-MM-DD' da data de publicación dun texto libre (Estado/Fechas), ou NULL
+	ISODate(expr string) string
+	// RowKey: columna que identifica a fila (desempate da paxinación por cursor) e como
+	// escribir un parámetro seu que chega como texto
+	RowKey() (col, param string)
+}
+
+// dialecto en uso; openRegistry cámbiao se os concellos veñen de Postgres
+var dbDialect dialect = sqliteDialect{}
+
+// --- SQLite ---
+// As funcións unaccent_lower e lb_date rexístranse en cada conexión (registerConnFuncs).
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) ListTables(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := []string{}
+	for rows.Next() {
+		var n string
+		rows.Scan(&n)
+		tables = append(tables, n)
+	}
+	return tables, rows.Err()
+}
+
+func (sqliteDialect) TableColumns(db *sql.DB, table string) ([]Column, error) {
+	q := fmt.Sprintf("PRAGMA table_info(%s)", quoteIdent(table))
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []Column{}
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull int
+		var dflt *string
+		var pk int
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		res = append(res, Column{Name: name, Type: ctype})
+	}
+	return res, nil
+}
+
+func (sqliteDialect) Fold(expr string) string {
+	return fmt.Sprintf("unaccent_lower(%s)", expr)
+}
+
+func (sqliteDialect) ToReal(expr string, euro bool) string {
+	if euro {
+		return fmt.Sprintf("CAST(REPLACE(REPLACE(%s, '.', ''), ',', '.') AS REAL)", expr)
+	}
+	return fmt.Sprintf("CAST(%s AS REAL)", expr)
+}
+
+func (sqliteDialect) RowKey() (string, string) { return "rowid", "CAST(? AS INTEGER)" }
+
+func (sqliteDialect) ISODate(expr string) string {
+	return fmt.Sprintf("lb_date(%s, '%s')", expr, datePub)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ==== Cambios entre dúas copias da base de datos ====
+// O scrapper sobrescribe o SQLite, así que gardamos a copia da semana pasada e comparamos:
+//
+//	licitaberto diff --format csv vella.db nova.db
+//	licitaberto --db nova.db --previous vella.db   # /changes no web
+//
+// As filas emparéllanse polo expediente (rol expediente) en cada táboa base. Saen os expedientes
+// novos, os eliminados e os campos que cambiaron (Estado, Importe...). Das táboas *_files
+// saen os ficheiros novos (PDFs publicados dende a outra copia).
+
+type diffField struct {
+	Column string `json:"column"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+}
+
+type diffRow struct {
+	Expediente string            `json:"expediente"`
+	Obxecto    string            `json:"obxecto"`
+	Row        map[string]string `json:"row,omitempty"`    // novos e eliminados: a fila enteira
+	Fields     []diffField       `json:"fields,omitempty"` // cambiados: só o que cambia
+}
+
+type diffFile struct {
+	Expediente string `json:"expediente"`
+	File       string `json:"file"`
+}
+
+type tableDiff struct {
+	Table         string     `json:"table"`
+	Added         []diffRow  `json:"added"`
+	Removed       []diffRow  `json:"removed"`
+	Changed       []diffRow  `json:"changed"`
+	NewFiles      []diffFile `json:"newFiles"`
+	SinExpediente int        `json:"sinExpediente"` // filas sen expediente, que non se poden emparellar
+}
+
+type snapshotDiff struct {
+	Old      string      `json:"old"`
+	New      string      `json:"new"`
+	Tables   []tableDiff `json:"tables"`
+	Added    int         `json:"added"`
+	Removed  int         `json:"removed"`
+	Changed  int         `json:"changed"`
+	NewFiles int         `json:"newFiles"`
+}
+
+// snapshotRows le todas as filas da táboa como texto (NULL → "")
+func snapshotRows(db *sql.DB, table string) ([]Column, []map[string]string, error) {
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	exprs := make([]string, len(cols))
+	for i, c := range cols {
+		exprs[i] = "CAST(" + quoteIdent(c.Name) + " AS TEXT)"
+	}
+	q := fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ", "), quoteIdent(table))
+	var out []map[string]string
+	err = queryEach(db, q, nil, func(rows *sql.Rows) error {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		m := make(map[string]string, len(cols))
+		for i, c := range cols {
+			m[c.Name] = strings.TrimSpace(vals[i].String)
+		}
+		out = append(out, m)
+		return nil
+	})
+	return cols, out, err
+}
+
+// keyedRows: filas por expediente; os repetidos van como "EXP#2", "EXP#3"... na orde da táboa
+func keyedRows(table string, cols []Column, rows []map[string]string) (map[string]map[string]string, string, int) {
+	expCol := roleColumn(table, cols, roleExpediente)
+	out := map[string]map[string]string{}
+	sinExp := 0
+	seen := map[string]int{}
+	for _, r := range rows {
+		exp := r[expCol]
+		if expCol == "" || exp == "" {
+			sinExp++
+			continue
+		}
+		seen[exp]++
+		if seen[exp] > 1 {
+			exp = fmt.Sprintf("%s#%d", exp, seen[exp])
+		}
+		out[exp] = r
+	}
+	return out, expCol, sinExp
+}
+
+// diffDatabases compara a copia vella coa nova
+func diffDatabases(oldDB, newDB *sql.DB) (*snapshotDiff, error) {
+	oldTabs, err := listBaseTables(oldDB)
+	if err != nil {
+		return nil, err
+	}
+	newTabs, err := listBaseTables(newDB)
+	if err != nil {
+		return nil, err
+	}
+	inOld, tables := map[string]bool{}, append([]string{}, newTabs...)
+	for _, t := range oldTabs {
+		inOld[t] = true
+	}
+	inNew := map[string]bool{}
+	for _, t := range newTabs {
+		inNew[t] = true
+	}
+	for _, t := range oldTabs {
+		if !inNew[t] {
+			tables = append(tables, t)
+		}
+	}
+	sort.Strings(tables)
+
+	d := &snapshotDiff{Tables: []tableDiff{}}
+	for _, t := range tables {
+		td := tableDiff{Table: t, Added: []diffRow{}, Removed: []diffRow{}, Changed: []diffRow{}, NewFiles: []diffFile{}}
+		var oldCols, newCols []Column
+		var oldRows, newRows []map[string]string
+		if inOld[t] {
+			if oldCols, oldRows, err = snapshotRows(oldDB, t); err != nil {
+				return nil, fmt.Errorf("%s: %w", t, err)
+			}
+		}
+		if inNew[t] {
+			if newCols, newRows, err = snapshotRows(newDB, t); err != nil {
+				return nil, fmt.Errorf("%s: %w", t, err)
+			}
+		}
+		oldBy, oldExp, _ := keyedRows(t, oldCols, oldRows)
+		newBy, newExp, sinExp := keyedRows(t, newCols, newRows)
+		td.SinExpediente = sinExp
+
+		// columnas das dúas copias, na orde da nova
+		var cols []string
+		seenCol := map[string]bool{}
+		for _, cs := range [][]Column{newCols, oldCols} {
+			for _, c := range cs {
+				if !seenCol[c.Name] && c.Name != newExp && c.Name != oldExp {
+					seenCol[c.Name] = true
+					cols = append(cols, c.Name)
+				}
+			}
+		}
+		obxecto := func(r map[string]string, cs []Column) string {
+			return r[roleColumn(t, cs, roleObxecto)]
+		}
+
+		for exp, nr := range newBy {
+			or, ok := oldBy[exp]
+			if !ok {
+				td.Added = append(td.Added, diffRow{Expediente: exp, Obxecto: obxecto(nr, newCols), Row: nr})
+				continue
+			}
+			var fields []diffField
+			for _, c := range cols {
+				if or[c] != nr[c] {
+					fields = append(fields, diffField{Column: c, Old: or[c], New: nr[c]})
+				}
+			}
+			if len(fields) > 0 {
+				td.Changed = append(td.Changed, diffRow{Expediente: exp, Obxecto: obxecto(nr, newCols), Fields: fields})
+			}
+		}
+		for exp, or := range oldBy {
+			if _, ok := newBy[exp]; !ok {
+				td.Removed = append(td.Removed, diffRow{Expediente: exp, Obxecto: obxecto(or, oldCols), Row: or})
+			}
+		}
+		for _, rs := range [][]diffRow{td.Added, td.Removed, td.Changed} {
+			sort.Slice(rs, func(i, j int) bool { return rs[i].Expediente < rs[j].Expediente })
+		}
+
+		if td.NewFiles, err = diffFiles(oldDB, newDB, t); err != nil {
+			return nil, err
+		}
+
+		d.Added += len(td.Added)
+		d.Removed += len(td.Removed)
+		d.Changed += len(td.Changed)
+		d.NewFiles += len(td.NewFiles)
+		d.Tables = append(d.Tables, td)
+	}
+	return d, nil
+}
+
+// diffFiles: ficheiros (expediente e filename) da nova copia que non estaban na vella. Só conta
+// o nome do ficheiro, coma en feeds.go e filecheck.go: se cambia o tamaño ou a data dun PDF
+// que xa estaba, non é novo.
+func diffFiles(oldDB, newDB *sql.DB, base string) ([]diffFile, error) {
+	out := []diffFile{}
+	nf := findFilesTable(newDB, base)
+	if nf == "" {
+		return out, nil
+	}
+	cols, rows, err := snapshotRows(newDB, nf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", nf, err)
+	}
+	key := func(cols []Column, r map[string]string) (diffFile, bool) {
+		expCol, fileCol := pickFirstColumnName(cols, "Expediente"), pickFirstColumnName(cols, "filename")
+		if expCol == "" || fileCol == "" || r[fileCol] == "" {
+			return diffFile{}, false
+		}
+		return diffFile{r[expCol], r[fileCol]}, true
+	}
+	old := map[diffFile]bool{}
+	if of := findFilesTable(oldDB, base); of != "" {
+		ocols, orows, err := snapshotRows(oldDB, of)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", of, err)
+		}
+		for _, r := range orows {
+			if f, ok := key(ocols, r); ok {
+				old[f] = true
+			}
+		}
+	}
+	for _, r := range rows {
+		if f, ok := key(cols, r); ok && !old[f] {
+			out = append(out, f)
+			old[f] = true // repetidos unha vez
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Expediente != out[j].Expediente {
+			return out[i].Expediente < out[j].Expediente
+		}
+		return out[i].File < out[j].File
+	})
+	return out, nil
+}
+
+// ==== saídas: JSON, CSV e HTML ====
+
+// cambios en CSV: unha liña por expediente novo/eliminado, campo cambiado ou ficheiro novo
+func writeDiffCSV(w io.Writer, d *snapshotDiff) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"taboa", "expediente", "cambio", "columna", "antes", "despois"})
+	for _, td := range d.Tables {
+		for _, r := range td.Added {
+			_ = cw.Write([]string{td.Table, r.Expediente, "novo", "", "", r.Obxecto})
+		}
+		for _, r := range td.Removed {
+			_ = cw.Write([]string{td.Table, r.Expediente, "eliminado", "", r.Obxecto, ""})
+		}
+		for _, r := range td.Changed {
+			for _, f := range r.Fields {
+				_ = cw.Write([]string{td.Table, r.Expediente, "cambio", f.Column, f.Old, f.New})
+			}
+		}
+		for _, f := range td.NewFiles {
+			_ = cw.Write([]string{td.Table, f.Expediente, "ficheiro", "", "", f.File})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeDiffJSON(w io.Writer, d *snapshotDiff) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// ==== subcomando diff ====
+
+// runDiff: licitaberto diff [--format json|csv|html] [-o ficheiro] vella.db nova.db
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := fs.String("format", "json", "json|csv|html")
+	outFile := fs.String("o", "", "ficheiro de saída (por defecto, a saída estándar)")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("uso: licitaberto diff [--format json|csv|html] [-o ficheiro] vella.db nova.db")
+	}
+	oldPath, newPath := fs.Arg(0), fs.Arg(1)
+	oldDB, err := openSQLite(oldPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", oldPath, err)
+	}
+	defer oldDB.Close()
+	newDB, err := openSQLite(newPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", newPath, err)
+	}
+	defer newDB.Close()
+
+	d, err := diffDatabases(oldDB, newDB)
+	if err != nil {
+		return err
+	}
+	d.Old, d.New = filepath.Base(oldPath), filepath.Base(newPath)
+
+	var buf bytes.Buffer
+	switch *format {
+	case "json":
+		err = writeDiffJSON(&buf, d)
+	case "csv":
+		err = writeDiffCSV(&buf, d)
+	case "html":
+		err = diffTemplate().ExecuteTemplate(&buf, "changes.gohtml", map[string]any{
+			"Diff": d, "concello": stripExt(d.New), "Standalone": true,
+		})
+	default:
+		return fmt.Errorf("formato descoñecido %q (json, csv ou html)", *format)
+	}
+	if err != nil {
+		return err
+	}
+	if *outFile == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	log.Printf("%s → %s: %d novos, %d eliminados, %d cambiados, %d ficheiros novos",
+		d.Old, d.New, d.Added, d.Removed, d.Changed, d.NewFiles)
+	return os.WriteFile(*outFile, buf.Bytes(), 0o644)
+}
+
+// diffTemplate: o template de /changes, para a saída HTML do subcomando
+func diffTemplate() *template.Template {
+	return template.Must(template.New("").Funcs(template.FuncMap{"euro": formatEuroFloat}).
+		ParseFS(tplFS, "templates/changes.gohtml", "templates/partials/*.gohtml"))
+}
+
+// ==== /changes: fronte á copia de --previous ====
+
+// previousPaths: copia anterior de cada concello (slug), polo nome do ficheiro
+var previousPaths = map[string]string{}
+
+// loadPrevious acepta o mesmo que --db (ficheiros, listas, directorios)
+func loadPrevious(arg string) error {
+	paths, err := expandDBPaths([]string{arg})
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		previousPaths[slugify(stripExt(filepath.Base(p)))] = p
+	}
+	return nil
+}
+
+func (s *server) concelloDiff(r *http.Request) (*snapshotDiff, error) {
+	c := s.concello(r)
+	prev := previousPaths[c.Slug]
+	if prev == "" && len(previousPaths) == 1 && len(s.reg.list) == 1 {
+		for _, p := range previousPaths {
+			prev = p // un só concello: vale calquera nome
+		}
+	}
+	if prev == "" {
+		return nil, nil
+	}
+	oldDB, err := openSQLite(prev)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", prev, err)
+	}
+	defer oldDB.Close()
+	d, err := diffDatabases(oldDB, c.DB)
+	if err != nil {
+		return nil, err
+	}
+	d.Old, d.New = filepath.Base(prev), filepath.Base(c.DBPath)
+	return d, nil
+}
+
+func (s *server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	d, err := s.concelloDiff(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := s.tpl.ExecuteTemplate(w, "changes.gohtml", s.pageData(r, map[string]any{"Diff": d})); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *server) handleAPIChanges(w http.ResponseWriter, r *http.Request) {
+	d, err := s.concelloDiff(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if d == nil {
+		http.Error(w, "sen copia anterior (--previous)", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(d)
+}
+
+func (s *server) handleExportChanges(w http.ResponseWriter, r *http.Request) {
+	d, err := s.concelloDiff(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if d == nil {
+		http.Error(w, "sen copia anterior (--previous)", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=_%s_changes.csv", safeFile(s.concello(r).Slug)))
+	_ = writeDiffCSV(w, d)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// diffTestDB crea unha copia do scrapper coas filas e ficheiros dados
+func diffTestDB(t *testing.T, name, sqlText string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`
+		CREATE TABLE Alcaldia_contratos_menores (Expediente TEXT, Objeto_del_contrato TEXT, Importe TEXT);
+		CREATE TABLE Alcaldia_contratos_menores_files (Expediente TEXT, filename TEXT, size TEXT, fecha TEXT);
+	` + sqlText); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDiffFiles(t *testing.T) {
+	oldDB := diffTestDB(t, "vella.db", `
+		INSERT INTO Alcaldia_contratos_menores VALUES ('2024/001', 'Beirarrúas', '14.500,00');
+		INSERT INTO Alcaldia_contratos_menores_files VALUES
+			('2024/001', 'resolucion.pdf', '1000', '2024-05-12'),
+			('2024/001', 'factura.pdf', '2000', '2024-05-12');
+	`)
+	newDB := diffTestDB(t, "nova.db", `
+		INSERT INTO Alcaldia_contratos_menores VALUES ('2024/001', 'Beirarrúas', '14.500,00');
+		INSERT INTO Alcaldia_contratos_menores_files VALUES
+			('2024/001', 'resolucion.pdf', '1200', '2024-05-12'),
+			('2024/001', 'factura.pdf', '2000', '2024-06-01'),
+			('2024/001', 'acta.pdf', '300', '2024-06-01'),
+			('2024/001', 'acta.pdf', '300', '2024-06-01');
+	`)
+	d, err := diffDatabases(oldDB, newDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// só cambian o tamaño e a data dos que xa había: o único novo é acta.pdf, unha vez
+	want := []diffFile{{"2024/001", "acta.pdf"}}
+	if len(d.Tables) != 1 || !reflect.DeepEqual(d.Tables[0].NewFiles, want) || d.NewFiles != 1 {
+		t.Errorf("NewFiles = %+v (%d), want %+v", d.Tables, d.NewFiles, want)
+	}
+	if d.Added != 0 || d.Removed != 0 || d.Changed != 0 {
+		t.Errorf("filas: +%d -%d ~%d, want ningún cambio", d.Added, d.Removed, d.Changed)
+	}
+}
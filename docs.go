@@ -0,0 +1,459 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledongthuc/pdf"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ==== Texto dos PDFs ====
+// O indexador percorre PDFPath (TABOA/EXPEDIENTE/ficheiro.pdf), extrae o texto de cada PDF en
+// Go puro (github.com/ledongthuc/pdf) e gárdao en <db>.docs.sqlite, ao lado do .db:
+//
+//	lb_docs      un rexistro por ficheiro: táboa, expediente, ficheiro, ruta, tamaño, mtime, páxinas, erro
+//	lb_docs_fts  o texto de cada ficheiro, co mesmo rowid, para /search/docs
+//
+// Só se volven ler os PDFs novos ou cambiados; os que xa non están bórranse do índice. Os
+// escaneados sen capa de texto quedan co texto baleiro (non hai OCR).
+
+// useDocs: indexar os PDFs en segundo plano ao arrincar (--docs)
+var useDocs bool
+
+const (
+	docsMaxText = 4 << 20 // texto máximo por PDF (bytes)
+	docsPerPage = 20
+)
+
+func docsPath(dbPath string) string {
+	return stripExt(dbPath) + ".docs.sqlite"
+}
+
+func isDocsFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".docs.sqlite")
+}
+
+// extractPDFText: o texto de todas as páxinas, cos espazos xuntados
+func extractPDFText(path string) (text string, pages int, err error) {
+	// a biblioteca pode entrar en pánico con PDFs mal formados
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("PDF non lexible: %v", r)
+		}
+	}()
+	f, rd, err := pdf.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	pages = rd.NumPage()
+	var b strings.Builder
+	for i := 1; i <= pages && b.Len() < docsMaxText; i++ {
+		p := rd.Page(i)
+		if p.V.IsNull() {
+			continue
+		}
+		b.WriteString(pageText(p))
+		b.WriteString("\n")
+	}
+	return strings.Join(strings.Fields(b.String()), " "), pages, nil
+}
+
+// pageText xunta os glifos da páxina. GetPlainText da biblioteca pega as liñas ("municipaisCriterios"),
+// así que separamos nós: salto cando cambia a liña e espazo cando hai oco entre glifos
+func pageText(p pdf.Page) string {
+	var b strings.Builder
+	var prev pdf.Text
+	for i, t := range p.Content().Text {
+		if i > 0 {
+			size := math.Max(prev.FontSize, 1)
+			switch {
+			case math.Abs(t.Y-prev.Y) > size/2:
+				b.WriteByte('\n')
+			case prev.W > 0 && t.X-(prev.X+prev.W) > size/5, t.X < prev.X-size/5:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.S)
+		prev = t
+	}
+	return b.String()
+}
+
+// docsExpedientes: directorio de cada expediente ("2024/0001" → "2024_0001") por táboa, para
+// recuperar o expediente tal como vén nas táboas _files
+func docsExpedientes(src *sql.DB) (map[string]map[string]string, error) {
+	bases, err := listBaseTables(src)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]map[string]string{}
+	for _, b := range bases {
+		ft := findFilesTable(src, b)
+		if ft == "" {
+			continue
+		}
+		cols, err := tableColumns(src, ft)
+		if err != nil {
+			return nil, err
+		}
+		col := pickFirstColumnName(cols, "Expediente")
+		if col == "" {
+			continue
+		}
+		dirs := map[string]string{}
+		err = queryEach(src, fmt.Sprintf("SELECT DISTINCT %s FROM %s", quoteIdent(col), quoteIdent(ft)), nil, func(rows *sql.Rows) error {
+			var exp sql.NullString
+			if err := rows.Scan(&exp); err != nil {
+				return err
+			}
+			if e := strings.TrimSpace(exp.String); e != "" {
+				dirs[strings.ReplaceAll(e, "/", "_")] = e
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		out[b] = dirs
+	}
+	return out, nil
+}
+
+// indexDocs pon ao día o índice de texto dos PDFs dun concello
+func indexDocs(dbPath, pdfPath string) error {
+	mod := ftsModule()
+	if mod == "" {
+		return fmt.Errorf("este binario de SQLite non ten FTS")
+	}
+	if st, err := os.Stat(pdfPath); err != nil || !st.IsDir() {
+		return fmt.Errorf("non hai directorio de PDFs en %s", pdfPath)
+	}
+
+	src, err := sql.Open("sqlite3", readOnlyURI(dbPath))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	exps, err := docsExpedientes(src)
+	if err != nil {
+		return err
+	}
+
+	d, err := sql.Open("sqlite3", docsPath(dbPath))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if _, err := d.Exec(`
+		PRAGMA journal_mode = WAL;
+		CREATE TABLE IF NOT EXISTS lb_docs_source (fts TEXT);
+		CREATE TABLE IF NOT EXISTS lb_docs (id INTEGER PRIMARY KEY, tbl TEXT, expediente TEXT, filename TEXT, path TEXT UNIQUE,
+			size INTEGER, mtime INTEGER, pages INTEGER, error TEXT, indexed_at TEXT);
+		CREATE INDEX IF NOT EXISTS lb_docs_exp ON lb_docs (tbl, expediente);
+	`); err != nil {
+		return err
+	}
+	// un índice doutro módulo FTS non se pode ler: comézase de novo
+	var have string
+	if err := d.QueryRow(`SELECT fts FROM lb_docs_source`).Scan(&have); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if have != mod {
+		if _, err := d.Exec(`DROP TABLE IF EXISTS lb_docs_fts; DELETE FROM lb_docs; DELETE FROM lb_docs_source;`); err != nil {
+			return err
+		}
+		if _, err := d.Exec(ftsCreateSQL(mod, "lb_docs_fts")); err != nil {
+			return err
+		}
+		if _, err := d.Exec(`INSERT INTO lb_docs_source VALUES (?)`, mod); err != nil {
+			return err
+		}
+	}
+
+	type known struct {
+		id, size, mtime int64
+	}
+	indexed := map[string]known{}
+	err = queryEach(d, `SELECT id, path, size, mtime FROM lb_docs`, nil, func(rows *sql.Rows) error {
+		var k known
+		var p string
+		if err := rows.Scan(&k.id, &p, &k.size, &k.mtime); err != nil {
+			return err
+		}
+		indexed[p] = k
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var added, failed int
+	seen := map[string]bool{}
+	err = filepath.WalkDir(pdfPath, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("WARN: docs: %v", err)
+			return nil
+		}
+		if e.IsDir() || !strings.EqualFold(filepath.Ext(path), ".pdf") {
+			return nil
+		}
+		rel, err := filepath.Rel(pdfPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		parts := strings.SplitN(rel, "/", 3) // TABOA/EXPEDIENTE/ficheiro
+		if len(parts) < 3 {
+			return nil
+		}
+		seen[rel] = true
+		info, err := e.Info()
+		if err != nil {
+			return nil
+		}
+		if k, ok := indexed[rel]; ok && k.size == info.Size() && k.mtime == info.ModTime().Unix() {
+			return nil
+		}
+
+		text, pages, xerr := extractPDFText(path)
+		errText := ""
+		if xerr != nil {
+			errText = xerr.Error()
+			failed++
+			log.Printf("WARN: docs: %s: %v", rel, xerr)
+		}
+		exp := parts[1]
+		if e, ok := exps[parts[0]][exp]; ok {
+			exp = e
+		}
+
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if k, ok := indexed[rel]; ok {
+			if _, err := tx.Exec(`DELETE FROM lb_docs_fts WHERE rowid = ?`, k.id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM lb_docs WHERE id = ?`, k.id); err != nil {
+				return err
+			}
+		}
+		res, err := tx.Exec(`INSERT INTO lb_docs (tbl, expediente, filename, path, size, mtime, pages, error, indexed_at) VALUES (?,?,?,?,?,?,?,?,?)`,
+			parts[0], exp, parts[2], rel, info.Size(), info.ModTime().Unix(), pages, errText, time.Now().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		id, _ := res.LastInsertId()
+		if _, err := tx.Exec(`INSERT INTO lb_docs_fts (rowid, doc) VALUES (?, ?)`, id, text); err != nil {
+			return err
+		}
+		added++
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+
+	// os que xa non están no disco
+	removed := 0
+	for p, k := range indexed {
+		if seen[p] {
+			continue
+		}
+		if _, err := d.Exec(`DELETE FROM lb_docs_fts WHERE rowid = ?`, k.id); err != nil {
+			return err
+		}
+		if _, err := d.Exec(`DELETE FROM lb_docs WHERE id = ?`, k.id); err != nil {
+			return err
+		}
+		removed++
+	}
+	log.Printf("docs %s: %d PDFs, %d novos ou cambiados (%d con erros), %d eliminados, en %s",
+		docsPath(dbPath), len(seen), added, failed, removed, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// indexAllDocs indexa os PDFs de todos os concellos SQLite (--docs), un tras outro
+func indexAllDocs(cs []*concelloDB) {
+	for _, c := range cs {
+		if isPostgresDSN(c.DBPath) {
+			continue
+		}
+		if err := indexDocs(c.DBPath, c.PDFPath); err != nil {
+			log.Printf("WARN: non se puideron indexar os PDFs de %s: %v", c.Name, err)
+		}
+	}
+}
+
+// ==== busca ====
+
+type docHit struct {
+	Table      string        `json:"table"`
+	Expediente string        `json:"expediente"`
+	Filename   string        `json:"filename"`
+	Pages      int           `json:"pages"`
+	Snippet    template.HTML `json:"snippet"` // HTML: o texto escapado cos acertos en <mark>
+	URL        string        `json:"url"`     // o PDF en /pdfs/
+	ExpURL     string        `json:"expedienteUrl"`
+}
+
+type docResults struct {
+	Q       string   `json:"q"`
+	Table   string   `json:"table,omitempty"`
+	Total   int      `json:"total"`
+	Page    int      `json:"page"`
+	Pages   int      `json:"pages"`
+	Hits    []docHit `json:"hits"`
+	Indexed int      `json:"indexed"` // PDFs no índice
+}
+
+// openDocs abre o índice en só lectura, coas funcións propias (lb_rank para FTS4)
+func openDocs(dbPath string) (*sql.DB, string, error) {
+	p := docsPath(dbPath)
+	if _, err := os.Stat(p); err != nil {
+		return nil, "", err
+	}
+	drv := &sqlite3.SQLiteDriver{ConnectHook: registerConnFuncs}
+	db := sql.OpenDB(sqliteConnector{dsn: readOnlyURI(p), drv: drv})
+	var mod string
+	if err := db.QueryRow(`SELECT fts FROM lb_docs_source`).Scan(&mod); err != nil {
+		db.Close()
+		return nil, "", err
+	}
+	return db, mod, nil
+}
+
+// marcas do snippet: caracteres de control que non aparecen no texto e se cambian por <mark> despois de escapar
+const (
+	markOpen  = "\x02"
+	markClose = "\x03"
+)
+
+func snippetHTML(s string) template.HTML {
+	s = html.EscapeString(s)
+	s = strings.NewReplacer(markOpen, "<mark>", markClose, "</mark>").Replace(s)
+	return template.HTML(s)
+}
+
+func searchDocs(db *sql.DB, mod, base, q, table string, page int) (*docResults, error) {
+	res := &docResults{Q: q, Table: table, Page: page, Hits: []docHit{}}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM lb_docs`).Scan(&res.Indexed); err != nil {
+		return nil, err
+	}
+	match := ftsMatchExpr(mod, q)
+	if match == "" {
+		return res, nil
+	}
+
+	where := "WHERE lb_docs_fts MATCH ?"
+	args := []any{match}
+	if table != "" {
+		where += " AND d.tbl = ?"
+		args = append(args, table)
+	}
+	from := "FROM lb_docs_fts JOIN lb_docs d ON d.id = lb_docs_fts.rowid " + where
+	if err := db.QueryRow("SELECT COUNT(*) "+from, args...).Scan(&res.Total); err != nil {
+		return nil, err
+	}
+	res.Pages = max(1, (res.Total+docsPerPage-1)/docsPerPage)
+	res.Page = min(max(page, 1), res.Pages)
+
+	snippet := fmt.Sprintf("snippet(lb_docs_fts, 0, '%s', '%s', '…', 24)", markOpen, markClose)
+	order := "bm25(lb_docs_fts)"
+	if mod != "fts5" {
+		snippet = fmt.Sprintf("snippet(lb_docs_fts, '%s', '%s', '…', -1, 24)", markOpen, markClose)
+		order = "-lb_rank(matchinfo(lb_docs_fts, 'pcnx'))"
+	}
+	q2 := fmt.Sprintf("SELECT d.tbl, d.expediente, d.filename, d.path, d.pages, %s %s ORDER BY %s, d.id LIMIT %d OFFSET %d",
+		snippet, from, order, docsPerPage, (res.Page-1)*docsPerPage)
+	err := queryEach(db, q2, args, func(rows *sql.Rows) error {
+		var h docHit
+		var path, snip string
+		if err := rows.Scan(&h.Table, &h.Expediente, &h.Filename, &path, &h.Pages, &snip); err != nil {
+			return err
+		}
+		h.Snippet = snippetHTML(snip)
+		segs := strings.Split(path, "/")
+		for i := range segs {
+			segs[i] = url.PathEscape(segs[i])
+		}
+		h.URL = base + "/pdfs/" + strings.Join(segs, "/")
+		h.ExpURL = expedienteURL(base, h.Table, h.Expediente)
+		res.Hits = append(res.Hits, h)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ==== /search/docs e /api/search/docs ====
+
+func (s *server) docsResults(r *http.Request) (*docResults, error) {
+	c := s.concello(r)
+	if live := s.reg.get(c.Slug); live != nil {
+		c = live // con asOf, o índice é o do .db actual
+	}
+	db, mod, err := openDocs(c.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	return searchDocs(db, mod, basePath(r), strings.TrimSpace(r.URL.Query().Get("q")), strings.TrimSpace(r.URL.Query().Get("table")), page)
+}
+
+func (s *server) handleSearchDocs(w http.ResponseWriter, r *http.Request) {
+	c := s.concello(r)
+	data := map[string]any{
+		"Q":     strings.TrimSpace(r.URL.Query().Get("q")),
+		"Table": strings.TrimSpace(r.URL.Query().Get("table")),
+	}
+	data["Tables"], _ = listBaseTables(c.DB)
+	res, err := s.docsResults(r)
+	if err != nil {
+		// sen índice: a páxina explica como crealo
+		data["NoIndex"] = true
+		log.Printf("WARN: /search/docs %s: %v", c.Name, err)
+	} else {
+		data["Res"], data["PrevPage"], data["NextPage"] = res, res.Page-1, res.Page+1
+	}
+	if err := s.tpl.ExecuteTemplate(w, "docs.gohtml", s.pageData(r, data)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *server) handleAPISearchDocs(w http.ResponseWriter, r *http.Request) {
+	res, err := s.docsResults(r)
+	if os.IsNotExist(err) {
+		http.Error(w, "non hai índice de documentos (licitaberto docs --db ...)", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ==== /expediente/<táboa>/<expediente>: todo dun contrato nunha páxina ====
+// As filas da táboa base (todas as columnas), os ficheiros da táboa _files coas ligazóns aos
+// PDFs e o seu tamaño, as outras táboas nas que aparece o mesmo Expediente e unha liña de
+// tempo coas datas de Estado/Fechas. /api/expediente/... dá o mesmo en JSON.
+//
+// O expediente leva / ("2024/0011"): vai tal cal no camiño, despois do nome da táboa.
+
+type expedienteFile struct {
+	Filename string         `json:"filename"`
+	URL      string         `json:"url"`
+	Size     int64          `json:"size"`
+	Exists   bool           `json:"exists"`
+	Row      map[string]any `json:"row"`
+}
+
+type expedienteRelated struct {
+	Table string `json:"table"`
+	Rows  int    `json:"rows"`
+	URL   string `json:"url"`
+}
+
+type timelineEvent struct {
+	Date   string `json:"date"` // YYYY-MM-DD
+	Kind   string `json:"kind"` // pub, fin, adx ou ""
+	Label  string `json:"label"`
+	Column string `json:"column"`
+	Text   string `json:"text"`
+}
+
+type expedienteDetail struct {
+	Table       string              `json:"table"`
+	Expediente  string              `json:"expediente"`
+	Columns     []string            `json:"columns"`
+	Rows        []map[string]any    `json:"rows"`
+	FilesTable  string              `json:"filesTable,omitempty"`
+	FileColumns []string            `json:"fileColumns,omitempty"`
+	Files       []expedienteFile    `json:"files"`
+	Related     []expedienteRelated `json:"related"`
+	Timeline    []timelineEvent     `json:"timeline"`
+}
+
+var timelineLabels = map[string]string{
+	datePub: "Publicación",
+	dateFin: "Fin de prazo",
+	dateAdx: "Adxudicación / resolución",
+	"":      "Data",
+}
+
+// expedientePath: /expediente/<táboa>/<expediente>, co / do expediente sen escapar
+func expedientePath(base, table, exp string) string {
+	return base + "/expediente/" + url.PathEscape(table) + "/" + strings.ReplaceAll(url.PathEscape(exp), "%2F", "/")
+}
+
+// expedienteRows: as filas da táboa co expediente exacto (sen espazos ao redor)
+func expedienteRows(db *sql.DB, table string, cols []Column, expCol, exp string) ([]map[string]any, error) {
+	flt := tableFilter{Where: fmt.Sprintf("WHERE TRIM(CAST(%s AS TEXT)) = ?", quoteIdent(expCol)), Args: []any{exp}}
+	return fetchPage(db, table, cols, flt, "", false, 1, 1_000_000)
+}
+
+func loadExpediente(db *sql.DB, base, pdfPath, table, exp string) (*expedienteDetail, error) {
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		return nil, err
+	}
+	expCol := roleColumn(table, cols, roleExpediente)
+	if expCol == "" {
+		return nil, fmt.Errorf("a táboa %s non ten columna de expediente", table)
+	}
+	rows, err := expedienteRows(db, table, cols, expCol, exp)
+	if err != nil {
+		return nil, err
+	}
+	d := &expedienteDetail{Table: table, Expediente: exp, Rows: rows,
+		Files: []expedienteFile{}, Related: []expedienteRelated{}, Timeline: []timelineEvent{}}
+	for _, c := range cols {
+		d.Columns = append(d.Columns, c.Name)
+	}
+	if len(rows) == 0 {
+		return d, nil
+	}
+
+	// ficheiros
+	if ft := findFilesTable(db, table); ft != "" {
+		fcols, err := tableColumns(db, ft)
+		if err != nil {
+			return nil, err
+		}
+		fexp, ffile := pickFirstColumnName(fcols, "Expediente"), pickFirstColumnName(fcols, "filename")
+		if fexp != "" && ffile != "" {
+			d.FilesTable = ft
+			for _, c := range fcols {
+				d.FileColumns = append(d.FileColumns, c.Name)
+			}
+			frows, err := expedienteRows(db, ft, fcols, fexp, exp)
+			if err != nil {
+				return nil, err
+			}
+			for _, fr := range frows {
+				name := ""
+				if fr[ffile] != nil {
+					name = strings.TrimSpace(fmt.Sprint(fr[ffile]))
+				}
+				f := expedienteFile{Filename: name, Row: fr}
+				if name != "" {
+					f.URL = pdfURL(base, table, exp, name)
+					if info, err := os.Stat(filepath.Join(pdfPath, table, strings.ReplaceAll(exp, "/", "_"), filepath.Base(name))); err == nil && info.Mode().IsRegular() {
+						f.Exists, f.Size = true, info.Size()
+					}
+				}
+				d.Files = append(d.Files, f)
+			}
+		}
+	}
+
+	// outras táboas co mesmo expediente
+	bases, err := listBaseTables(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bases {
+		if b == table {
+			continue
+		}
+		bcols, err := tableColumns(db, b)
+		if err != nil {
+			return nil, err
+		}
+		col := roleColumn(b, bcols, roleExpediente)
+		if col == "" {
+			continue
+		}
+		n, err := countRows(db, b, fmt.Sprintf("WHERE TRIM(CAST(%s AS TEXT)) = ?", quoteIdent(col)), []any{exp})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b, err)
+		}
+		if n > 0 {
+			d.Related = append(d.Related, expedienteRelated{Table: b, Rows: n, URL: expedientePath(base, b, exp)})
+		}
+	}
+
+	// liña de tempo: as datas de Estado e Fechas de todas as filas
+	var dateCols []string
+	if c := pickFirstColumnName(cols, "Estado"); c != "" {
+		dateCols = append(dateCols, c)
+	}
+	if c := roleColumn(table, cols, roleData); c != "" && (len(dateCols) == 0 || c != dateCols[0]) {
+		dateCols = append(dateCols, c)
+	}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		for _, c := range dateCols {
+			if row[c] == nil {
+				continue
+			}
+			text := strings.TrimSpace(fmt.Sprint(row[c]))
+			for _, ld := range extractDates(text) {
+				if key := ld.ISO + "|" + ld.Kind; !seen[key] {
+					seen[key] = true
+					d.Timeline = append(d.Timeline, timelineEvent{Date: ld.ISO, Kind: ld.Kind, Label: timelineLabels[ld.Kind], Column: c, Text: text})
+				}
+			}
+		}
+	}
+	sort.SliceStable(d.Timeline, func(i, j int) bool { return d.Timeline[i].Date < d.Timeline[j].Date })
+	return d, nil
+}
+
+// expedienteFromPath: táboa e expediente de /expediente/<táboa>/<expediente>
+func (s *server) expedienteFromPath(w http.ResponseWriter, r *http.Request, prefix string) (*expedienteDetail, bool) {
+	c := s.concello(r)
+	table, exp, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	exp = strings.TrimSpace(exp)
+	if table == "" || exp == "" || !tableExists(c.DB, table) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	d, err := loadExpediente(c.DB, basePath(r), c.PDFPath, table, exp)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return nil, false
+	}
+	if len(d.Rows) == 0 {
+		http.Error(w, fmt.Sprintf("non hai ningún expediente %s en %s", exp, table), 404)
+		return nil, false
+	}
+	return d, true
+}
+
+func (s *server) handleExpediente(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.expedienteFromPath(w, r, "/expediente/")
+	if !ok {
+		return
+	}
+	data := map[string]any{
+		"D":       d,
+		"Table":   d.Table,
+		"APIPath": strings.Replace(expedientePath(basePath(r), d.Table, d.Expediente), "/expediente/", "/api/expediente/", 1),
+	}
+	if err := s.tpl.ExecuteTemplate(w, "expediente.gohtml", s.pageData(r, data)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *server) handleAPIExpediente(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.expedienteFromPath(w, r, "/api/expediente/")
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ==== /export/zip: os PDFs dos expedientes filtrados ====
+// Mesmos parámetros que /export/csv. O ZIP leva manifest.csv (as filas, coma o CSV) e os PDFs
+// de cada expediente en <expediente con / cambiado por _>/<ficheiro>; se algún dos que nomea a
+// táboa _files non está no disco, vai listado en faltan.txt.
+//
+// Escríbese directamente na resposta, sen ficheiros temporais. Antes de empezar súmanse os
+// tamaños e, se pasan de --zip-max, respóndese 413 para que se afine a busca.
+
+// zipMaxBytes: tamaño máximo dos PDFs dun ZIP (0 = sen límite)
+var zipMaxBytes int64
+
+type zipEntry struct {
+	name string // ruta dentro do ZIP
+	path string
+	info os.FileInfo
+}
+
+func (s *server) handleExportZIP(w http.ResponseWriter, r *http.Request) {
+	c := s.concello(r)
+	name := r.URL.Query().Get("table")
+	if name == "" {
+		http.Error(w, "missing table", 400)
+		return
+	}
+	cols, err := tableColumns(c.DB, name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	qParam := r.URL.Query().Get("q")
+	order := r.URL.Query().Get("order")
+	dir := strings.ToUpper(r.URL.Query().Get("dir")) == "DESC"
+	from, to := dateRange(r)
+	flt, err := buildFilter(c.DB, name, cols, withDateRange(name, cols, qParam, from, to))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	rows, err := fetchPage(c.DB, name, cols, flt, order, dir, 1, 1_000_000)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	files, err := feedFiles(newFlagContext(c.DB, nil, ""), name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// primeiro a lista de ficheiros, para saber o tamaño antes de escribir nada
+	var entries []zipEntry
+	var missing []string
+	var total int64
+	expCol := roleColumn(name, cols, roleExpediente)
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if expCol == "" || row[expCol] == nil {
+			continue
+		}
+		exp := strings.TrimSpace(fmt.Sprint(row[expCol]))
+		if exp == "" || seen[exp] {
+			continue
+		}
+		seen[exp] = true
+		expDir := strings.ReplaceAll(exp, "/", "_")
+		if expDir == "." || expDir == ".." {
+			continue
+		}
+		for _, f := range files[exp] {
+			f = filepath.Base(f) // o nome vén da táboa: nada de ../
+			if f == "." || f == ".." {
+				continue
+			}
+			p := filepath.Join(c.PDFPath, name, expDir, f)
+			info, err := os.Stat(p)
+			if err != nil || !info.Mode().IsRegular() {
+				missing = append(missing, expDir+"/"+f)
+				continue
+			}
+			total += info.Size()
+			entries = append(entries, zipEntry{name: expDir + "/" + f, path: p, info: info})
+		}
+	}
+	if zipMaxBytes > 0 && total > zipMaxBytes {
+		http.Error(w, fmt.Sprintf("os PDFs suman %.1f MB e o máximo son %.1f MB: afina a busca", float64(total)/(1<<20), float64(zipMaxBytes)/(1<<20)), 413)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=_%s_export.zip", safeFile(name)))
+	zw := zip.NewWriter(w)
+
+	mf, err := createZipText(zw, "manifest.csv")
+	if err == nil {
+		err = writeExportCSV(mf, cols, rows)
+	}
+	if err != nil {
+		log.Printf("WARN: export zip %s: %v", name, err)
+		return
+	}
+	for _, e := range entries {
+		if err := addZipFile(zw, e); err != nil {
+			// xa se mandou parte da resposta: só queda cortala
+			log.Printf("WARN: export zip %s: %v", name, err)
+			return
+		}
+	}
+	if len(missing) > 0 {
+		mw, err := createZipText(zw, "faltan.txt")
+		if err == nil {
+			_, err = io.WriteString(mw, strings.Join(missing, "\n")+"\n")
+		}
+		if err != nil {
+			log.Printf("WARN: export zip %s: %v", name, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("WARN: export zip %s: %v", name, err)
+	}
+}
+
+// createZipText: ficheiro xerado agora (senón o ZIP dálle data de 1980)
+func createZipText(zw *zip.Writer, name string) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+}
+
+// addZipFile copia un PDF ao ZIP sen comprimir (os PDF xa van comprimidos)
+func addZipFile(zw *zip.Writer, e zipEntry) error {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr, err := zip.FileInfoHeader(e.info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = e.name
+	hdr.Method = zip.Store
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ==== Feeds Atom ====
+//
+//	/feeds/all.atom                    contratos novos de todas as táboas
+//	/feeds/table/<táboa>.atom?q=...    dunha táboa, coa mesma consulta que /table
+//	/feeds/adxudicatario/<id>.atom     dun provedor (o id de /api/suppliers)
+//
+// As entradas son os contratos máis recentes pola data (adxudicación ou publicación). O id de
+// cada entrada sae da táboa e do expediente, así que non cambia aínda que o .db se regenere.
+
+const feedLimit = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Summary    atomText       `xml:"summary"`
+	Content    atomText       `xml:"content"`
+}
+
+// absoluteBase: esquema e host da petición (os lectores de feeds precisan URLs absolutas)
+func absoluteBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedID: id estable dunha entrada (concello, táboa e expediente). Sen expediente, un hash dos
+// campos; os expedientes repetidos levan #2, #3... na orde da táboa.
+func feedID(slug string, fr flagRow, seen map[string]int) string {
+	key := fr.Expediente
+	if key == "" {
+		sum := sha1.Sum([]byte(strings.Join([]string{fr.Obxecto, fr.Adx, fr.Data, fr.DataAdx, formatEuroFloat(fr.Importe)}, "\x00")))
+		key = "#" + hex.EncodeToString(sum[:8])
+	}
+	id := fr.Table + "/" + key
+	seen[id]++
+	if n := seen[id]; n > 1 {
+		id = fmt.Sprintf("%s#%d", id, n)
+	}
+	return "tag:licitaberto,2024:" + slug + "/" + url.PathEscape(fr.Table) + "/" + url.PathEscape(strings.TrimPrefix(id, fr.Table+"/"))
+}
+
+// feedDate: a data da entrada (adxudicación e, se non, publicación), "" se a fila non ten
+func feedDate(fr flagRow) string {
+	if fr.DataAdx != "" {
+		return fr.DataAdx
+	}
+	return fr.Data
+}
+
+// feedFiles: os ficheiros de cada expediente na táboa _files (nil se non hai)
+func feedFiles(ctx *flagContext, table string) (map[string][]string, error) {
+	ft := findFilesTable(ctx.db, table)
+	if ft == "" {
+		return nil, nil
+	}
+	cols, err := tableColumns(ctx.db, ft)
+	if err != nil {
+		return nil, err
+	}
+	expCol, fileCol := pickFirstColumnName(cols, "Expediente"), pickFirstColumnName(cols, "filename")
+	if expCol == "" || fileCol == "" {
+		return nil, nil
+	}
+	out := map[string][]string{}
+	q := fmt.Sprintf("SELECT %s, %s FROM %s", quoteIdent(expCol), quoteIdent(fileCol), quoteIdent(ft))
+	err = queryEach(ctx.db, q, nil, func(rows *sql.Rows) error {
+		var exp, file sql.NullString
+		if err := rows.Scan(&exp, &file); err != nil {
+			return err
+		}
+		if e, f := strings.TrimSpace(exp.String), strings.TrimSpace(file.String); e != "" && f != "" {
+			out[e] = append(out[e], f)
+		}
+		return nil
+	})
+	return out, err
+}
+
+type feedItem struct {
+	flagRow
+	ID string
+}
+
+// pdfURL: os PDFs van en PDF/<táboa>/<expediente con _>/<ficheiro>, como na vista da táboa
+func pdfURL(abs, table, exp, file string) string {
+	return abs + createLinkPDF(table) + "/" + url.PathEscape(strings.ReplaceAll(exp, "/", "_")) + "/" + url.PathEscape(file)
+}
+
+// queryError: o primeiro erro de q nas táboas (nil se vale para todas)
+func queryError(db *sql.DB, tables []string, q string) error {
+	if q == "" {
+		return nil
+	}
+	for _, t := range tables {
+		cols, err := tableColumns(db, t)
+		if err != nil {
+			return err
+		}
+		if _, err := buildFilter(db, t, cols, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// feedSource: as filas que entran nun feed, xa ordenadas e recortadas
+type feedSource struct {
+	rows  []feedItem
+	files map[string]map[string][]string // táboa → expediente → ficheiros
+}
+
+// collectFeed xunta as filas das táboas (con q) que cumpren keep, as máis recentes primeiro
+func collectFeed(ctx *flagContext, slug string, tables []string, q string, keep func(flagRow) bool) (*feedSource, error) {
+	src := &feedSource{files: map[string]map[string][]string{}}
+	seen := map[string]int{}
+	for _, t := range tables {
+		rows, err := ctx.readRows(t, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, fr := range rows {
+			id := feedID(slug, fr, seen) // antes de filtrar e ordenar, para que non dependa diso
+			if keep == nil || keep(fr) {
+				src.rows = append(src.rows, feedItem{fr, id})
+			}
+		}
+	}
+	// orde estable: data descendente; despois táboa e expediente
+	sort.SliceStable(src.rows, func(i, j int) bool {
+		a, b := src.rows[i], src.rows[j]
+		if da, db := feedDate(a.flagRow), feedDate(b.flagRow); da != db {
+			return da > db
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		return a.Expediente > b.Expediente
+	})
+	if len(src.rows) > feedLimit {
+		src.rows = src.rows[:feedLimit]
+	}
+	for _, fr := range src.rows {
+		if _, ok := src.files[fr.Table]; ok {
+			continue
+		}
+		files, err := feedFiles(ctx, fr.Table)
+		if err != nil {
+			return nil, err
+		}
+		src.files[fr.Table] = files
+	}
+	return src, nil
+}
+
+// atomTime: "AAAA-MM-DD" a RFC 3339
+func atomTime(iso string) string {
+	return iso + "T00:00:00Z"
+}
+
+// buildFeed monta o feed; abs é o prefixo absoluto do concello (https://host/ames)
+func buildFeed(c *concelloDB, abs, title, self, alternate string, src *feedSource) atomFeed {
+	// sen datas nas filas, a data de modificación do .db
+	fallback := time.Now().UTC().Format(time.RFC3339)
+	if st, err := os.Stat(c.DBPath); err == nil {
+		fallback = st.ModTime().UTC().Format(time.RFC3339)
+	}
+
+	f := atomFeed{
+		Title:   c.Name + " · " + title,
+		ID:      "tag:licitaberto,2024:" + c.Slug + strings.TrimPrefix(self, abs),
+		Author:  atomPerson{Name: "licitaberto"},
+		Links:   []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}, {Rel: "alternate", Type: "text/html", Href: alternate}},
+		Entries: []atomEntry{},
+	}
+	for _, fr := range src.rows {
+		updated := fallback
+		if d := feedDate(fr.flagRow); d != "" {
+			updated = atomTime(d)
+		}
+		if updated > f.Updated {
+			f.Updated = updated
+		}
+
+		title := fr.Obxecto
+		if title == "" {
+			title = fr.Expediente
+		}
+		if fr.HasImporte {
+			title += " · " + formatEuroFloat(fr.Importe) + " €"
+		}
+		e := atomEntry{
+			Title:   title,
+			ID:      fr.ID,
+			Updated: updated,
+			Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: fr.URL}},
+			Summary: atomText{Type: "text", Body: feedSummary(fr.flagRow)},
+			Content: atomText{Type: "html", Body: feedContent(abs, fr.flagRow, src.files[fr.Table][fr.Expediente])},
+		}
+		if e.Links[0].Href == "" {
+			e.Links[0].Href = alternate
+		}
+		if fr.FichaURL != "" {
+			e.Links = append(e.Links, atomLink{Rel: "related", Type: "text/html", Href: fr.FichaURL})
+		}
+		e.Categories = append(e.Categories, atomCategory{Term: fr.Table})
+		if fr.Tipo != "" {
+			e.Categories = append(e.Categories, atomCategory{Term: fr.Tipo})
+		}
+		f.Entries = append(f.Entries, e)
+	}
+	if f.Updated == "" {
+		f.Updated = fallback
+	}
+	return f
+}
+
+func feedSummary(fr flagRow) string {
+	parts := []string{fr.Expediente}
+	if fr.Adx != "" {
+		parts = append(parts, fr.Supplier)
+	}
+	if fr.HasImporte {
+		parts = append(parts, formatEuroFloat(fr.Importe)+" €")
+	}
+	return strings.Join(parts, " · ")
+}
+
+// feedContent: obxecto, importe, adxudicatario e ligazóns aos PDFs do expediente
+func feedContent(abs string, fr flagRow, files []string) string {
+	var b strings.Builder
+	esc := html.EscapeString
+	fmt.Fprintf(&b, "<p>%s</p><ul>", esc(fr.Obxecto))
+	fmt.Fprintf(&b, "<li>Expediente: %s</li>", esc(fr.Expediente))
+	if fr.Tipo != "" {
+		fmt.Fprintf(&b, "<li>Tipo: %s</li>", esc(fr.Tipo))
+	}
+	if fr.HasImporte {
+		fmt.Fprintf(&b, "<li>Importe: %s €</li>", formatEuroFloat(fr.Importe))
+	}
+	if fr.Adx != "" {
+		fmt.Fprintf(&b, "<li>Adxudicatario: <a href=\"%s\">%s</a></li>", esc(abs+"/feeds/adxudicatario/"+url.PathEscape(fr.SupplierID)+".atom"), esc(fr.Adx))
+	}
+	if fr.Data != "" {
+		fmt.Fprintf(&b, "<li>Data: %s</li>", fr.Data)
+	}
+	if fr.DataAdx != "" && fr.DataAdx != fr.Data {
+		fmt.Fprintf(&b, "<li>Adxudicación: %s</li>", fr.DataAdx)
+	}
+	b.WriteString("</ul>")
+	if len(files) > 0 {
+		b.WriteString("<p>Documentos:</p><ul>")
+		for _, f := range files {
+			fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>", esc(pdfURL(abs, fr.Table, fr.Expediente, f)), esc(f))
+		}
+		b.WriteString("</ul>")
+	}
+	return b.String()
+}
+
+// ==== /feeds/ ====
+
+func (s *server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	c := s.concello(r)
+	// co prefixo absoluto, as ligazóns das filas (flagRow.URL) xa saen absolutas
+	abs := absoluteBase(r) + basePath(r)
+	ctx := newFlagContext(c.DB, s.suppliers(), abs)
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	rest := strings.TrimPrefix(r.URL.Path, "/feeds/")
+	name, ok := strings.CutSuffix(rest, ".atom")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		title, alternate string
+		tables           []string
+		keep             func(flagRow) bool
+		err              error
+	)
+	switch {
+	case name == "all":
+		title, alternate = "Contratos novos", abs+"/"
+		tables, err = listBaseTables(c.DB)
+	case strings.HasPrefix(name, "table/"):
+		t := strings.TrimPrefix(name, "table/")
+		if !tableExists(c.DB, t) {
+			http.Error(w, "non existe a táboa "+t, 404)
+			return
+		}
+		title, alternate, tables = t, abs+"/table/"+t, []string{t}
+		if q != "" {
+			title += " · " + q
+			alternate += "?q=" + url.QueryEscape(q)
+		}
+	case strings.HasPrefix(name, "adxudicatario/"):
+		id, _ := url.PathUnescape(strings.TrimPrefix(name, "adxudicatario/"))
+		if id == "" {
+			http.NotFound(w, r)
+			return
+		}
+		title, alternate = id, abs+"/"
+		keep = func(fr flagRow) bool { return fr.SupplierID == id }
+		tables, err = listBaseTables(c.DB)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	// erros de q: 400, como en /api/table
+	if err := queryError(c.DB, tables, q); err != nil {
+		writeQueryError(w, q, err)
+		return
+	}
+
+	src, err := collectFeed(ctx, c.Slug, tables, q, keep)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if keep != nil && len(src.rows) > 0 {
+		title = src.rows[0].Supplier
+	}
+
+	self := abs + r.URL.Path
+	if r.URL.RawQuery != "" {
+		self += "?" + r.URL.RawQuery
+	}
+	feed := buildFeed(c, abs, title, self, alternate, src)
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Printf("WARN: feed %s: %v", r.URL.Path, err)
+	}
+}
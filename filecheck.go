@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// ==== Comprobación dos anexos ====
+// As ligazóns da táboa van a PDFPath/<táboa>/<expediente con / cambiado por _>/<ficheiro> sen
+// mirar se o ficheiro existe. Aquí compárase cada táboa _files co directorio de PDFs:
+//
+//	falta     está na táboa _files pero non no disco
+//	baleiro   existe pero ten 0 bytes
+//	invalido  ten extensión .pdf pero non se le como PDF
+//	orfo      está no disco pero ningunha táboa _files o nomea
+//
+// e calcúlase a cobertura de cada táboa: ficheiros nomeados que están ben e expedientes con
+// algún ficheiro bo.
+
+const (
+	fileMissing = "falta"
+	fileEmpty   = "baleiro"
+	fileInvalid = "invalido"
+	fileOrphan  = "orfo"
+)
+
+type fileProblem struct {
+	Kind       string `json:"kind"`
+	Table      string `json:"table"`
+	Expediente string `json:"expediente,omitempty"`
+	Filename   string `json:"filename"`
+	Path       string `json:"path"` // relativa a PDFPath
+	Detail     string `json:"detail,omitempty"`
+}
+
+type fileTableStat struct {
+	Table        string  `json:"table"`
+	FilesTable   string  `json:"filesTable"`
+	Referenced   int     `json:"referenced"` // filas da táboa _files
+	OK           int     `json:"ok"`
+	Missing      int     `json:"missing"`
+	Empty        int     `json:"empty"`
+	Invalid      int     `json:"invalid"`
+	Orphans      int     `json:"orphans"`
+	Coverage     float64 `json:"coverage"` // % de ficheiros nomeados que están ben
+	Expedientes  int     `json:"expedientes"`
+	ExpWithFiles int     `json:"expWithFiles"`
+	ExpCoverage  float64 `json:"expCoverage"` // % de expedientes da táboa base con algún ficheiro bo
+}
+
+type filesReport struct {
+	PDFPath  string          `json:"pdfPath"`
+	Tables   []fileTableStat `json:"tables"`
+	Problems []fileProblem   `json:"problems"`
+}
+
+// checkPDF: nil se o ficheiro se le como PDF (cabeceira e táboa xref)
+func checkPDF(path string, size int64) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(f, head); err != nil || string(head) != "%PDF-" {
+		return fmt.Errorf("non empeza por %%PDF-")
+	}
+	_, err = pdf.NewReader(f, size)
+	return err
+}
+
+// checkFiles compara as táboas _files do concello co directorio de PDFs
+func checkFiles(db *sql.DB, pdfPath string) (*filesReport, error) {
+	rep := &filesReport{PDFPath: pdfPath, Tables: []fileTableStat{}, Problems: []fileProblem{}}
+	bases, err := listBaseTables(db)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{} // rutas relativas nomeadas nalgunha táboa _files
+	stats := map[string]*fileTableStat{}
+	for _, b := range bases {
+		ft := findFilesTable(db, b)
+		if ft == "" {
+			continue
+		}
+		cols, err := tableColumns(db, ft)
+		if err != nil {
+			return nil, err
+		}
+		expCol, fileCol := pickFirstColumnName(cols, "Expediente"), pickFirstColumnName(cols, "filename")
+		if expCol == "" || fileCol == "" {
+			log.Printf("WARN: %s sen columnas Expediente/filename, sáltase", ft)
+			continue
+		}
+		st := &fileTableStat{Table: b, FilesTable: ft}
+		stats[b] = st
+		good := map[string]bool{} // expedientes con algún ficheiro bo
+
+		q := fmt.Sprintf("SELECT %s, %s FROM %s", quoteIdent(expCol), quoteIdent(fileCol), quoteIdent(ft))
+		err = queryEach(db, q, nil, func(rows *sql.Rows) error {
+			var exp, file sql.NullString
+			if err := rows.Scan(&exp, &file); err != nil {
+				return err
+			}
+			e, f := strings.TrimSpace(exp.String), strings.TrimSpace(file.String)
+			if f == "" {
+				return nil
+			}
+			st.Referenced++
+			// a mesma ruta que as ligazóns de table.gohtml
+			rel := b + "/" + strings.ReplaceAll(e, "/", "_") + "/" + f
+			referenced[rel] = true
+			p := fileProblem{Table: b, Expediente: e, Filename: f, Path: rel}
+			info, err := os.Stat(filepath.Join(pdfPath, filepath.FromSlash(rel)))
+			switch {
+			case err != nil:
+				p.Kind = fileMissing
+				st.Missing++
+			case info.IsDir():
+				p.Kind, p.Detail = fileInvalid, "é un directorio"
+				st.Invalid++
+			case info.Size() == 0:
+				p.Kind = fileEmpty
+				st.Empty++
+			case strings.EqualFold(filepath.Ext(f), ".pdf"):
+				if perr := checkPDF(filepath.Join(pdfPath, filepath.FromSlash(rel)), info.Size()); perr != nil {
+					p.Kind, p.Detail = fileInvalid, perr.Error()
+					st.Invalid++
+				}
+			}
+			if p.Kind != "" {
+				rep.Problems = append(rep.Problems, p)
+				return nil
+			}
+			st.OK++
+			good[e] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ft, err)
+		}
+
+		// expedientes da táboa base
+		bcols, err := tableColumns(db, b)
+		if err != nil {
+			return nil, err
+		}
+		if col := roleColumn(b, bcols, roleExpediente); col != "" {
+			exps := map[string]bool{}
+			err = queryEach(db, fmt.Sprintf("SELECT %s FROM %s", quoteIdent(col), quoteIdent(b)), nil, func(rows *sql.Rows) error {
+				var exp sql.NullString
+				if err := rows.Scan(&exp); err != nil {
+					return err
+				}
+				if e := strings.TrimSpace(exp.String); e != "" {
+					exps[e] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", b, err)
+			}
+			st.Expedientes = len(exps)
+			for e := range exps {
+				if good[e] {
+					st.ExpWithFiles++
+				}
+			}
+		}
+	}
+
+	// orfos: todo o que hai no disco e non nomea ningunha táboa
+	if _, err := os.Stat(pdfPath); err == nil {
+		err = filepath.WalkDir(pdfPath, func(path string, e fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("WARN: %v", err)
+				return nil
+			}
+			if e.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(pdfPath, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if referenced[rel] {
+				return nil
+			}
+			table, rest, _ := strings.Cut(rel, "/")
+			dir, file, ok := strings.Cut(rest, "/")
+			if !ok {
+				dir, file = "", rest
+			}
+			rep.Problems = append(rep.Problems, fileProblem{Kind: fileOrphan, Table: table, Expediente: dir, Filename: file, Path: rel})
+			if st := stats[table]; st != nil {
+				st.Orphans++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("WARN: non existe o directorio de PDFs %s", pdfPath)
+	}
+
+	for _, b := range bases {
+		st := stats[b]
+		if st == nil {
+			continue
+		}
+		if st.Referenced > 0 {
+			st.Coverage = 100 * float64(st.OK) / float64(st.Referenced)
+		}
+		if st.Expedientes > 0 {
+			st.ExpCoverage = 100 * float64(st.ExpWithFiles) / float64(st.Expedientes)
+		}
+		rep.Tables = append(rep.Tables, *st)
+	}
+	sort.SliceStable(rep.Problems, func(i, j int) bool {
+		a, b := rep.Problems[i], rep.Problems[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Path < b.Path
+	})
+	return rep, nil
+}
+
+// problemCounts: cantos problemas de cada tipo
+func (rep *filesReport) problemCounts() map[string]int {
+	out := map[string]int{fileMissing: 0, fileEmpty: 0, fileInvalid: 0, fileOrphan: 0}
+	for _, p := range rep.Problems {
+		out[p.Kind]++
+	}
+	return out
+}
+
+// ==== subcomando check-files ====
+
+func writeFilesText(w io.Writer, name string, rep *filesReport) {
+	fmt.Fprintf(w, "== %s (%s)\n", name, rep.PDFPath)
+	for _, t := range rep.Tables {
+		fmt.Fprintf(w, "%s: %d/%d ficheiros ben (%.1f%%), %d faltan, %d baleiros, %d inválidos, %d orfos; %d/%d expedientes con anexos (%.1f%%)\n",
+			t.Table, t.OK, t.Referenced, t.Coverage, t.Missing, t.Empty, t.Invalid, t.Orphans, t.ExpWithFiles, t.Expedientes, t.ExpCoverage)
+	}
+	for _, p := range rep.Problems {
+		if p.Detail != "" {
+			fmt.Fprintf(w, "%-8s %s (%s)\n", p.Kind, p.Path, p.Detail)
+		} else {
+			fmt.Fprintf(w, "%-8s %s\n", p.Kind, p.Path)
+		}
+	}
+}
+
+func writeFilesCSV(w io.Writer, name string, rep *filesReport, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		_ = cw.Write([]string{"concello", "tipo", "taboa", "expediente", "ficheiro", "ruta", "detalle"})
+	}
+	for _, p := range rep.Problems {
+		_ = cw.Write([]string{name, p.Kind, p.Table, p.Expediente, p.Filename, p.Path, p.Detail})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runCheckFiles: licitaberto check-files --db ... [--format text|json|csv]
+func runCheckFiles(args []string) error {
+	fset := flag.NewFlagSet("check-files", flag.ExitOnError) // fs é io/fs
+	dbPath := fset.String("db", "", "ficheiro SQLite, lista separada por comas ou directorio")
+	format := fset.String("format", "text", "text|json|csv")
+	_ = fset.Parse(args)
+	if *dbPath == "" {
+		return fmt.Errorf("uso: licitaberto check-files --db ... [--format text|json|csv]")
+	}
+	switch *format {
+	case "text", "json", "csv":
+	default:
+		return fmt.Errorf("formato descoñecido: %s", *format)
+	}
+	paths, err := expandDBPaths([]string{*dbPath})
+	if err != nil {
+		return err
+	}
+
+	out := map[string]*filesReport{}
+	var names []string
+	for _, p := range paths {
+		if isPostgresDSN(p) {
+			log.Printf("WARN: check-files só é para SQLite, sáltase %s", p)
+			continue
+		}
+		db, err := openSQLite(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		rep, err := checkFiles(db, pdfPathFor(p))
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		name := stripExt(filepath.Base(p))
+		out[name] = rep
+		names = append(names, name)
+
+		switch *format {
+		case "text":
+			writeFilesText(os.Stdout, name, rep)
+		case "csv":
+			if err := writeFilesCSV(os.Stdout, name, rep, len(names) == 1); err != nil {
+				return err
+			}
+		}
+	}
+	if *format != "json" {
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// ==== /admin/files e /api/admin/files ====
+
+func (s *server) filesReport(r *http.Request) (*filesReport, error) {
+	c := s.concello(r)
+	return checkFiles(c.DB, c.PDFPath)
+}
+
+func (s *server) handleAdminFiles(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.filesReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	kind := strings.TrimSpace(r.URL.Query().Get("kind"))
+	problems := rep.Problems
+	if kind != "" {
+		problems = nil
+		for _, p := range rep.Problems {
+			if p.Kind == kind {
+				problems = append(problems, p)
+			}
+		}
+	}
+	data := map[string]any{
+		"Rep":      rep,
+		"Counts":   rep.problemCounts(),
+		"Kinds":    []string{fileMissing, fileEmpty, fileInvalid, fileOrphan},
+		"Kind":     kind,
+		"Problems": problems,
+	}
+	if err := s.tpl.ExecuteTemplate(w, "files.gohtml", s.pageData(r, data)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *server) handleAPIAdminFiles(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.filesReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ==== Alertas (red flags) ====
+// Cada indicador é un tipo que cumpre a interface indicator: recibe o contexto e unha táboa base
+// e devolve achados (findings), cada un coa súa gravidade, as filas implicadas e unha explicación.
+// /flags suma as gravidades por expediente e por provedor e ordena. Para engadir un indicador
+// abonda con implementalo e metelo en flagIndicators.
+//
+// Ningún indicador proba nada: son cousas para revisar.
+
+// gravidades
+const (
+	sevBaixa = 1
+	sevMedia = 2
+	sevAlta  = 3
+)
+
+var sevNames = map[int]string{sevBaixa: "baixa", sevMedia: "media", sevAlta: "alta"}
+
+// flagRow: unha fila da táboa base cos campos que interesan aos indicadores
+type flagRow struct {
+	Table      string  `json:"table"`
+	Expediente string  `json:"expediente"`
+	Obxecto    string  `json:"obxecto"`
+	Tipo       string  `json:"tipo"`
+	Adx        string  `json:"adxudicatario"`
+	SupplierID string  `json:"supplierId"`
+	Supplier   string  `json:"supplier"`
+	Importe    float64 `json:"importe"`
+	HasImporte bool    `json:"-"`
+	Data       string  `json:"data"`              // publicación (ou a única data)
+	DataAdx    string  `json:"dataAdx"`           // adxudicación/resolución, se a hai
+	DataFin    string  `json:"dataFin,omitempty"` // fin do prazo de presentación (licitacións)
+	Estado     string  `json:"estado,omitempty"`
+	URL        string  `json:"url"`
+	FichaURL   string  `json:"fichaUrl,omitempty"`
+
+	limiares []thresholdLabel
+	dataText string // o texto da columna de datas, para a hora do prazo (calendar.go)
+}
+
+type finding struct {
+	Indicator   string    `json:"indicator"`
+	Severity    int       `json:"severity"`
+	Table       string    `json:"table"`
+	Organo      string    `json:"organo"`
+	Rows        []flagRow `json:"rows"`
+	Explanation string    `json:"explanation"`
+}
+
+// SeverityName para os templates
+func (f finding) SeverityName() string { return sevNames[f.Severity] }
+
+// indicator: un indicador de risco
+type indicator interface {
+	ID() string
+	Name() string
+	Evaluate(ctx *flagContext, table string) ([]finding, error)
+}
+
+// indicadores en uso, na orde na que se amosan
+var flagIndicators = []indicator{
+	nearThresholdIndicator{},
+	roundAmountIndicator{},
+	repeatAwardIndicator{},
+	weekendAwardIndicator{},
+	splittingIndicator{},
+}
+
+// flagContext: o concello que se analiza; as filas de cada táboa lense unha vez e comparten todos os indicadores
+type flagContext struct {
+	db   *sql.DB
+	sup  *supplierIndex
+	base string
+	rows map[string][]flagRow
+}
+
+func newFlagContext(db *sql.DB, sup *supplierIndex, base string) *flagContext {
+	return &flagContext{db: db, sup: sup, base: base, rows: map[string][]flagRow{}}
+}
+
+// tableRows le (unha vez) as filas da táboa, cos campos resoltos polos roles
+func (ctx *flagContext) tableRows(table string) ([]flagRow, error) {
+	if rows, ok := ctx.rows[table]; ok {
+		return rows, nil
+	}
+	rows, err := ctx.readRows(table, "")
+	if err != nil {
+		return nil, err
+	}
+	ctx.rows[table] = rows
+	return rows, nil
+}
+
+// readRows le, sen caché, as filas da táboa que cumpren q (a linguaxe de consulta de /table)
+func (ctx *flagContext) readRows(table, q string) ([]flagRow, error) {
+	cols, err := tableColumns(ctx.db, table)
+	if err != nil {
+		return nil, err
+	}
+	flt, err := buildFilter(ctx.db, table, cols, q)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := fetchPage(ctx.db, table, cols, flt, "", false, 1, 1_000_000)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", table, err)
+	}
+	roles := tableRoles(table, cols)
+	limiares := rowThresholds(table, cols)
+	estado := pickFirstColumnName(cols, "Estado")
+	text := func(m map[string]any, role string) string {
+		if c := roles[role]; c != "" && m[c] != nil {
+			return strings.TrimSpace(fmt.Sprint(m[c]))
+		}
+		return ""
+	}
+	rows := make([]flagRow, 0, len(raw))
+	for _, m := range raw {
+		fr := flagRow{
+			Table:      table,
+			Expediente: text(m, roleExpediente),
+			Obxecto:    text(m, roleObxecto),
+			Tipo:       text(m, roleTipo),
+			Adx:        text(m, roleAdx),
+		}
+		fr.Importe, fr.HasImporte = parseEuroNumber(text(m, roleImporte))
+		fr.dataText = text(m, roleData)
+		dates := extractDates(fr.dataText)
+		fr.Data, fr.DataAdx, fr.DataFin = pickDate(dates, datePub), pickDate(dates, dateAdx), pickDate(dates, dateFin)
+		if estado != "" && m[estado] != nil {
+			fr.Estado = strings.TrimSpace(fmt.Sprint(m[estado]))
+		}
+		if fr.Adx != "" {
+			sp := ctx.sup.resolve(fr.Adx)
+			fr.SupplierID, fr.Supplier = sp.ID, sp.Label
+		}
+		fr.URL = expedienteURL(ctx.base, table, fr.Expediente)
+		fr.FichaURL = fichaURL(ctx.base, table, fr.Expediente)
+		if limiares != nil {
+			fr.limiares = limiares(m)
+		}
+		rows = append(rows, fr)
+	}
+	return rows, nil
+}
+
+// expedienteURL: ligazón á fila do expediente na táboa ("" sen expediente)
+func expedienteURL(base, table, exp string) string {
+	if exp == "" {
+		return ""
+	}
+	return base + "/table/" + table + "?q=" + url.QueryEscape(exp)
+}
+
+// fichaURL: ligazón á ficha do expediente (expediente.go; "" sen expediente)
+func fichaURL(base, table, exp string) string {
+	if exp == "" {
+		return ""
+	}
+	return expedientePath(base, table, exp)
+}
+
+// ==== indicadores ====
+
+// nearThresholdIndicator: importes xusto por baixo dun limiar legal (etiqueta "preto" de thresholds.go)
+type nearThresholdIndicator struct{}
+
+func (nearThresholdIndicator) ID() string   { return "preto_limiar" }
+func (nearThresholdIndicator) Name() string { return "Importe xusto por baixo dun limiar" }
+
+func (nearThresholdIndicator) Evaluate(ctx *flagContext, table string) ([]finding, error) {
+	rows, err := ctx.tableRows(table)
+	if err != nil {
+		return nil, err
+	}
+	var out []finding
+	for _, fr := range rows {
+		for _, l := range fr.limiares {
+			if l.Label != thresholdNear {
+				continue
+			}
+			sev := sevBaixa
+			if l.Kind == "menor" {
+				sev = sevMedia // o contrato menor evita a licitación
+			}
+			out = append(out, finding{
+				Severity:    sev,
+				Table:       table,
+				Rows:        []flagRow{fr},
+				Explanation: fmt.Sprintf("%s € é o %.0f%% do límite de %s (%s €)", formatEuroFloat(fr.Importe), l.Pct, strings.ToLower(l.Name), formatEuroFloat(l.Limite)),
+			})
+		}
+	}
+	return out, nil
+}
+
+// roundAmountIndicator: importes redondos (múltiplos de 1.000 €), raros se saen dun orzamento detallado
+type roundAmountIndicator struct{}
+
+const roundAmountMin = 5000
+
+func (roundAmountIndicator) ID() string   { return "importe_redondo" }
+func (roundAmountIndicator) Name() string { return "Importe redondo" }
+
+func (roundAmountIndicator) Evaluate(ctx *flagContext, table string) ([]finding, error) {
+	rows, err := ctx.tableRows(table)
+	if err != nil {
+		return nil, err
+	}
+	var out []finding
+	for _, fr := range rows {
+		if !fr.HasImporte || fr.Importe < roundAmountMin || math.Mod(fr.Importe, 1000) != 0 {
+			continue
+		}
+		out = append(out, finding{
+			Severity:    sevBaixa,
+			Table:       table,
+			Rows:        []flagRow{fr},
+			Explanation: fmt.Sprintf("importe redondo: %s €", formatEuroFloat(fr.Importe)),
+		})
+	}
+	return out, nil
+}
+
+// repeatAwardIndicator: o mesmo órgano (táboa) adxudica moitas veces ao mesmo provedor
+type repeatAwardIndicator struct{}
+
+const repeatAwardMin = 3
+
+func (repeatAwardIndicator) ID() string   { return "adx_repetido" }
+func (repeatAwardIndicator) Name() string { return "Adxudicacións repetidas ao mesmo provedor" }
+
+func (repeatAwardIndicator) Evaluate(ctx *flagContext, table string) ([]finding, error) {
+	rows, err := ctx.tableRows(table)
+	if err != nil {
+		return nil, err
+	}
+	bySup := map[string][]flagRow{}
+	for _, fr := range rows {
+		if fr.SupplierID != "" {
+			bySup[fr.SupplierID] = append(bySup[fr.SupplierID], fr)
+		}
+	}
+	var out []finding
+	for _, rs := range bySup {
+		if len(rs) < repeatAwardMin {
+			continue
+		}
+		sev := sevBaixa
+		switch {
+		case len(rs) >= 10:
+			sev = sevAlta
+		case len(rs) >= 5:
+			sev = sevMedia
+		}
+		total := 0.0
+		for _, fr := range rs {
+			total += fr.Importe
+		}
+		out = append(out, finding{
+			Severity: sev,
+			Table:    table,
+			Rows:     rs,
+			Explanation: fmt.Sprintf("%d de %d adxudicacións a %s (%s €)",
+				len(rs), len(rows), rs[0].Supplier, formatEuroFloat(total)),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].Rows) != len(out[j].Rows) {
+			return len(out[i].Rows) > len(out[j].Rows)
+		}
+		return out[i].Rows[0].SupplierID < out[j].Rows[0].SupplierID
+	})
+	return out, nil
+}
+
+// weekendAwardIndicator: adxudicacións con data de sábado ou domingo
+type weekendAwardIndicator struct{}
+
+func (weekendAwardIndicator) ID() string   { return "adx_fin_de_semana" }
+func (weekendAwardIndicator) Name() string { return "Adxudicación en fin de semana" }
+
+func (weekendAwardIndicator) Evaluate(ctx *flagContext, table string) ([]finding, error) {
+	rows, err := ctx.tableRows(table)
+	if err != nil {
+		return nil, err
+	}
+	var out []finding
+	for _, fr := range rows {
+		d, err := time.Parse("2006-01-02", fr.DataAdx)
+		if err != nil {
+			continue
+		}
+		if wd := d.Weekday(); wd == time.Saturday || wd == time.Sunday {
+			out = append(out, finding{
+				Severity:    sevBaixa,
+				Table:       table,
+				Rows:        []flagRow{fr},
+				Explanation: fmt.Sprintf("adxudicado en %s (%s)", weekdayNames[wd], fr.DataAdx),
+			})
+		}
+	}
+	return out, nil
+}
+
+var weekdayNames = map[time.Weekday]string{time.Saturday: "sábado", time.Sunday: "domingo"}
+
+// splittingIndicator: o detector de fraccionamento (splitting.go) como indicador
+type splittingIndicator struct{}
+
+func (splittingIndicator) ID() string   { return "fraccionamento" }
+func (splittingIndicator) Name() string { return "Posible fraccionamento de contratos menores" }
+
+func (splittingIndicator) Evaluate(ctx *flagContext, table string) ([]finding, error) {
+	if !strings.HasSuffix(strings.ToLower(table), "_contratos_menores") {
+		return nil, nil
+	}
+	flags, err := detectSplitting(ctx.db, ctx.sup, []string{table}, ctx.base)
+	if err != nil {
+		return nil, err
+	}
+	var out []finding
+	for _, f := range flags {
+		fd := finding{
+			Severity: sevAlta,
+			Table:    table,
+			Explanation: fmt.Sprintf("%d contratos de %s a %s entre %s e %s suman %s € (límite %s €)",
+				len(f.Contratos), f.Categoria, f.Supplier, f.Desde, f.Ata, formatEuroFloat(f.Total), formatEuroFloat(f.Limite)),
+		}
+		for _, c := range f.Contratos {
+			fd.Rows = append(fd.Rows, flagRow{
+				Table: table, Expediente: c.Expediente, Obxecto: c.Obxecto, Adx: c.Adx,
+				SupplierID: f.SupplierID, Supplier: f.Supplier,
+				Importe: c.Importe, HasImporte: true, Data: c.Data, URL: c.URL, FichaURL: c.FichaURL,
+			})
+		}
+		out = append(out, fd)
+	}
+	return out, nil
+}
+
+// ==== puntuación ====
+
+// flagScore: un expediente ou provedor coa suma das gravidades dos seus achados
+type flagScore struct {
+	Key        string         `json:"key"`
+	Label      string         `json:"label"`
+	Table      string         `json:"table,omitempty"`
+	URL        string         `json:"url,omitempty"`
+	FichaURL   string         `json:"fichaUrl,omitempty"`
+	Score      int            `json:"score"`
+	Findings   int            `json:"findings"`
+	Indicators map[string]int `json:"indicators"` // nº de achados por indicador
+}
+
+type flagReport struct {
+	Indicators  []flagIndicatorInfo `json:"indicators"`
+	Expedientes []*flagScore        `json:"expedientes"`
+	Suppliers   []*flagScore        `json:"suppliers"`
+	Findings    []finding           `json:"findings"`
+}
+
+type flagIndicatorInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Findings int    `json:"findings"`
+}
+
+// runFlags pasa os indicadores (todos, ou os de only) por todas as táboas base
+func runFlags(ctx *flagContext, only map[string]bool) (*flagReport, error) {
+	tables, err := listBaseTables(ctx.db)
+	if err != nil {
+		return nil, err
+	}
+	rep := &flagReport{Findings: []finding{}}
+	for _, ind := range flagIndicators {
+		if len(only) > 0 && !only[ind.ID()] {
+			continue
+		}
+		info := flagIndicatorInfo{ID: ind.ID(), Name: ind.Name()}
+		for _, t := range tables {
+			fs, err := ind.Evaluate(ctx, t)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", ind.ID(), err)
+			}
+			for _, f := range fs {
+				f.Indicator, f.Organo = ind.ID(), organoFromTable(t)
+				rep.Findings = append(rep.Findings, f)
+			}
+			info.Findings += len(fs)
+		}
+		rep.Indicators = append(rep.Indicators, info)
+	}
+
+	exps, sups := map[string]*flagScore{}, map[string]*flagScore{}
+	add := func(m map[string]*flagScore, key string, mk func() *flagScore, f finding) {
+		sc := m[key]
+		if sc == nil {
+			sc = mk()
+			sc.Indicators = map[string]int{}
+			m[key] = sc
+		}
+		sc.Score += f.Severity
+		sc.Findings++
+		sc.Indicators[f.Indicator]++
+	}
+	for _, f := range rep.Findings {
+		// cada achado conta unha vez por expediente e por provedor, aínda que teña varias filas
+		seenExp, seenSup := map[string]bool{}, map[string]bool{}
+		for _, fr := range f.Rows {
+			if fr.Expediente != "" && !seenExp[fr.Expediente] {
+				seenExp[fr.Expediente] = true
+				fr := fr
+				add(exps, fr.Table+"\x00"+fr.Expediente, func() *flagScore {
+					return &flagScore{Key: fr.Expediente, Label: fr.Obxecto, Table: fr.Table, URL: fr.URL, FichaURL: fr.FichaURL}
+				}, f)
+			}
+			if fr.SupplierID != "" && !seenSup[fr.SupplierID] {
+				seenSup[fr.SupplierID] = true
+				fr := fr
+				add(sups, fr.SupplierID, func() *flagScore {
+					return &flagScore{Key: fr.SupplierID, Label: fr.Supplier}
+				}, f)
+			}
+		}
+	}
+	rep.Expedientes, rep.Suppliers = rankScores(exps), rankScores(sups)
+	return rep, nil
+}
+
+// rankScores: de maior a menor puntuación (empates polo número de achados e a clave)
+func rankScores(m map[string]*flagScore) []*flagScore {
+	out := make([]*flagScore, 0, len(m))
+	for _, sc := range m {
+		out = append(out, sc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		if out[i].Findings != out[j].Findings {
+			return out[i].Findings > out[j].Findings
+		}
+		return out[i].Table+out[i].Key < out[j].Table+out[j].Key
+	})
+	return out
+}
+
+// ==== /flags e /api/flags ====
+
+// flagsLimit: cantos expedientes e provedores se amosan na páxina
+const flagsLimit = 50
+
+func (s *server) flagReport(r *http.Request) (*flagReport, error) {
+	c := s.concello(r)
+	only := map[string]bool{}
+	for _, id := range r.URL.Query()["indicator"] {
+		only[id] = true
+	}
+	return runFlags(newFlagContext(c.DB, s.suppliers(), basePath(r)), only)
+}
+
+func (s *server) handleFlags(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.flagReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	data := map[string]any{
+		"Indicators":  rep.Indicators,
+		"Expedientes": rep.Expedientes[:min(flagsLimit, len(rep.Expedientes))],
+		"Suppliers":   rep.Suppliers[:min(flagsLimit, len(rep.Suppliers))],
+		"NExp":        len(rep.Expedientes),
+		"NSup":        len(rep.Suppliers),
+	}
+	if err := s.tpl.ExecuteTemplate(w, "flags.gohtml", s.pageData(r, data)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *server) handleAPIFlags(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.flagReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(rep)
+}
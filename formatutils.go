@@ -117,10 +117,10 @@ func numericOrderExpr(col string, style string) string {
 	switch style {
 	case "euro":
 		// "12.345,67" -> 12345.67
-		return fmt.Sprintf("CAST(REPLACE(REPLACE(%s, '.', ''), ',', '.') AS REAL)", id)
+		return dbDialect.ToReal(id, true)
 	case "dot":
 		// "12345.67" ou REAL
-		return fmt.Sprintf("CAST(%s AS REAL)", id)
+		return dbDialect.ToReal(id, false)
 	default:
 		return id
 	}
@@ -187,6 +187,21 @@ func formatEuroFloat(f float64) string {
 	return b.String() + "," + decp
 }
 
+// formatBytes: 15 B, 120,5 kB, 3,2 MB
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, unit := float64(n)/1024, "kB"
+	for _, u := range []string{"MB", "GB"} {
+		if f < 1024 {
+			break
+		}
+		f, unit = f/1024, u
+	}
+	return strings.Replace(fmt.Sprintf("%.1f %s", f, unit), ".", ",", 1)
+}
+
 // ==== conversores formatos de importes
 
 func safeFile(s string) string {
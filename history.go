@@ -0,0 +1,550 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== Historial (asOf) ====
+// Con --history gardamos, ao lado de cada .db, un <concello>.history.sqlite só de engadir: cada
+// vez que o .db cambia (mtime ou tamaño) apúntase unha instantánea e as versións das filas que
+// cambiaron, por táboa e expediente. Unha fila eliminada queda como versión sen datos.
+//
+// Logo /table/, /summary e /summary_all (e o resto de páxinas do concello) aceptan asOf=AAAA-MM-DD:
+// reconstrúese a base de datos tal como estaba na última instantánea ata ese día e sérvese
+// coma se fose outro concello, en /{concello}@AAAA-MM-DD/..., así as ligazóns seguen na mesma data.
+//
+//	lb_snapshots (id, scraped_at, recorded_at, size, mtime)   scraped_at: mtime do .db
+//	lb_tables    (snap, tbl, ord, columns)                    táboas e columnas de cada instantánea
+//	lb_versions  (tbl, key, snap, ord, hash, data)            data JSON da fila; NULL = eliminada
+//	lb_order     (snap, tbl, keys)                            claves de cada táboa na orde da instantánea
+//
+// lb_versions só garda as filas que cambian, e a súa ord é a da instantánea na que cambiaron;
+// por iso a orde de cada instantánea vai aparte, en lb_order (os historiais sen ela usan ord).
+
+// useHistory: gardar o historial ao abrir cada concello (--history)
+var useHistory = false
+
+func historyPath(dbPath string) string {
+	return stripExt(dbPath) + ".history.sqlite"
+}
+
+func isHistoryFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".history.sqlite")
+}
+
+// formato das datas das instantáneas (hora local, compárase como texto)
+const historyTimeLayout = "2006-01-02T15:04:05"
+
+// recordHistory apunta unha instantánea se o .db cambiou dende a última
+func recordHistory(dbPath string) error {
+	st, err := os.Stat(dbPath)
+	if err != nil {
+		return err
+	}
+	h, err := sql.Open("sqlite3", historyPath(dbPath))
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	if _, err := h.Exec(`
+		CREATE TABLE IF NOT EXISTS lb_snapshots (id INTEGER PRIMARY KEY, scraped_at TEXT, recorded_at TEXT, size INTEGER, mtime INTEGER);
+		CREATE TABLE IF NOT EXISTS lb_tables (snap INTEGER, tbl TEXT, ord INTEGER, columns TEXT, PRIMARY KEY (snap, tbl));
+		CREATE TABLE IF NOT EXISTS lb_versions (tbl TEXT, key TEXT, snap INTEGER, ord INTEGER, hash TEXT, data TEXT, PRIMARY KEY (tbl, key, snap));
+		CREATE TABLE IF NOT EXISTS lb_order (snap INTEGER, tbl TEXT, keys TEXT, PRIMARY KEY (snap, tbl));
+	`); err != nil {
+		return err
+	}
+	var size, mtime int64
+	err = h.QueryRow(`SELECT size, mtime FROM lb_snapshots ORDER BY id DESC LIMIT 1`).Scan(&size, &mtime)
+	if err == nil && size == st.Size() && mtime == st.ModTime().Unix() {
+		return nil // sen cambios
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	src, err := sql.Open("sqlite3", readOnlyURI(dbPath))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// estado actual: a última versión de cada fila
+	current := map[string]map[string]string{} // táboa → clave → hash ("" se eliminada)
+	err = queryEach(h, `
+		SELECT v.tbl, v.key, COALESCE(v.hash, '') FROM lb_versions v
+		JOIN (SELECT tbl, key, MAX(snap) AS snap FROM lb_versions GROUP BY tbl, key) m
+		  ON v.tbl = m.tbl AND v.key = m.key AND v.snap = m.snap`, nil, func(rows *sql.Rows) error {
+		var t, k, hash string
+		if err := rows.Scan(&t, &k, &hash); err != nil {
+			return err
+		}
+		if current[t] == nil {
+			current[t] = map[string]string{}
+		}
+		current[t][k] = hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tables, err := listTables(src)
+	if err != nil {
+		return err
+	}
+	tx, err := h.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO lb_snapshots (scraped_at, recorded_at, size, mtime) VALUES (?,?,?,?)`,
+		st.ModTime().Format(historyTimeLayout), time.Now().Format(historyTimeLayout), st.Size(), st.ModTime().Unix())
+	if err != nil {
+		return err
+	}
+	snap, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	ins, err := tx.Prepare(`INSERT INTO lb_versions VALUES (?,?,?,?,?,?)`)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	changed := 0
+	seenTable := map[string]bool{}
+	for i, t := range tables {
+		seenTable[t] = true
+		cols, err := tableColumns(src, t)
+		if err != nil {
+			return err
+		}
+		cj, _ := json.Marshal(cols)
+		if _, err := tx.Exec(`INSERT INTO lb_tables VALUES (?,?,?,?)`, snap, t, i, string(cj)); err != nil {
+			return err
+		}
+		rows, err := historyRows(src, t, cols)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		seen := map[string]bool{}
+		keys := make([]string, len(rows))
+		for ord, r := range rows {
+			seen[r.key] = true
+			keys[ord] = r.key
+			if current[t][r.key] == r.hash {
+				continue
+			}
+			if _, err := ins.Exec(t, r.key, snap, ord, r.hash, r.data); err != nil {
+				return err
+			}
+			changed++
+		}
+		kj, _ := json.Marshal(keys)
+		if _, err := tx.Exec(`INSERT INTO lb_order VALUES (?,?,?)`, snap, t, string(kj)); err != nil {
+			return err
+		}
+		// as que xa non están: versión sen datos
+		for k, hash := range current[t] {
+			if !seen[k] && hash != "" {
+				if _, err := ins.Exec(t, k, snap, 0, nil, nil); err != nil {
+					return err
+				}
+				changed++
+			}
+		}
+	}
+	for t, keys := range current {
+		if seenTable[t] {
+			continue
+		}
+		for k, hash := range keys {
+			if hash != "" {
+				if _, err := ins.Exec(t, k, snap, 0, nil, nil); err != nil {
+					return err
+				}
+				changed++
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("historial %s: instantánea %d (%s), %d versións novas", historyPath(dbPath), snap, st.ModTime().Format(historyTimeLayout), changed)
+	return nil
+}
+
+type historyRow struct {
+	key, hash, data string
+}
+
+// historyRows le as filas como JSON (NULL → null) coa súa clave: o expediente, e se falta
+// ou se repite na táboa, o expediente co hash da fila
+func historyRows(db *sql.DB, table string, cols []Column) ([]historyRow, error) {
+	exprs := make([]string, len(cols))
+	for i, c := range cols {
+		exprs[i] = "CAST(" + quoteIdent(c.Name) + " AS TEXT)"
+	}
+	expCol := roleColumn(table, cols, roleExpediente)
+	var out []historyRow
+	var exps []string
+	count := map[string]int{}
+	err := queryEach(db, fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ", "), quoteIdent(table)), nil, func(rows *sql.Rows) error {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		m := make(map[string]*string, len(cols))
+		exp := ""
+		for i, c := range cols {
+			if vals[i].Valid {
+				v := vals[i].String
+				m[c.Name] = &v
+				if c.Name == expCol {
+					exp = strings.TrimSpace(v)
+				}
+			} else {
+				m[c.Name] = nil
+			}
+		}
+		b, err := json.Marshal(m) // as claves saen ordenadas: o hash é estable
+		if err != nil {
+			return err
+		}
+		sum := sha1.Sum(b)
+		out = append(out, historyRow{hash: hex.EncodeToString(sum[:]), data: string(b)})
+		exps = append(exps, exp)
+		count[exp]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]int{}
+	for i := range out {
+		k := exps[i]
+		if k == "" || count[k] > 1 {
+			k += "#" + out[i].hash[:12]
+		}
+		// filas idénticas repetidas
+		if used[k]++; used[k] > 1 {
+			k = fmt.Sprintf("%s-%d", k, used[k])
+		}
+		out[i].key = k
+	}
+	return out, nil
+}
+
+// ==== reconstrución ====
+
+type historySnapshot struct {
+	ID         int64  `json:"id"`
+	ScrapedAt  string `json:"scrapedAt"`
+	RecordedAt string `json:"recordedAt"`
+	Versions   int    `json:"versions"` // filas novas, cambiadas ou eliminadas nesta instantánea
+}
+
+// snapshotAt: a última instantánea ata asOf (AAAA-MM-DD enteiro, ou AAAA-MM-DDTHH:MM:SS)
+func snapshotAt(dbPath, asOf string) (int64, error) {
+	cutoff := asOf
+	if _, err := time.Parse("2006-01-02", asOf); err == nil {
+		cutoff = asOf + "T23:59:59"
+	} else if _, err := time.Parse(historyTimeLayout, asOf); err != nil {
+		return 0, fmt.Errorf("asOf %q: ten que ser AAAA-MM-DD", asOf)
+	}
+	hp := historyPath(dbPath)
+	if _, err := os.Stat(hp); err != nil {
+		return 0, fmt.Errorf("non hai historial de %s (--history)", filepath.Base(dbPath))
+	}
+	h, err := sql.Open("sqlite3", readOnlyURI(hp))
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+	var id sql.NullInt64
+	if err := h.QueryRow(`SELECT MAX(id) FROM lb_snapshots WHERE scraped_at <= ?`, cutoff).Scan(&id); err != nil {
+		return 0, err
+	}
+	if !id.Valid {
+		return 0, fmt.Errorf("o historial de %s non chega ata %s", filepath.Base(dbPath), asOf)
+	}
+	return id.Int64, nil
+}
+
+// materializeSnapshot escribe a base de datos da instantánea snap en dst (se non existe xa:
+// as instantáneas non cambian)
+func materializeSnapshot(dbPath string, snap int64, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	h, err := sql.Open("sqlite3", readOnlyURI(historyPath(dbPath)))
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	type tableDef struct {
+		name string
+		cols []Column
+	}
+	var tables []tableDef
+	err = queryEach(h, `SELECT tbl, columns FROM lb_tables WHERE snap = ? ORDER BY ord`, []any{snap}, func(rows *sql.Rows) error {
+		var td tableDef
+		var cj string
+		if err := rows.Scan(&td.name, &cj); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(cj), &td.cols); err != nil {
+			return err
+		}
+		tables = append(tables, td)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var hasOrder bool // os historiais anteriores a lb_order non a teñen
+	if err := h.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'lb_order'`).Scan(&hasOrder); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	_ = os.Remove(tmp)
+	out, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	tx, err := out.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, td := range tables {
+		defs, names, marks := make([]string, len(td.cols)), make([]string, len(td.cols)), make([]string, len(td.cols))
+		for i, c := range td.cols {
+			defs[i] = quoteIdent(c.Name) + " " + c.Type
+			names[i] = quoteIdent(c.Name)
+			marks[i] = "?"
+		}
+		if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(td.name), strings.Join(defs, ", "))); err != nil {
+			return fmt.Errorf("%s: %w", td.name, err)
+		}
+		ins, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(td.name), strings.Join(names, ", "), strings.Join(marks, ",")))
+		if err != nil {
+			return err
+		}
+		// as filas vivas na instantánea, na orde en que cambiaron por última vez
+		var order []string
+		data := map[string]string{}
+		err = queryEach(h, `
+			SELECT v.key, v.data FROM lb_versions v
+			JOIN (SELECT key, MAX(snap) AS snap FROM lb_versions WHERE tbl = ? AND snap <= ? GROUP BY key) m
+			  ON v.key = m.key AND v.snap = m.snap
+			WHERE v.tbl = ? AND v.data IS NOT NULL
+			ORDER BY v.ord`, []any{td.name, snap, td.name}, func(rows *sql.Rows) error {
+			var k, d string
+			if err := rows.Scan(&k, &d); err != nil {
+				return err
+			}
+			order = append(order, k)
+			data[k] = d
+			return nil
+		})
+		// e se o historial a garda, a orde que tiñan nesa instantánea
+		if err == nil && hasOrder {
+			var kj string
+			switch err = h.QueryRow(`SELECT keys FROM lb_order WHERE snap = ? AND tbl = ?`, snap, td.name).Scan(&kj); err {
+			case nil:
+				err = json.Unmarshal([]byte(kj), &order)
+			case sql.ErrNoRows:
+				err = nil
+			}
+		}
+		for _, k := range order {
+			if err != nil {
+				break
+			}
+			d, ok := data[k]
+			if !ok {
+				err = fmt.Errorf("a fila %q de lb_order non ten versión", k)
+				break
+			}
+			var m map[string]*string
+			if err = json.Unmarshal([]byte(d), &m); err != nil {
+				break
+			}
+			args := make([]any, len(td.cols))
+			for i, c := range td.cols {
+				if v := m[c.Name]; v != nil {
+					args[i] = *v
+				}
+			}
+			_, err = ins.Exec(args...)
+		}
+		ins.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", td.name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// asOfMax: cantos concellos reconstruídos se manteñen abertos (e no disco) á vez
+const asOfMax = 4
+
+// asOfDB: un concello reconstruído, cantas peticións o están a usar e cando se usou por última vez
+type asOfDB struct {
+	c    *concelloDB
+	refs int
+	used int64
+}
+
+// asOfDBs: concellos reconstruídos xa abertos, por ruta do .db e instantánea
+var asOfDBs = struct {
+	sync.Mutex
+	m    map[string]*asOfDB
+	tick int64
+}{m: map[string]*asOfDB{}}
+
+// asOfConcello: o concello c tal como estaba en asOf. Hai que chamar a release ao rematar
+// de usalo: ata entón non se pode pechar.
+func asOfConcello(c *concelloDB, asOf string) (ac *concelloDB, release func(), err error) {
+	if dbDialect.Name() != "sqlite" {
+		return nil, nil, fmt.Errorf("o historial só vale para SQLite")
+	}
+	snap, err := snapshotAt(c.DBPath, asOf)
+	if err != nil {
+		return nil, nil, err
+	}
+	abs, _ := filepath.Abs(c.DBPath)
+	key := fmt.Sprintf("%s@%d", abs, snap)
+
+	asOfDBs.Lock()
+	defer asOfDBs.Unlock()
+	e := asOfDBs.m[key]
+	if e == nil {
+		sum := sha1.Sum([]byte(abs))
+		dst := filepath.Join(os.TempDir(), "licitaberto-asof", fmt.Sprintf("%s-%s-%d.sqlite", c.Slug, hex.EncodeToString(sum[:4]), snap))
+		if err := materializeSnapshot(c.DBPath, snap, dst); err != nil {
+			return nil, nil, err
+		}
+		if useCache {
+			if err := ensureCache(dst); err != nil {
+				log.Printf("WARN: non se puido construír a caché de %s: %v", dst, err)
+			}
+		}
+		db, err := openSQLite(dst)
+		if err != nil {
+			return nil, nil, err
+		}
+		e = &asOfDB{c: &concelloDB{Slug: c.Slug, Name: c.Name, DBPath: dst, PDFPath: c.PDFPath, DB: db}}
+		asOfDBs.m[key] = e
+	}
+	asOfDBs.tick++
+	e.used = asOfDBs.tick
+	e.refs++
+	evictAsOf()
+	var once sync.Once
+	return e.c, func() {
+		once.Do(func() {
+			asOfDBs.Lock()
+			defer asOfDBs.Unlock()
+			e.refs--
+			evictAsOf()
+		})
+	}, nil
+}
+
+// evictAsOf pecha e borra os reconstruídos usados hai máis tempo ata quedar en asOfMax
+// (os que están en uso agardan). Chámase con asOfDBs bloqueado.
+func evictAsOf() {
+	for len(asOfDBs.m) > asOfMax {
+		var oldest string
+		for k, e := range asOfDBs.m {
+			if e.refs == 0 && (oldest == "" || e.used < asOfDBs.m[oldest].used) {
+				oldest = k
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		c := asOfDBs.m[oldest].c
+		delete(asOfDBs.m, oldest)
+		if err := c.DB.Close(); err != nil {
+			log.Printf("WARN: pechando %s: %v", c.DBPath, err)
+		}
+		for _, p := range []string{c.DBPath, cachePath(c.DBPath)} {
+			for _, f := range []string{p, p + "-wal", p + "-shm"} {
+				if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+					log.Printf("WARN: borrando %s: %v", f, err)
+				}
+			}
+		}
+	}
+}
+
+// listSnapshots: as instantáneas do historial dun concello
+func listSnapshots(dbPath string) ([]historySnapshot, error) {
+	out := []historySnapshot{}
+	hp := historyPath(dbPath)
+	if _, err := os.Stat(hp); err != nil {
+		return out, nil
+	}
+	h, err := sql.Open("sqlite3", readOnlyURI(hp))
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	err = queryEach(h, `
+		SELECT s.id, s.scraped_at, s.recorded_at, (SELECT COUNT(*) FROM lb_versions v WHERE v.snap = s.id)
+		FROM lb_snapshots s ORDER BY s.id`, nil, func(rows *sql.Rows) error {
+		var hs historySnapshot
+		if err := rows.Scan(&hs.ID, &hs.ScrapedAt, &hs.RecordedAt, &hs.Versions); err != nil {
+			return err
+		}
+		out = append(out, hs)
+		return nil
+	})
+	return out, err
+}
+
+// /api/history: instantáneas do concello, para escoller asOf
+func (s *server) handleAPIHistory(w http.ResponseWriter, r *http.Request) {
+	c := s.reg.get(s.concello(r).Slug) // o orixinal, tamén baixo /{concello}@data/
+	snaps, err := listSnapshots(c.DBPath)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"concello": c.Slug, "snapshots": snaps})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// snapshotTest apunta unha instantánea do .db como se o portal o baixase no día dado
+func snapshotTest(t *testing.T, path, day string) {
+	t.Helper()
+	ts, err := time.ParseInLocation("2006-01-02", day, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, ts, ts.Add(12*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordHistory(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// asOfRows: expediente e importe das filas do concello reconstruído, na orde da táboa
+func asOfRows(t *testing.T, c *concelloDB, asOf string) []string {
+	t.Helper()
+	ac, release, err := asOfConcello(c, asOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	out := []string{}
+	err = queryEach(ac.DB, `SELECT Expediente, COALESCE(Importe, 'NULL') FROM Alcaldia_contratos_menores ORDER BY rowid`, nil, func(rows *sql.Rows) error {
+		var exp, imp string
+		if err := rows.Scan(&exp, &imp); err != nil {
+			return err
+		}
+		out = append(out, exp+" "+imp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// closeAsOf pecha os concellos reconstruídos que deixou a proba
+func closeAsOf(t *testing.T) {
+	t.Cleanup(func() {
+		asOfDBs.Lock()
+		defer asOfDBs.Unlock()
+		for k, e := range asOfDBs.m {
+			e.c.DB.Close()
+			delete(asOfDBs.m, k)
+		}
+	})
+}
+
+func TestAsOf(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	useCache = false
+	defer func() { useCache = true }()
+	closeAsOf(t)
+
+	path := writeTestDB(t)
+	snapshotTest(t, path, "2024-01-10")
+
+	// o portal cambia: 2024/002 edítase, 2024/003 desaparece e a táboa vén noutra orde
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec(`
+		UPDATE Alcaldia_contratos_menores SET Importe = '350,00' WHERE Expediente = '2024/002';
+		DELETE FROM Alcaldia_contratos_menores WHERE Expediente = '2024/003';
+		CREATE TABLE novo AS SELECT * FROM Alcaldia_contratos_menores ORDER BY Expediente DESC;
+		DELETE FROM Alcaldia_contratos_menores;
+		INSERT INTO Alcaldia_contratos_menores SELECT * FROM novo;
+		DROP TABLE novo;
+	`)
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotTest(t, path, "2024-02-10")
+
+	c := &concelloDB{Slug: "proba", Name: "Proba", DBPath: path}
+	tests := []struct {
+		asOf string
+		want []string
+	}{
+		{"2024-01-10", []string{"2024/001 14.500,00", "2024/002 300,00", "2024/003 1.000,00", "2024/004 15.000,00"}},
+		{"2024-01-31", []string{"2024/001 14.500,00", "2024/002 300,00", "2024/003 1.000,00", "2024/004 15.000,00"}},
+		// as filas sen cambios gardan a orde da segunda instantánea, non a da primeira
+		{"2024-02-10", []string{"2024/004 15.000,00", "2024/002 350,00", "2024/001 14.500,00"}},
+	}
+	for _, tt := range tests {
+		if got := asOfRows(t, c, tt.asOf); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("asOf %s = %v, want %v", tt.asOf, got, tt.want)
+		}
+	}
+	if _, _, err := asOfConcello(c, "2023-12-31"); err == nil {
+		t.Error("asOf anterior ao historial: esperábase erro")
+	}
+}
+
+func TestAsOfEvict(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	useCache = false
+	defer func() { useCache = true }()
+	closeAsOf(t)
+
+	path := writeTestDB(t)
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	n := asOfMax + 2
+	for i := 1; i <= n; i++ {
+		if _, err := raw.Exec(`UPDATE Alcaldia_contratos_menores SET Importe = ? WHERE Expediente = '2024/001'`, i); err != nil {
+			t.Fatal(err)
+		}
+		snapshotTest(t, path, fmt.Sprintf("2024-01-%02d", i))
+	}
+
+	c := &concelloDB{Slug: "proba", DBPath: path}
+	// a primeira segue en uso: non se pode pechar aínda que sexa a máis vella
+	first, release, err := asOfConcello(c, "2024-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= n; i++ {
+		asOfRows(t, c, fmt.Sprintf("2024-01-%02d", i))
+	}
+	if err := first.DB.Ping(); err != nil {
+		t.Errorf("a instantánea en uso pechouse: %v", err)
+	}
+	release()
+
+	asOfDBs.Lock()
+	open := len(asOfDBs.m)
+	asOfDBs.Unlock()
+	if open != asOfMax {
+		t.Errorf("%d abertas, want %d", open, asOfMax)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "licitaberto-asof", "*"))
+	if len(files) != asOfMax {
+		t.Errorf("%d ficheiros no disco, want %d: %v", len(files), asOfMax, files)
+	}
+	// pecháronse as menos usadas que non estaban en uso: a 2 e a 3
+	for _, f := range files {
+		if m, _ := filepath.Match("*-[23].sqlite", filepath.Base(f)); m {
+			t.Errorf("%s segue no disco", f)
+		}
+	}
+	if _, err := os.Stat(first.DBPath); err != nil {
+		t.Errorf("a instantánea en uso borrouse: %v", err)
+	}
+}
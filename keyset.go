@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ==== Paxinación por cursor (keyset) ====
+// Con LIMIT/OFFSET as páxinas fondas len e descartan todas as filas anteriores, e se o scrapper
+// engade datos entre dúas peticións as filas móvense de páxina. Cun cursor (after=...) a seguinte
+// páxina empeza xusto despois da última fila vista: WHERE (chave, rowid) > (?, ?).
+//
+// O cursor é opaco para o cliente: JSON en base64 coa orde, a chave e o rowid da fila de
+// referencia, o número de páxina (só para amosar), o estilo numérico xa detectado da columna
+// e un hash do filtro (q, from, to): cun filtro distinto o cursor non vale (errBadCursor).
+
+type pageCursor struct {
+	Order string `json:"o,omitempty"`
+	Desc  bool   `json:"d,omitempty"`
+	Style string `json:"s,omitempty"` // "typed", "rank", "euro", "dot" ou "text"
+	Key   any    `json:"k,omitempty"` // chave de orde da fila de referencia
+	Row   string `json:"r"`           // rowid (ctid en Postgres) da fila de referencia
+	Page  int    `json:"p"`           // páxina á que leva o cursor
+	Back  bool   `json:"b,omitempty"` // true: páxina anterior (filas antes da referencia)
+	Filt  string `json:"f,omitempty"` // filterHash do filtro co que se fixo
+}
+
+// errBadCursor: cursor mal formado, manipulado ou doutra busca; os handlers dan 400 só por el
+var errBadCursor = errors.New("cursor non válido")
+
+// filterHash identifica a WHERE e os seus parámetros ("" sen filtro)
+func filterHash(f tableFilter) string {
+	if f.Where == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(f.Where + "\x00" + fmt.Sprintf("%#v", f.Args)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (c pageCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errBadCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.Row == "" {
+		return c, errBadCursor
+	}
+	return c, nil
+}
+
+// cursorStatus: 400 se o cursor non vale, 500 para os erros da base de datos
+func cursorStatus(err error) int {
+	if errors.Is(err, errBadCursor) {
+		return 400
+	}
+	return 500
+}
+
+// pageResult: filas dunha páxina e os cursores para moverse dende ela ("" se non hai máis)
+type pageResult struct {
+	Rows       []map[string]any
+	Page       int
+	Next, Prev string
+}
+
+// pageOrder: FROM, chave de orde (sen NULL, para poder comparala) e args extra dunha orde
+type pageOrder struct {
+	from  string
+	key   string // "" = só rowid
+	style string
+	args  []any // van diante dos da WHERE (os do JOIN de relevancia)
+}
+
+func resolvePageOrder(db *sql.DB, table string, f tableFilter, orderBy, style string) pageOrder {
+	o := pageOrder{from: quoteIdent(table)}
+	switch {
+	case orderBy == "" && f.rankFrom != "":
+		// busca FTS sen orde explícita: máis relevantes primeiro
+		o.from += f.rankFrom
+		o.args = f.rankArgs
+		o.key, o.style = "lbr.lb_rank", "rank"
+	case orderBy == "":
+		// sen orde: a da táboa (rowid)
+	default:
+		// importe tipado na caché: orde por REAL sen reparsear
+		if tf, expr, ok := typedOrder(db, table, orderBy); ok {
+			o.from, o.key, o.style = tf, expr, "typed"
+			break
+		}
+		// estilo numérico da columna: o do cursor se xa o trae, se non detectalo
+		if style != "euro" && style != "dot" && style != "text" {
+			if style = detectNumericStyle(db, table, orderBy, f.Where, f.Args); style == "" {
+				style = "text"
+			}
+		}
+		o.style = style
+		if style == "text" {
+			o.key = fmt.Sprintf("CAST(%s AS TEXT)", quoteIdent(orderBy))
+		} else {
+			o.key = numericOrderExpr(orderBy, style)
+		}
+	}
+	// NULL non se pode comparar: van primeiro en ASC (coma en SQLite) e ao final en DESC
+	if o.key != "" {
+		if o.style == "text" {
+			o.key = fmt.Sprintf("COALESCE(%s, '')", o.key)
+		} else {
+			o.key = fmt.Sprintf("COALESCE(%s, -1e308)", o.key)
+		}
+	}
+	return o
+}
+
+// fetchKeyset devolve unha páxina: dende o cursor after se o hai, se non a páxina page (OFFSET)
+func fetchKeyset(db *sql.DB, table string, cols []Column, f tableFilter, orderBy string, desc bool, page, perPage int, after string) (pageResult, error) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage <= 0 {
+		perPage = 50
+	}
+
+	var cur *pageCursor
+	if after != "" {
+		c, err := decodeCursor(after)
+		if err != nil {
+			return pageResult{}, err
+		}
+		if c.Filt != filterHash(f) {
+			return pageResult{}, fmt.Errorf("%w: é doutra busca", errBadCursor)
+		}
+		// un cursor doutra orde non serve: volvemos á páxina pedida
+		if c.Order == orderBy && c.Desc == desc {
+			cur = &c
+			page = max(1, c.Page)
+		}
+	}
+	style := ""
+	if cur != nil {
+		style = cur.Style
+	}
+	o := resolvePageOrder(db, table, f, orderBy, style)
+
+	rowKey, rowParam := dbDialect.RowKey()
+	rid := quoteIdent(table) + "." + rowKey
+
+	// dirección real da consulta: a anterior percórrese ao revés e dáse a volta ao final
+	back := cur != nil && cur.Back
+	dirDesc := desc != back
+	dir := map[bool]string{true: "DESC", false: "ASC"}[dirDesc]
+	cmp := map[bool]string{true: "<", false: ">"}[dirDesc]
+
+	where, args := f.Where, append(append([]any{}, o.args...), f.Args...)
+	ob := fmt.Sprintf("ORDER BY %s %s", rid, dir)
+	if o.key != "" {
+		ob = fmt.Sprintf("ORDER BY %s %s, %s %s", o.key, dir, rid, dir)
+	}
+	limit := fmt.Sprintf("LIMIT %d", perPage+1) // +1: saber se hai máis sen contar
+	if cur != nil {
+		if o.key != "" {
+			where = andWhere(where, fmt.Sprintf("(%s, %s) %s (?, %s)", o.key, rid, cmp, rowParam))
+			args = append(args, cur.Key, cur.Row)
+		} else {
+			where = andWhere(where, fmt.Sprintf("%s %s %s", rid, cmp, rowParam))
+			args = append(args, cur.Row)
+		}
+	} else {
+		limit += fmt.Sprintf(" OFFSET %d", (page-1)*perPage)
+	}
+
+	selectCols := make([]string, len(cols), len(cols)+2)
+	for i, c := range cols {
+		selectCols[i] = quoteIdent(c.Name)
+	}
+	keyExpr := o.key
+	if keyExpr == "" {
+		keyExpr = "NULL"
+	}
+	selectCols = append(selectCols, keyExpr, fmt.Sprintf("CAST(%s AS TEXT)", rid))
+
+	q := fmt.Sprintf("SELECT %s FROM %s %s %s %s", strings.Join(selectCols, ","), o.from, where, ob, limit)
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return pageResult{}, err
+	}
+	defer rows.Close()
+
+	type keyed struct {
+		row map[string]any
+		key any
+		rid string
+	}
+	var got []keyed
+	for rows.Next() {
+		vals := make([]any, len(cols)+2)
+		ptrs := make([]any, len(vals))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return pageResult{}, err
+		}
+		m := make(map[string]any, len(cols))
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				vals[i] = string(b) // Postgres devolve numeric e similares como bytes
+			}
+			m[c.Name] = vals[i]
+		}
+		k := vals[len(cols)]
+		if b, ok := k.([]byte); ok {
+			k = string(b)
+		}
+		got = append(got, keyed{row: m, key: k, rid: fmt.Sprint(vals[len(cols)+1])})
+	}
+	if err := rows.Err(); err != nil {
+		return pageResult{}, err
+	}
+
+	more := len(got) > perPage
+	if more {
+		got = got[:perPage]
+	}
+	if back {
+		for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+			got[i], got[j] = got[j], got[i]
+		}
+	}
+
+	res := pageResult{Rows: make([]map[string]any, len(got)), Page: page}
+	for i, g := range got {
+		res.Rows[i] = g.row
+	}
+	if len(got) == 0 {
+		return res, nil
+	}
+	mk := func(g keyed, p int, back bool) string {
+		return pageCursor{Order: orderBy, Desc: desc, Style: o.style, Key: g.key, Row: g.rid, Page: p, Back: back, Filt: filterHash(f)}.encode()
+	}
+	// cara adiante hai máis se sobrou fila (ou se viñemos cara atrás); cara atrás, se non estamos na primeira
+	hasNext, hasPrev := more, page > 1
+	if back {
+		hasNext, hasPrev = true, more
+		if !more {
+			res.Page = 1 // chegamos ao principio
+		}
+	}
+	if hasNext {
+		res.Next = mk(got[len(got)-1], page+1, false)
+	}
+	if hasPrev {
+		res.Prev = mk(got[0], page-1, true)
+	}
+	return res, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []pageCursor{
+		{Row: "1", Page: 2},
+		{Order: "Importe", Desc: true, Style: "euro", Key: 14500.0, Row: "12", Page: 3},
+		{Order: "Expediente", Style: "text", Key: "2024/001", Row: "7", Page: 2, Back: true},
+		{Style: "rank", Key: -1.25, Row: "(0,3)", Page: 5}, // ctid de Postgres
+	}
+	for _, c := range tests {
+		got, err := decodeCursor(c.encode())
+		if err != nil {
+			t.Errorf("decodeCursor(%+v): %v", c, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Errorf("round trip %+v = %+v", c, got)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	valid := pageCursor{Order: "Importe", Key: 10.0, Row: "3", Page: 2}.encode()
+	b64 := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []string{
+		"",
+		"non-é-base64!",
+		valid[:len(valid)-4], // cortado
+		valid + "==",         // con recheo, que non leva
+		b64("non é json"),
+		b64(`{"o":"Importe","p":2}`), // sen fila de referencia
+		b64(`{"r":3,"p":2}`),         // fila que non é texto
+		b64(`{"r":"3","p":"dous"}`),
+	}
+	for _, s := range tests {
+		if c, err := decodeCursor(s); !errors.Is(err, errBadCursor) {
+			t.Errorf("decodeCursor(%q) = %+v, %v; want errBadCursor", s, c, err)
+		}
+	}
+}
+
+// percorre a táboa de proba páxina a páxina cos cursores, cara adiante e cara atrás
+func TestFetchKeysetPages(t *testing.T) {
+	for _, withCache := range []bool{true, false} {
+		db := openTestDB(t, withCache)
+		table := "Alcaldia_contratos_menores"
+		cols, err := tableColumns(db, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, order := range []struct {
+			col  string
+			desc bool
+			want []string
+		}{
+			{"", false, []string{"2024/001", "2024/002", "2024/003", "2024/004"}},
+			{"Importe", false, []string{"2024/002", "2024/003", "2024/001", "2024/004"}},
+			{"Importe", true, []string{"2024/004", "2024/001", "2024/003", "2024/002"}},
+			{"Expediente", true, []string{"2024/004", "2024/003", "2024/002", "2024/001"}},
+		} {
+			name := fmt.Sprintf("cache=%v %s desc=%v", withCache, order.col, order.desc)
+			var got []string
+			var pages []pageResult
+			after := ""
+			for i := 0; i < 10; i++ {
+				res, err := fetchKeyset(db, table, cols, tableFilter{}, order.col, order.desc, 1, 1, after)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if res.Page != i+1 {
+					t.Errorf("%s: páxina %d, want %d", name, res.Page, i+1)
+				}
+				for _, r := range res.Rows {
+					got = append(got, fmt.Sprint(r["Expediente"]))
+				}
+				pages = append(pages, res)
+				if res.Next == "" {
+					break
+				}
+				after = res.Next
+			}
+			if !reflect.DeepEqual(got, order.want) {
+				t.Errorf("%s: %v, want %v", name, got, order.want)
+				continue
+			}
+			// dende a última páxina, Prev leva á penúltima
+			last := pages[len(pages)-1]
+			prev, err := fetchKeyset(db, table, cols, tableFilter{}, order.col, order.desc, 1, 1, last.Prev)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(prev.Rows) != 1 || fmt.Sprint(prev.Rows[0]["Expediente"]) != order.want[len(order.want)-2] {
+				t.Errorf("%s: Prev = %v, want %s", name, prev.Rows, order.want[len(order.want)-2])
+			}
+		}
+	}
+}
+
+func TestFetchKeysetOtherOrder(t *testing.T) {
+	db := openTestDB(t, false)
+	table := "Alcaldia_contratos_menores"
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// un cursor doutra orde non se usa: vale a páxina pedida
+	after := pageCursor{Order: "Importe", Key: 300.0, Row: "2", Page: 2}.encode()
+	res, err := fetchKeyset(db, table, cols, tableFilter{}, "Expediente", false, 3, 1, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Page != 3 || len(res.Rows) != 1 || res.Rows[0]["Expediente"] != "2024/003" {
+		t.Errorf("got page %d %v, want 3 [2024/003]", res.Page, res.Rows)
+	}
+	if _, err := fetchKeyset(db, table, cols, tableFilter{}, "", false, 1, 1, "lixo"); err == nil {
+		t.Error("cursor lixo: want error")
+	}
+}
+
+// un cursor manipulado só move o punto de partida: os valores van como parámetros
+func TestFetchKeysetTamperedCursor(t *testing.T) {
+	db := openTestDB(t, false)
+	table := "Alcaldia_contratos_menores"
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		c    pageCursor
+		want []string
+	}{
+		{pageCursor{Order: "Expediente", Style: "text", Key: "2024/002' OR '1'='1", Row: "1", Page: 2}, []string{"2024/003", "2024/004"}},
+		{pageCursor{Order: "Expediente", Style: "); DROP TABLE x; --", Key: "2024/003", Row: "3", Page: 2}, []string{"2024/004"}},
+		{pageCursor{Row: "99", Page: 7}, nil},
+		{pageCursor{Row: "0 OR 1=1", Page: 2}, []string{"2024/001", "2024/002", "2024/003", "2024/004"}},
+	}
+	for _, tt := range tests {
+		res, err := fetchKeyset(db, table, cols, tableFilter{}, tt.c.Order, false, 1, 10, tt.c.encode())
+		if err != nil {
+			t.Errorf("%+v: %v", tt.c, err)
+			continue
+		}
+		var got []string
+		for _, r := range res.Rows {
+			got = append(got, fmt.Sprint(r["Expediente"]))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v = %v, want %v", tt.c, got, tt.want)
+		}
+	}
+	if n, err := countRows(db, table, "", nil); err != nil || n != 4 {
+		t.Errorf("a táboa cambiou: %d filas, %v", n, err)
+	}
+}
+
+// o cursor vai atado ao filtro: con outra busca é un erro de cursor (400); os da base de datos non
+func TestFetchKeysetFilter(t *testing.T) {
+	db := openTestDB(t, false)
+	table := "Alcaldia_contratos_menores"
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := func(q string) tableFilter {
+		f, err := buildFilter(db, table, cols, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	obras := filter("tipo:obras")
+	res, err := fetchKeyset(db, table, cols, obras, "", false, 1, 1, "")
+	if err != nil || res.Next == "" {
+		t.Fatalf("primeira páxina: %+v, %v", res, err)
+	}
+	if res, err := fetchKeyset(db, table, cols, filter("tipo:obras"), "", false, 1, 1, res.Next); err != nil || len(res.Rows) != 1 || res.Rows[0]["Expediente"] != "2024/003" {
+		t.Errorf("mesmo filtro: %v, %v", res.Rows, err)
+	}
+	for _, f := range []tableFilter{filter("tipo:servizos"), filter("tipo:obras importe>1"), {}} {
+		if _, err := fetchKeyset(db, table, cols, f, "", false, 1, 1, res.Next); !errors.Is(err, errBadCursor) || cursorStatus(err) != 400 {
+			t.Errorf("%q: err = %v, want errBadCursor", f.Where, err)
+		}
+	}
+	_, err = fetchKeyset(db, "Non_existe", cols, tableFilter{}, "", false, 1, 1, "")
+	if err == nil || errors.Is(err, errBadCursor) || cursorStatus(err) != 500 {
+		t.Errorf("táboa que non existe: err = %v, want 500", err)
+	}
+}
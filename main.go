@@ -3,6 +3,16 @@
 //
 //	go run . --db ./data.sqlite --mode web   # UI web en http://127.0.0.1:8080
 //	go run . --db ./data.sqlite --mode tui   # UI TUI (terminal)
+//	go run . --db ./dir_con_sqlites/ --mode web        # varios concellos: /{concello}/...
+//	go run . --db ./ames.db,./teo.db --mode web        # idem, lista separada por comas
+//	go run . index --db ./data.sqlite                  # (re)constrúe a caché tipada e sae
+//	go run . diff --format csv vella.db nova.db        # cambios entre dúas copias (ver diff.go)
+//	go run . history --db ./dir_con_sqlites/           # garda unha instantánea no historial e sae
+//	go run . docs --db ./dir_con_sqlites/              # indexa o texto dos PDFs (ver docs.go) e sae
+//	go run . alerts --db ./dir/ --searches buscas.json # avalía as buscas gardadas (ver searches.go)
+//	go run . check-files --db ./dir_con_sqlites/       # anexos que faltan, orfos ou rotos (ver filecheck.go)
+//	go run . --db ./data.sqlite --roles roles.json     # roles de columna propios (ver roles.go)
+//	go run . --db 'postgres://user@host/db' --mode web # PostgreSQL: un concello por esquema
 //
 // Dependencias:
 //
@@ -11,12 +21,18 @@
 //	go get github.com/charmbracelet/bubbles@v0.16.2
 //	go get github.com/charmbracelet/lipgloss
 //	go get github.com/xuri/excelize/v2
+//	go get github.com/ledongthuc/pdf                  # texto dos PDFs (docs.go)
 //
 // Notas:
-// - Read-only: activamos PRAGMA query_only=ON. Este programa non fai INSERT/UPDATE/DELETE.
+// - Read-only: activamos PRAGMA query_only=ON e o .db nunca se escribe.
+//   O que escribimos vai en ficheiros aparte: a caché tipada
+//   (<db>.cache.sqlite), o texto dos PDFs (<db>.docs.sqlite), o historial (<db>.history.sqlite,
+//   con --history), as buscas gardadas e o seu estado (.state.json) e as bases de datos
+//   reconstruídas para asOf (no directorio temporal, só as últimas usadas).
 // - Exportación: CSV e XLSX (Excel) da vista filtrada/ordenada.
 // - Gráficas: no modo web úsase Chart.js; no modo TUI amósase un histograma ASCII.
-// - Portabilidade: para migrar a Postgres/MySQL no futuro, substitúe o driver e os SQLs de detalles.
+// - Portabilidade: o SQL propio de cada motor vai en dialect.go (SQLite) e dialect_postgres.go.
+//   Para MySQL abondaría con outra implementación de dialect.
 
 // by ChatGPT+pequenas correcións minhas
 //
@@ -24,7 +40,6 @@
 package main
 
 import (
-	"database/sql"
 	"embed"
 	"time"
 
@@ -33,30 +48,31 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
-	"path/filepath"
+	"os"
 	"strings"
+	"sync"
 
 	tea "github.com/charmbracelet/bubbletea"
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/text/cases"
-	"golang.org/x/text/language"
 )
 
 //go:embed webstatic/*
 var webFS embed.FS
 
-var pdfPath, concello string
-
 type server struct {
-	db      *sql.DB
+	reg     *registry
 	tpl     *template.Template
 	perPage int
+
+	supMu    sync.Mutex
+	sup      *supplierIndex // provedores, ver suppliers.go
+	supStale bool           // cambiou un .db: reconstruír na seguinte petición
 }
 
 //go:embed templates/* templates/partials/*
 var tplFS embed.FS
 
-func newServer(db *sql.DB) (*server, error) {
+func newServer(reg *registry) (*server, error) {
 	tpl := template.Must(
 		template.New("").
 			Funcs(template.FuncMap{
@@ -66,6 +82,8 @@ func newServer(db *sql.DB) (*server, error) {
 				"toUpper":   strings.ToUpper,    // pasar a maiúsculas
 				"hasPrefix": strings.HasPrefix,  // comprobar prefixo
 				"trim":      strings.TrimSpace,  // quitar espazos arredor
+				"euro":      formatEuroFloat,    // 12.345,67
+				"bytes":     formatBytes,        // 120,5 kB
 			}).
 			ParseFS(tplFS,
 				"templates/*.gohtml",
@@ -74,7 +92,7 @@ func newServer(db *sql.DB) (*server, error) {
 	)
 	// log.Printf("templates: %s", tpl.DefinedTemplates())
 
-	return &server{db: db, tpl: tpl, perPage: 25}, nil
+	return &server{reg: reg, tpl: tpl, perPage: 25}, nil
 }
 
 func (s *server) routes(addr string, debug bool) error {
@@ -83,23 +101,92 @@ func (s *server) routes(addr string, debug bool) error {
 		return err
 	}
 
+	// rutas dun concello: van sen prefixo (concello por defecto) ou baixo /{concello}/...
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withLogging(debug, s.handleIndex))
+	mux.HandleFunc("/table/", withLogging(debug, s.handleTable))
+	mux.HandleFunc("/export/csv", withLogging(debug, s.handleExportCSV))
+	mux.HandleFunc("/export/xlsx", withLogging(debug, s.handleExportXLSX))
+	mux.HandleFunc("/export/zip", withLogging(debug, s.handleExportZIP))
+	mux.HandleFunc("/api/table/", withLogging(debug, s.handleAPITable)) // ← API JSON para Instant Search
+
+	mux.HandleFunc("/pdfs/", s.handlePDFs)
+
+	// directorio de adxudicatarios e ficha de cada un
+	mux.HandleFunc("/adjudicatary", withLogging(debug, s.handleAdjudicatary))
+	mux.HandleFunc("/adjudicatary/", withLogging(debug, s.handleAdjudicatary))
+	mux.HandleFunc("/api/adjudicatary", withLogging(debug, s.handleAPIAdjudicatary))
+	mux.HandleFunc("/api/adjudicatary/", withLogging(debug, s.handleAPIAdjudicatary))
+
+	// ficha dun expediente: filas, documentos, outras táboas e liña de tempo
+	mux.HandleFunc("/expediente/", withLogging(debug, s.handleExpediente))
+	mux.HandleFunc("/api/expediente/", withLogging(debug, s.handleAPIExpediente))
+
+	mux.HandleFunc("/summary", withLogging(debug, s.handleSummary))
+	mux.HandleFunc("/api/summary", withLogging(debug, s.handleAPISummary))
+
+	mux.HandleFunc("/summary_all", withLogging(debug, s.handleSummaryAll))
+	mux.HandleFunc("/api/summary_all", withLogging(debug, s.handleAPISummaryAll))
+
+	mux.HandleFunc("/api/roles", withLogging(debug, s.handleAPIRoles)) // columnas resoltas para cada rol
+
+	mux.HandleFunc("/api/history", withLogging(debug, s.handleAPIHistory)) // instantáneas para asOf=
+
+	// cambios fronte á copia anterior (--previous)
+	mux.HandleFunc("/changes", withLogging(debug, s.handleChanges))
+	mux.HandleFunc("/api/changes", withLogging(debug, s.handleAPIChanges))
+	mux.HandleFunc("/export/changes", withLogging(debug, s.handleExportChanges))
+
+	// alertas: indicadores de risco e posible fraccionamento de contratos menores
+	mux.HandleFunc("/flags", withLogging(debug, s.handleFlags))
+	mux.HandleFunc("/api/flags", withLogging(debug, s.handleAPIFlags))
+	mux.HandleFunc("/flags/splitting", withLogging(debug, s.handleSplitting))
+	mux.HandleFunc("/api/flags/splitting", withLogging(debug, s.handleAPISplitting))
+
+	// análise: lei de Benford e importes redondos
+	mux.HandleFunc("/analysis/benford", withLogging(debug, s.handleBenford))
+	mux.HandleFunc("/api/analysis/benford", withLogging(debug, s.handleAPIBenford))
+
+	// feeds Atom de contratos novos: todas as táboas, unha táboa (con q) ou un adxudicatario
+	mux.HandleFunc("/feeds/", withLogging(debug, s.handleFeed))
+
+	// busca no texto dos PDFs (índice <db>.docs.sqlite)
+	mux.HandleFunc("/search/docs", withLogging(debug, s.handleSearchDocs))
+	mux.HandleFunc("/api/search/docs", withLogging(debug, s.handleAPISearchDocs))
+	if useDocs {
+		go indexAllDocs(s.reg.list)
+	}
+
+	// prazos de presentación das licitacións abertas (iCalendar)
+	mux.HandleFunc("/calendar.ics", withLogging(debug, s.handleCalendar))
+
+	// anexos: táboas _files contra o directorio de PDFs
+	mux.HandleFunc("/admin/files", withLogging(debug, s.handleAdminFiles))
+	mux.HandleFunc("/api/admin/files", withLogging(debug, s.handleAPIAdminFiles))
+
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(assets))))
-	http.HandleFunc("/", withLogging(debug, s.handleIndex))
-	http.HandleFunc("/table/", withLogging(debug, s.handleTable))
-	http.HandleFunc("/export/csv", withLogging(debug, s.handleExportCSV))
-	http.HandleFunc("/export/xlsx", withLogging(debug, s.handleExportXLSX))
-	http.HandleFunc("/api/table/", withLogging(debug, s.handleAPITable)) // ← API JSON para Instant Search
+	http.Handle("/", s.withConcello(mux))
+
+	// comparación entre concellos (ATTACH DATABASE)
+	http.HandleFunc("/compare", withLogging(debug, s.handleCompare))
+	http.HandleFunc("/api/compare", withLogging(debug, s.handleAPICompare))
+
+	// provedores resoltos (de todos os concellos)
+	http.HandleFunc("/api/suppliers", withLogging(debug, s.handleAPISuppliers))
 
-	http.Handle("/pdfs/", http.StripPrefix("/pdfs/", http.FileServer(http.Dir(pdfPath))))
+	// buscas gardadas: avalíanse cando cambia o .db
+	http.HandleFunc("/api/searches", withLogging(debug, s.handleAPISearches))
 
-	http.HandleFunc("/summary", withLogging(debug, s.handleSummary))
-	http.HandleFunc("/api/summary", withLogging(debug, s.handleAPISummary))
+	// provedores, historial e buscas cada vez que o scrapper cambia un .db
+	go s.watchDBs(s.watchTasks())
 
-	http.HandleFunc("/summary_all", withLogging(debug, s.handleSummaryAll))
-	http.HandleFunc("/api/summary_all", withLogging(debug, s.handleAPISummaryAll))
+	// limiares legais en uso
+	http.HandleFunc("/api/thresholds", withLogging(debug, s.handleAPIThresholds))
 
 	log.Printf("Web UI en http://%s", addr)
-	log.Printf("PDFs en %s", http.Dir(pdfPath))
+	for _, c := range s.reg.list {
+		log.Printf("concello: %s en /%s/ · PDFs en %s", c.Name, c.Slug, c.PDFPath)
+	}
 
 	return http.ListenAndServe(addr, nil)
 }
@@ -110,7 +197,7 @@ func withLogging(debug bool, h http.HandlerFunc) http.HandlerFunc {
 		if debug {
 			start := time.Now()
 			log.Printf("→ %s %s %s", r.Method, r.URL.Path, r.URL.RawQuery)
-			defer log.Printf("← %s %s (%s)", r.Method, r.URL.Path, time.Since(start))
+			defer func() { log.Printf("← %s %s (%s)", r.Method, r.URL.Path, time.Since(start)) }()
 		}
 		h(w, r)
 	}
@@ -120,45 +207,148 @@ func withLogging(debug bool, h http.HandlerFunc) http.HandlerFunc {
 
 // ==== main ====
 func main() {
+	// subcomandos: van antes das flags (licitaberto index --db ...)
+	cmd := ""
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "index", "history", "docs":
+			cmd = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "diff":
+			// vai aparte: non abre ningún concello
+			if err := runDiff(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "alerts":
+			if err := runAlerts(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "check-files":
+			if err := runCheckFiles(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	// o dbPath tamen indica onde estaran os ficheiros PDF, entendendo que ao utilizar o scrapper
 	//  https://github.com/alexandregz/plataforma_contratacion_estado_scrapper van ter esa estructura:
 	// 	PDF/CONCELHO/TABOA/EXPEDIENTE/
-	dbPath := flag.String("db", "", "ruta ao ficheiro SQLite")
+	// --db acepta un ficheiro, unha lista separada por comas ou un directorio; os argumentos
+	// posicionais tamén se toman como ficheiros SQLite. Cada ficheiro é un concello.
+	dbPath := flag.String("db", "", "ruta ao ficheiro SQLite, lista separada por comas ou directorio")
 	mode := flag.String("mode", "web", "web|tui")
 	addr := flag.String("addr", "127.0.0.1:8080", "enderezo para o modo web")
 
 	debug := flag.Bool("debug", false, "enable debug logging")
+	cache := flag.Bool("cache", true, "construír e usar a caché tipada (<db>.cache.sqlite)")
+	roles := flag.String("roles", "", "ficheiro JSON cos roles de columna por táboa (ver roles.go)")
+	suppliers := flag.String("suppliers", "", "ficheiro JSON con correccións da agrupación de provedores (ver suppliers.go)")
+	history := flag.Bool("history", false, "gardar o historial de cada .db (<db>.history.sqlite) para asOf=")
+	searches := flag.String("searches", "", "ficheiro JSON con buscas gardadas e notificadores (ver searches.go)")
+	previous := flag.String("previous", "", "copia anterior dos .db (ficheiro, lista ou directorio) para /changes")
+	limiares := flag.String("thresholds", "", "ficheiro JSON cos limiares legais (ver thresholds.go)")
+	zipMax := flag.Int64("zip-max", 1024, "tamaño máximo en MB dos PDFs de /export/zip (0 = sen límite)")
+	docs := flag.Bool("docs", false, "indexar en segundo plano o texto dos PDFs (<db>.docs.sqlite) para /search/docs")
 
 	flag.Parse()
 
-	if *dbPath == "" {
+	dbArgs := flag.Args()
+	if *dbPath != "" {
+		dbArgs = append([]string{*dbPath}, dbArgs...)
+	}
+	if len(dbArgs) == 0 {
 		log.Fatal("Debe especificar a ruta ao ficheiro SQLite con --db")
 	}
 
-	db, err := openSQLite(*dbPath)
+	paths, err := expandDBPaths(dbArgs)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
-
-	// rexistro de funcións, polo de agora só "unaccent_lower"
-	if err := registerSQLiteFuncs(db); err != nil {
-		log.Printf("WARN: non se puideron rexistrar funcs SQLite: %v", err)
+	if *roles != "" {
+		if err := loadRoles(*roles); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *suppliers != "" {
+		if err := loadSupplierOverrides(*suppliers); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *searches != "" {
+		if savedSearches, err = loadSearches(*searches); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *previous != "" {
+		if err := loadPrevious(*previous); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *limiares != "" {
+		if err := loadThresholds(*limiares); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cmd == "history" {
+		for _, p := range paths {
+			if isPostgresDSN(p) {
+				log.Printf("WARN: o historial só é para SQLite, sáltase %s", p)
+				continue
+			}
+			if err := recordHistory(p); err != nil {
+				log.Fatalf("%s: %v", p, err)
+			}
+		}
+		return
+	}
+	if cmd == "docs" {
+		for _, p := range paths {
+			if isPostgresDSN(p) {
+				log.Printf("WARN: o índice de documentos só é para SQLite, sáltase %s", p)
+				continue
+			}
+			if err := indexDocs(p, pdfPathFor(p)); err != nil {
+				log.Fatalf("%s: %v", p, err)
+			}
+		}
+		return
+	}
+	if cmd == "index" {
+		for _, p := range paths {
+			if isPostgresDSN(p) {
+				log.Printf("WARN: a caché tipada só é para SQLite, sáltase %s", p)
+				continue
+			}
+			if err := buildCache(p); err != nil {
+				log.Fatalf("%s: %v", p, err)
+			}
+		}
+		return
 	}
 
-	// path fisico a PDFs. Hai que reemprazar "TABOA/EXPEDIENTE/" polo que toque "on the fly"
-	pdfPath = filepath.Dir(*dbPath) + "/PDF" + stripExt(strings.TrimPrefix(*dbPath, filepath.Dir(*dbPath)))
-	concello = strings.Replace(stripExt(strings.TrimPrefix(*dbPath, filepath.Dir(*dbPath))), "/", "", 1)
-
-	caser := cases.Title(language.EuropeanSpanish) // nh...
-	concello = caser.String(concello)
+	useCache = *cache
+	if useCache && ftsModule() != "fts5" {
+		log.Printf("WARN: binario sen FTS5, a busca de texto usa %q (compila con -tags sqlite_fts5)", ftsModule())
+	}
+	useHistory = *history
+	useDocs = *docs
+	zipMaxBytes = *zipMax << 20
+	reg, err := openRegistry(paths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reg.Close()
 
-	log.Printf("concello: %s", concello)
-	// log.Printf("pdfPath: %s", pdfPath)
+	for _, c := range reg.list {
+		log.Printf("concello: %s", c.Name)
+	}
 
 	switch *mode {
 	case "web":
-		srv, err := newServer(db)
+		srv, err := newServer(reg)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -166,7 +356,8 @@ func main() {
 			log.Fatal(err)
 		}
 	case "tui":
-		p := tea.NewProgram(initialTUI(db))
+		// a TUI traballa sobre o primeiro concello
+		p := tea.NewProgram(initialTUI(reg.first().DB))
 		if _, err := p.Run(); err != nil {
 			log.Fatal(err)
 		}
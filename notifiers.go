@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ==== Notificadores ====
+// Cada tipo de notificador cumpre a interface notifier e rexístrase en notifierTypes co seu
+// construtor. Todos levan o enderezo do servidor na configuración (addr ou url), así que se
+// poden probar contra un servidor local (licitaberto alerts --test <nome>).
+
+type notifier interface {
+	Notify(ctx context.Context, m alertMessage) error
+}
+
+// notifierConfig: un notificador do ficheiro de buscas; cada tipo usa os campos que precisa
+type notifierConfig struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"` // smtp, webhook, telegram, matrix
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"` // webhook
+	Token   string            `json:"token,omitempty"`   // telegram, matrix
+	Chat    string            `json:"chat,omitempty"`    // telegram
+	Room    string            `json:"room,omitempty"`    // matrix
+	Addr    string            `json:"addr,omitempty"`    // smtp: host:porto
+	User    string            `json:"user,omitempty"`
+	Pass    string            `json:"pass,omitempty"`
+	From    string            `json:"from,omitempty"`
+	To      []string          `json:"to,omitempty"`
+}
+
+var notifierTypes = map[string]func(notifierConfig) (notifier, error){
+	"smtp":     newSMTPNotifier,
+	"webhook":  newWebhookNotifier,
+	"telegram": newTelegramNotifier,
+	"matrix":   newMatrixNotifier,
+}
+
+func newNotifier(nc notifierConfig) (notifier, error) {
+	mk := notifierTypes[nc.Type]
+	if mk == nil {
+		return nil, fmt.Errorf("notificador %q: tipo descoñecido %q (smtp, webhook, telegram, matrix)", nc.Name, nc.Type)
+	}
+	n, err := mk(nc)
+	if err != nil {
+		return nil, fmt.Errorf("notificador %q: %w", nc.Name, err)
+	}
+	return n, nil
+}
+
+var notifyClient = &http.Client{Timeout: 15 * time.Second}
+
+// postJSON envía v como JSON e falla se a resposta non é 2xx
+func postJSON(ctx context.Context, method, u string, headers map[string]string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s %s: %s %s", method, u, res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// --- webhook: o alertMessage tal cal en JSON ---
+
+type webhookNotifier struct{ cfg notifierConfig }
+
+func newWebhookNotifier(nc notifierConfig) (notifier, error) {
+	if nc.URL == "" {
+		return nil, fmt.Errorf("falta url")
+	}
+	return webhookNotifier{nc}, nil
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, m alertMessage) error {
+	return postJSON(ctx, http.MethodPost, n.cfg.URL, n.cfg.Headers, m)
+}
+
+// --- telegram: sendMessage da Bot API (url por defecto https://api.telegram.org) ---
+
+type telegramNotifier struct{ cfg notifierConfig }
+
+func newTelegramNotifier(nc notifierConfig) (notifier, error) {
+	if nc.Token == "" || nc.Chat == "" {
+		return nil, fmt.Errorf("fan falta token e chat")
+	}
+	if nc.URL == "" {
+		nc.URL = "https://api.telegram.org"
+	}
+	return telegramNotifier{nc}, nil
+}
+
+func (n telegramNotifier) Notify(ctx context.Context, m alertMessage) error {
+	u := strings.TrimRight(n.cfg.URL, "/") + "/bot" + n.cfg.Token + "/sendMessage"
+	return postJSON(ctx, http.MethodPost, u, nil, map[string]any{
+		"chat_id":                  n.cfg.Chat,
+		"text":                     m.Text(),
+		"disable_web_page_preview": true,
+	})
+}
+
+// --- matrix: m.room.message na Client-Server API ---
+
+type matrixNotifier struct{ cfg notifierConfig }
+
+func newMatrixNotifier(nc notifierConfig) (notifier, error) {
+	if nc.URL == "" || nc.Token == "" || nc.Room == "" {
+		return nil, fmt.Errorf("fan falta url, token e room")
+	}
+	return matrixNotifier{nc}, nil
+}
+
+func (n matrixNotifier) Notify(ctx context.Context, m alertMessage) error {
+	// o id de transacción evita duplicados se se reintenta a mesma petición
+	txn := fmt.Sprintf("lb%d", time.Now().UnixNano())
+	u := strings.TrimRight(n.cfg.URL, "/") + "/_matrix/client/v3/rooms/" + url.PathEscape(n.cfg.Room) + "/send/m.room.message/" + txn
+	return postJSON(ctx, http.MethodPut, u, map[string]string{"Authorization": "Bearer " + n.cfg.Token}, map[string]any{
+		"msgtype": "m.text",
+		"body":    m.Text(),
+	})
+}
+
+// --- smtp: correo en texto plano ---
+
+type smtpNotifier struct{ cfg notifierConfig }
+
+func newSMTPNotifier(nc notifierConfig) (notifier, error) {
+	if nc.Addr == "" || nc.From == "" || len(nc.To) == 0 {
+		return nil, fmt.Errorf("fan falta addr, from e to")
+	}
+	return smtpNotifier{nc}, nil
+}
+
+func (n smtpNotifier) Notify(ctx context.Context, m alertMessage) error {
+	var auth smtp.Auth
+	if n.cfg.User != "" {
+		host, _, _ := strings.Cut(n.cfg.Addr, ":")
+		auth = smtp.PlainAuth("", n.cfg.User, n.cfg.Pass, host)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.cfg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject()))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Text(), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	// net/smtp non acepta contexto: o prazo vai no propio envío
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(n.cfg.Addr, auth, n.cfg.From, n.cfg.To, []byte(b.String())) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
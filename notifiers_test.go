@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testAlert() alertMessage {
+	return alertMessage{
+		Search:   savedSearch{ID: "obras", Table: "Alcaldia_contratos_menores", Q: "tipo:Obras"},
+		Concello: "ames",
+		Table:    "Alcaldia_contratos_menores",
+		URL:      "https://licitaberto.example.org/ames/table/Alcaldia_contratos_menores?q=tipo%3AObras",
+		Rows:     []map[string]string{{"Expediente": "2024/001", "Importe": "14.500,00"}},
+		Lines:    []string{"2024/001 · Reparación de beirarrúas · 14.500,00 €"},
+	}
+}
+
+// request: o que recibiu o servidor de proba
+type request struct {
+	method, path string
+	header       http.Header
+	body         []byte
+}
+
+// stubServer apunta as peticións e responde co status dado
+func stubServer(t *testing.T, status int) (*httptest.Server, *[]request) {
+	t.Helper()
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = append(got, request{r.Method, r.URL.Path, r.Header.Clone(), b})
+		w.WriteHeader(status)
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &got
+}
+
+func notifyOnce(t *testing.T, nc notifierConfig) error {
+	t.Helper()
+	n, err := newNotifier(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.Notify(context.Background(), testAlert())
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	srv, got := stubServer(t, http.StatusOK)
+	err := notifyOnce(t, notifierConfig{Name: "hook", Type: "webhook", URL: srv.URL + "/hook", Headers: map[string]string{"X-Token": "segredo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*got) != 1 {
+		t.Fatalf("%d peticións, want 1", len(*got))
+	}
+	r := (*got)[0]
+	if r.method != http.MethodPost || r.path != "/hook" || r.header.Get("X-Token") != "segredo" || r.header.Get("Content-Type") != "application/json" {
+		t.Errorf("petición %s %s %v", r.method, r.path, r.header)
+	}
+	var m alertMessage
+	if err := json.Unmarshal(r.body, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Search.ID != "obras" || m.Concello != "ames" || len(m.Rows) != 1 || m.Rows[0]["Expediente"] != "2024/001" {
+		t.Errorf("corpo = %s", r.body)
+	}
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	srv, got := stubServer(t, http.StatusOK)
+	if err := notifyOnce(t, notifierConfig{Name: "tg", Type: "telegram", URL: srv.URL + "/", Token: "123:abc", Chat: "-100"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*got) != 1 {
+		t.Fatalf("%d peticións, want 1", len(*got))
+	}
+	r := (*got)[0]
+	if r.method != http.MethodPost || r.path != "/bot123:abc/sendMessage" {
+		t.Errorf("petición %s %s", r.method, r.path)
+	}
+	var body struct {
+		ChatID string `json:"chat_id"`
+		Text   string `json:"text"`
+	}
+	if err := json.Unmarshal(r.body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ChatID != "-100" || body.Text != testAlert().Text() {
+		t.Errorf("corpo = %s", r.body)
+	}
+}
+
+func TestMatrixNotifier(t *testing.T) {
+	srv, got := stubServer(t, http.StatusOK)
+	nc := notifierConfig{Name: "mx", Type: "matrix", URL: srv.URL, Token: "syt_x", Room: "!sala:example.org"}
+	// dúas veces: cada envío leva o seu id de transacción
+	for i := 0; i < 2; i++ {
+		if err := notifyOnce(t, nc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*got) != 2 {
+		t.Fatalf("%d peticións, want 2", len(*got))
+	}
+	prefix := "/_matrix/client/v3/rooms/!sala:example.org/send/m.room.message/"
+	for _, r := range *got {
+		if r.method != http.MethodPut || !strings.HasPrefix(r.path, prefix) || r.header.Get("Authorization") != "Bearer syt_x" {
+			t.Errorf("petición %s %s %v", r.method, r.path, r.header)
+		}
+		var body map[string]string
+		if err := json.Unmarshal(r.body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body["msgtype"] != "m.text" || body["body"] != testAlert().Text() {
+			t.Errorf("corpo = %s", r.body)
+		}
+	}
+	if (*got)[0].path == (*got)[1].path {
+		t.Errorf("o mesmo id de transacción: %s", (*got)[0].path)
+	}
+}
+
+func TestNotifierHTTPError(t *testing.T) {
+	srv, _ := stubServer(t, http.StatusBadGateway)
+	for _, nc := range []notifierConfig{
+		{Name: "hook", Type: "webhook", URL: srv.URL},
+		{Name: "tg", Type: "telegram", URL: srv.URL, Token: "t", Chat: "c"},
+		{Name: "mx", Type: "matrix", URL: srv.URL, Token: "t", Room: "!r:x"},
+	} {
+		if err := notifyOnce(t, nc); err == nil || !strings.Contains(err.Error(), "502") {
+			t.Errorf("%s: err = %v, want 502", nc.Type, err)
+		}
+	}
+}
+
+func TestNewNotifierErrors(t *testing.T) {
+	tests := []struct {
+		nc  notifierConfig
+		err string
+	}{
+		{notifierConfig{Name: "x", Type: "fax"}, "tipo descoñecido"},
+		{notifierConfig{Name: "x", Type: "webhook"}, "falta url"},
+		{notifierConfig{Name: "x", Type: "telegram", Token: "t"}, "token e chat"},
+		{notifierConfig{Name: "x", Type: "matrix", URL: "http://localhost", Token: "t"}, "url, token e room"},
+		{notifierConfig{Name: "x", Type: "smtp", Addr: "localhost:25", From: "a@example.org"}, "addr, from e to"},
+	}
+	for _, tt := range tests {
+		_, err := newNotifier(tt.nc)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.nc.Type, err, tt.err)
+		}
+	}
+}
+
+// smtpStub: un servidor SMTP mínimo que acepta unha mensaxe e devolve o que recibiu
+func smtpStub(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		var b strings.Builder
+		reply("220 proba ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			b.WriteString(strings.TrimSpace(line) + "\n")
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 proba")
+			case cmd == "DATA":
+				reply("354 adiante")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					b.WriteString(l)
+				}
+				reply("250 ok")
+			case cmd == "QUIT":
+				reply("221 adeus")
+				out <- b.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), out
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, out := smtpStub(t)
+	err := notifyOnce(t, notifierConfig{Name: "correo", Type: "smtp", Addr: addr, From: "alertas@example.org", To: []string{"a@example.org", "b@example.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := <-out
+	for _, want := range []string{
+		"MAIL FROM:<alertas@example.org>",
+		"RCPT TO:<a@example.org>",
+		"RCPT TO:<b@example.org>",
+		"To: a@example.org, b@example.org\r\n",
+		"Subject: =?utf-8?q?",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"- 2024/001 · Reparación de beirarrúas · 14.500,00 €\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("falta %q en\n%s", want, got)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ==== Linguaxe de consulta do parámetro q ====
+// Exemplo: tipo:Obras importe>=15000 adx:"Construcciones" data:2024-01..2024-06 -anulado
+//
+//	campo:valor      contén (sen acentos nin maiúsculas); campo=valor, igual
+//	campo>=n, <, ... comparacións en importe e data
+//	campo:a..b       rango (un extremo pode faltar: data:2024-01..)
+//	-termo           nega o termo
+//	"dúas palabras"  frase; as palabras soltas van á busca de texto (FTS/LIKE)
+
+type qTerm struct {
+	Neg    bool
+	Field  string // "" = texto libre
+	Op     string // ":", "=", ">", ">=", "<", "<=", ".."
+	Value  string
+	To     string // fin do rango (Op "..")
+	Phrase bool   // texto libre entre comiñas: busca a frase enteira
+	Raw    string // o termo tal cal (sen o -), por se o campo non existe
+}
+
+// tipos de campo
+const (
+	qText = iota
+	qNum
+	qDate
+)
+
+type queryField struct {
+	kind  int
+	role  string   // rol de columna (roles.go)
+	cands []string // columnas fixas, para os campos sen rol
+}
+
+// alias de campo -> rol de columna (o mesmo que usan os resumos)
+var queryFields = map[string]queryField{
+	"tipo":          {kind: qText, role: roleTipo},
+	"importe":       {kind: qNum, role: roleImporte},
+	"imp":           {kind: qNum, role: roleImporte},
+	"adx":           {kind: qText, role: roleAdx},
+	"adxudicatario": {kind: qText, role: roleAdx},
+	"adjudicatario": {kind: qText, role: roleAdx},
+	"empresa":       {kind: qText, role: roleAdx},
+	"obxecto":       {kind: qText, role: roleObxecto},
+	"objeto":        {kind: qText, role: roleObxecto},
+	"obj":           {kind: qText, role: roleObxecto},
+	"exp":           {kind: qText, role: roleExpediente},
+	"expediente":    {kind: qText, role: roleExpediente},
+	"estado":        {kind: qText, cands: []string{"Estado"}},
+	"data":          {kind: qDate, role: roleData},
+	"fecha":         {kind: qDate, role: roleData},
+	"date":          {kind: qDate, role: roleData},
+}
+
+// parseQuery separa q en termos; erro se a sintaxe non é válida
+func parseQuery(q string) ([]qTerm, error) {
+	var out []qTerm
+	rs := []rune(q)
+	i := 0
+	isIdent := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' }
+
+	// valor: "entre comiñas" ou ata o seguinte espazo
+	quoted := false
+	readValue := func() (string, error) {
+		quoted = i < len(rs) && rs[i] == '"'
+		if quoted {
+			end := i + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if end >= len(rs) {
+				return "", fmt.Errorf("comiña sen pechar")
+			}
+			v := string(rs[i+1 : end])
+			i = end + 1
+			return v, nil
+		}
+		start := i
+		for i < len(rs) && !unicode.IsSpace(rs[i]) {
+			i++
+		}
+		return string(rs[start:i]), nil
+	}
+
+	for i < len(rs) {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+		var t qTerm
+		if rs[i] == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			t.Neg = true
+			i++
+		}
+
+		// campo: identificador que empeza por letra seguido dun operador
+		start := i
+		raw := func() string { return string(rs[start:i]) }
+		j := i
+		for j < len(rs) && isIdent(rs[j]) {
+			j++
+		}
+		if j > start && unicode.IsLetter(rs[start]) && j < len(rs) && strings.ContainsRune(":=<>", rs[j]) {
+			t.Field = strings.ToLower(string(rs[start:j]))
+			i = j
+			switch {
+			case rs[i] == ':' || rs[i] == '=':
+				t.Op = string(rs[i])
+				i++
+			case i+1 < len(rs) && rs[i+1] == '=':
+				t.Op = string(rs[i : i+2])
+				i += 2
+			default:
+				t.Op = string(rs[i])
+				i++
+			}
+			v, err := readValue()
+			if err != nil {
+				return nil, err
+			}
+			if t.Op == ":" {
+				if a, b, ok := strings.Cut(v, ".."); ok {
+					t.Op, v, t.To = "..", a, b
+				}
+			}
+			if v == "" && t.To == "" {
+				return nil, fmt.Errorf("falta o valor de %q", t.Field)
+			}
+			t.Value, t.Raw = v, raw()
+			out = append(out, t)
+			continue
+		}
+
+		v, err := readValue()
+		if err != nil {
+			return nil, err
+		}
+		if v != "" {
+			t.Value, t.Phrase, t.Raw = v, quoted, raw()
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// buildFilter traduce q a unha WHERE parametrizada para a táboa. As palabras soltas
+// van a buildSearch (FTS ou LIKE); os campos resólvense cos candidatos de queryFields.
+func buildFilter(db *sql.DB, table string, cols []Column, q string) (tableFilter, error) {
+	terms, err := parseQuery(strings.TrimSpace(q))
+	if err != nil {
+		return tableFilter{}, err
+	}
+
+	// un campo que non é alias nin columna ("Lote:1", "ref:A-3" dun obxecto) é texto
+	for i, t := range terms {
+		if t.Field != "" && !isQueryField(cols, t.Field) {
+			terms[i] = qTerm{Neg: t.Neg, Value: t.Raw, Raw: t.Raw}
+		}
+	}
+
+	var conds []string
+	var args []any
+	var out tableFilter
+
+	var free []string
+	for _, t := range terms {
+		if t.Field == "" && !t.Neg {
+			free = append(free, t.searchText())
+		}
+	}
+	if len(free) > 0 {
+		s := buildSearch(db, table, cols, strings.Join(free, " "))
+		if s.Where != "" {
+			conds = append(conds, strings.TrimPrefix(s.Where, "WHERE "))
+			args = append(args, s.Args...)
+			out.rankFrom, out.rankArgs = s.rankFrom, s.rankArgs
+		}
+	}
+
+	for _, t := range terms {
+		if t.Field == "" && !t.Neg {
+			continue
+		}
+		var cond string
+		var cargs []any
+		if t.Field == "" {
+			s := buildSearch(db, table, cols, t.searchText())
+			cond, cargs = strings.TrimPrefix(s.Where, "WHERE "), s.Args
+		} else {
+			cond, cargs, err = fieldCond(db, table, cols, t)
+			if err != nil {
+				return tableFilter{}, err
+			}
+		}
+		if cond == "" {
+			continue
+		}
+		if t.Neg {
+			// NOT (NULL LIKE ?) é NULL: unha columna NULL conta como que non cumpre
+			cond = "NOT COALESCE((" + cond + "), FALSE)"
+		}
+		conds = append(conds, cond)
+		args = append(args, cargs...)
+	}
+
+	if len(conds) > 0 {
+		out.Where = "WHERE " + strings.Join(conds, " AND ")
+		out.Args = args
+	}
+	return out, nil
+}
+
+// isQueryField: alias de queryFields ou nome dunha columna da táboa
+func isQueryField(cols []Column, field string) bool {
+	if _, ok := queryFields[field]; ok {
+		return true
+	}
+	return pickFirstColumnName(cols, field) != ""
+}
+
+// searchText: o termo de texto libre para buildSearch, coas comiñas se é unha frase
+func (t qTerm) searchText() string {
+	if t.Phrase {
+		return `"` + t.Value + `"`
+	}
+	return t.Value
+}
+
+func fieldCond(db *sql.DB, table string, cols []Column, t qTerm) (string, []any, error) {
+	f, known := queryFields[t.Field]
+	if !known {
+		// nome de columna tal cal
+		f = queryField{kind: qText, cands: []string{t.Field}}
+	}
+	col := pickFirstColumnName(cols, f.cands...)
+	if f.role != "" {
+		col = roleColumn(table, cols, f.role)
+	}
+	if col == "" {
+		if !known {
+			return "", nil, fmt.Errorf("campo descoñecido: %q", t.Field)
+		}
+		return "", nil, fmt.Errorf("a táboa %s non ten columna para %q", table, t.Field)
+	}
+
+	switch f.kind {
+	case qNum:
+		return numCond(db, table, col, t)
+	case qDate:
+		return dateCond(db, table, col, t)
+	}
+
+	if t.Op == ".." {
+		// nos campos de texto ".." non é un rango
+		t.Op, t.Value = ":", t.Value+".."+t.To
+	}
+	folded := asciiFold(strings.TrimSpace(t.Value))
+	switch t.Op {
+	case ":":
+		return dbDialect.Fold(fmt.Sprintf("CAST(%s AS TEXT)", quoteIdent(col))) + " LIKE ?", []any{"%" + folded + "%"}, nil
+	case "=":
+		return adxKeyExpr(col) + " = ?", []any{folded}, nil
+	}
+	return "", nil, fmt.Errorf("o operador %s non vale para %q", t.Op, t.Field)
+}
+
+// typedRowCond filtra polas columnas tipadas da caché: rowid IN (SELECT src_rowid ...)
+func typedRowCond(table, cond string) string {
+	return fmt.Sprintf("%s.rowid IN (SELECT src_rowid FROM %s.%s WHERE %s)",
+		quoteIdent(table), cacheSchema, quoteIdent(typedTableName(table)), cond)
+}
+
+func numCond(db *sql.DB, table, col string, t qTerm) (string, []any, error) {
+	num := func(s string) (float64, error) {
+		// "15.000" e "1.234,56" en formato europeo; "15000" ou "15000,5" tal cal
+		if euroNumRe.MatchString(s) {
+			if f, ok := parseEuroNumber(s); ok {
+				return f, nil
+			}
+		}
+		f, err := strconv.ParseFloat(strings.Replace(strings.TrimSuffix(s, "€"), ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("importe non válido: %q", s)
+		}
+		return f, nil
+	}
+
+	var cond string
+	var args []any
+	switch t.Op {
+	case "..":
+		var parts []string
+		if t.Value != "" {
+			a, err := num(t.Value)
+			if err != nil {
+				return "", nil, err
+			}
+			parts = append(parts, "%[1]s >= ?")
+			args = append(args, a)
+		}
+		if t.To != "" {
+			b, err := num(t.To)
+			if err != nil {
+				return "", nil, err
+			}
+			parts = append(parts, "%[1]s <= ?")
+			args = append(args, b)
+		}
+		cond = strings.Join(parts, " AND ")
+	case ":", "=", ">", ">=", "<", "<=":
+		v, err := num(t.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		op := t.Op
+		if op == ":" {
+			op = "="
+		}
+		cond = "%[1]s " + op + " ?"
+		args = append(args, v)
+	default:
+		return "", nil, fmt.Errorf("o operador %s non vale para %q", t.Op, t.Field)
+	}
+
+	if m, ok := cacheMeta(db, table); ok && strings.EqualFold(m.ImporteCol, col) {
+		return typedRowCond(table, fmt.Sprintf(cond, "lb_importe")), args, nil
+	}
+	return fmt.Sprintf(cond, sqlToRealEuro(quoteIdent(col))), args, nil
+}
+
+var (
+	qDateISORe = regexp.MustCompile(`^(\d{4})(?:-(\d{1,2})(?:-(\d{1,2}))?)?$`)
+	qDateDMYRe = regexp.MustCompile(`^(?:(\d{1,2})/)?(\d{1,2})/(\d{4})$`)
+)
+
+// dateBounds devolve o primeiro e o último día ISO que cobre unha data parcial
+// ("2024" -> 2024-01-01..2024-12-31, "2024-03" -> 2024-03-01..2024-03-31)
+func dateBounds(s string) (lo, hi string, err error) {
+	var y, m, d string
+	if g := qDateISORe.FindStringSubmatch(s); g != nil {
+		y, m, d = g[1], g[2], g[3]
+	} else if g := qDateDMYRe.FindStringSubmatch(s); g != nil {
+		y, m, d = g[3], g[2], g[1]
+	} else {
+		return "", "", fmt.Errorf("data non válida: %q (usa AAAA, AAAA-MM, AAAA-MM-DD ou DD/MM/AAAA)", s)
+	}
+	switch {
+	case m == "":
+		return y + "-01-01", y + "-12-31", nil
+	case d == "":
+		if isoDate("1", m, y) == "" {
+			return "", "", fmt.Errorf("data non válida: %q", s)
+		}
+		if len(m) == 1 {
+			m = "0" + m
+		}
+		return y + "-" + m + "-01", y + "-" + m + "-31", nil
+	}
+	iso := isoDate(d, m, y)
+	if iso == "" {
+		return "", "", fmt.Errorf("data non válida: %q", s)
+	}
+	return iso, iso, nil
+}
+
+func dateCond(db *sql.DB, table, col string, t qTerm) (string, []any, error) {
+	cond, args, err := dateTermSQL(t)
+	if err != nil {
+		return "", nil, err
+	}
+	if m, ok := cacheMeta(db, table); ok && strings.EqualFold(m.DateCol, col) {
+		return typedRowCond(table, fmt.Sprintf(cond, "lb_data_pub")), args, nil
+	}
+	return fmt.Sprintf(cond, isoDateExpr(col)), args, nil
+}
+
+// dateTermSQL: condición dun termo de data, con %[1]s no lugar da expresión ISO
+func dateTermSQL(t qTerm) (string, []any, error) {
+	var parts []string
+	var args []any
+	add := func(op, v string) {
+		parts = append(parts, "%[1]s "+op+" ?")
+		args = append(args, v)
+	}
+
+	switch t.Op {
+	case "..":
+		if t.Value != "" {
+			lo, _, err := dateBounds(t.Value)
+			if err != nil {
+				return "", nil, err
+			}
+			add(">=", lo)
+		}
+		if t.To != "" {
+			_, hi, err := dateBounds(t.To)
+			if err != nil {
+				return "", nil, err
+			}
+			add("<=", hi)
+		}
+	default:
+		lo, hi, err := dateBounds(t.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		switch t.Op {
+		case ":", "=":
+			add(">=", lo)
+			add("<=", hi)
+		case ">":
+			add(">", hi)
+		case ">=":
+			add(">=", lo)
+		case "<":
+			add("<", lo)
+		case "<=":
+			add("<=", hi)
+		}
+	}
+	return strings.Join(parts, " AND "), args, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// openTestDB crea un SQLite temporal cos contratos menores de proba e ábreo coma o servidor,
+// coa caché tipada (FTS) ou sen ela (LIKE)
+func openTestDB(t *testing.T, withCache bool) *sql.DB {
+	t.Helper()
+	path := writeTestDB(t)
+	if withCache {
+		if err := buildCache(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// writeTestDB escribe o SQLite de proba nun directorio temporal e devolve a ruta
+func writeTestDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proba.db")
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec(`
+		CREATE TABLE Alcaldia_contratos_menores (Expediente TEXT, Objeto_del_contrato TEXT, Tipo TEXT, Importe TEXT, Adxudicatario TEXT, Estado TEXT);
+		INSERT INTO Alcaldia_contratos_menores VALUES
+			('2024/001', 'Reparación de beirarrúas', 'Obras', '14.500,00', 'CONSTRUCCIONES X, S.L.', 'Resuelta 12/05/2024'),
+			('2024/002', 'Lote:1 material de oficina ás 10:30', 'Subministro', '300,00', 'PAPELERIA Y SL', 'Resuelta 03/02/2023'),
+			('2024/003', 'Obras menores na escola', 'Obras', '1.000,00', 'CONSTRUCCIONES X SL', 'Publicación: 15/01/2024'),
+			('2024/004', 'Menores obras no parque', 'Servizos', '15.000,00', NULL, NULL);
+		CREATE TABLE Alcaldia_contratos_menores_files (Expediente TEXT, filename TEXT);
+	`)
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// expedientes devolve os expedientes das filas que cumpren q, ordenados
+func expedientes(t *testing.T, db *sql.DB, table, q string) ([]string, error) {
+	t.Helper()
+	cols, err := tableColumns(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := buildFilter(db, table, cols, q)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := fetchPage(db, table, cols, f, "", false, 1, 100)
+	if err != nil {
+		t.Fatalf("%q: %v", q, err)
+	}
+	out := []string{}
+	for _, r := range rows {
+		out = append(out, fmt.Sprint(r["Expediente"]))
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []qTerm
+	}{
+		{"", nil},
+		{"beirarrúas", []qTerm{{Value: "beirarrúas", Raw: "beirarrúas"}}},
+		{"tipo:Obras", []qTerm{{Field: "tipo", Op: ":", Value: "Obras", Raw: "tipo:Obras"}}},
+		{"Tipo=Obras", []qTerm{{Field: "tipo", Op: "=", Value: "Obras", Raw: "Tipo=Obras"}}},
+		{"importe>=15000", []qTerm{{Field: "importe", Op: ">=", Value: "15000", Raw: "importe>=15000"}}},
+		{"importe<=1.000,50", []qTerm{{Field: "importe", Op: "<=", Value: "1.000,50", Raw: "importe<=1.000,50"}}},
+		{"importe>5 importe<9", []qTerm{
+			{Field: "importe", Op: ">", Value: "5", Raw: "importe>5"},
+			{Field: "importe", Op: "<", Value: "9", Raw: "importe<9"},
+		}},
+		{"data:2024-01..2024-06", []qTerm{{Field: "data", Op: "..", Value: "2024-01", To: "2024-06", Raw: "data:2024-01..2024-06"}}},
+		{"data:2024..", []qTerm{{Field: "data", Op: "..", Value: "2024", Raw: "data:2024.."}}},
+		{"data:..2024", []qTerm{{Field: "data", Op: "..", To: "2024", Raw: "data:..2024"}}},
+		{`adx:"Construcciones X"`, []qTerm{{Field: "adx", Op: ":", Value: "Construcciones X", Raw: `adx:"Construcciones X"`}}},
+		{"-anulado", []qTerm{{Neg: true, Value: "anulado", Raw: "anulado"}}},
+		{"-tipo:Obras", []qTerm{{Neg: true, Field: "tipo", Op: ":", Value: "Obras", Raw: "tipo:Obras"}}},
+		{`"obras menores"`, []qTerm{{Value: "obras menores", Phrase: true, Raw: `"obras menores"`}}},
+		{"- solto", []qTerm{{Value: "-", Raw: "-"}, {Value: "solto", Raw: "solto"}}},
+		{"10:30", []qTerm{{Value: "10:30", Raw: "10:30"}}},
+		{"2024/001", []qTerm{{Value: "2024/001", Raw: "2024/001"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseQuery(tt.q)
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", tt.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseQuery(%q) =\n\t%+v\nwant\n\t%+v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		q, err string
+	}{
+		{`adx:"sen pechar`, "comiña sen pechar"},
+		{`"sen pechar`, "comiña sen pechar"},
+		{"tipo:", "falta o valor"},
+		{"importe>= obras", "falta o valor"},
+	}
+	for _, tt := range tests {
+		_, err := parseQuery(tt.q)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseQuery(%q): err = %v, want %q", tt.q, err, tt.err)
+		}
+	}
+}
+
+func TestDateBounds(t *testing.T) {
+	tests := []struct {
+		in, lo, hi string
+		err        bool
+	}{
+		{in: "2024", lo: "2024-01-01", hi: "2024-12-31"},
+		{in: "2024-03", lo: "2024-03-01", hi: "2024-03-31"},
+		{in: "2024-3", lo: "2024-03-01", hi: "2024-03-31"},
+		{in: "2024-03-09", lo: "2024-03-09", hi: "2024-03-09"},
+		{in: "9/3/2024", lo: "2024-03-09", hi: "2024-03-09"},
+		{in: "03/2024", lo: "2024-03-01", hi: "2024-03-31"},
+		{in: "2024-13", err: true},
+		{in: "2024-02-30", err: true},
+		{in: "marzo", err: true},
+	}
+	for _, tt := range tests {
+		lo, hi, err := dateBounds(tt.in)
+		if (err != nil) != tt.err || lo != tt.lo || hi != tt.hi {
+			t.Errorf("dateBounds(%q) = %q, %q, %v; want %q, %q, err %v", tt.in, lo, hi, err, tt.lo, tt.hi, tt.err)
+		}
+	}
+}
+
+func TestBuildFilter(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"", []string{"2024/001", "2024/002", "2024/003", "2024/004"}},
+		{"beirarruas", []string{"2024/001"}},
+		{"tipo:obras", []string{"2024/001", "2024/003"}},
+		{"-tipo:obras", []string{"2024/002", "2024/004"}},
+		{"importe>=1000", []string{"2024/001", "2024/003", "2024/004"}},
+		{"importe>1000", []string{"2024/001", "2024/004"}},
+		{"importe:500..2000", []string{"2024/003"}},
+		{"importe:..1000", []string{"2024/002", "2024/003"}},
+		{"importe=15000", []string{"2024/004"}},
+		{"data:2024", []string{"2024/001", "2024/003"}},
+		{"data:..2023-12", []string{"2024/002"}},
+		{"data:2024-05", []string{"2024/001"}},
+		{"adx:construcciones", []string{"2024/001", "2024/003"}},
+		{"exp=2024/002", []string{"2024/002"}},
+		{"estado:resuelta", []string{"2024/001", "2024/002"}},
+		{"Tipo:servizos", []string{"2024/004"}},
+		{"obras menores", []string{"2024/003", "2024/004"}},
+		{`"obras menores"`, []string{"2024/003"}},
+		{"-obras", []string{"2024/002"}},
+		// un campo que non existe é texto
+		{"lote:1", []string{"2024/002"}},
+		{"10:30", []string{"2024/002"}},
+		{"-lote:1", []string{"2024/001", "2024/003", "2024/004"}},
+		// a negación colle as filas coa columna NULL (2024/004)
+		{"-estado:resuelta", []string{"2024/003", "2024/004"}},
+		{"-adx:construcciones", []string{"2024/002", "2024/004"}},
+		{"-beirarruas", []string{"2024/002", "2024/003", "2024/004"}},
+		{"-data:2024", []string{"2024/002", "2024/004"}},
+	}
+	// sen caché a busca é LIKE do texto enteiro, non palabra a palabra
+	like := map[string][]string{
+		"obras menores": {"2024/003"},
+	}
+	for _, withCache := range []bool{true, false} {
+		db := openTestDB(t, withCache)
+		for _, tt := range tests {
+			want := tt.want
+			if w, ok := like[tt.q]; ok && !withCache {
+				want = w
+			}
+			got, err := expedientes(t, db, "Alcaldia_contratos_menores", tt.q)
+			if err != nil {
+				t.Errorf("cache=%v %q: %v", withCache, tt.q, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("cache=%v %q = %v, want %v", withCache, tt.q, got, want)
+			}
+		}
+	}
+}
+
+func TestBuildFilterErrors(t *testing.T) {
+	db := openTestDB(t, false)
+	tests := []struct {
+		table, q, err string
+	}{
+		{"Alcaldia_contratos_menores", "importe>=moito", "importe non válido"},
+		{"Alcaldia_contratos_menores", "data:2024-13", "data non válida"},
+		{"Alcaldia_contratos_menores", "tipo>obras", "o operador > non vale"},
+		{"Alcaldia_contratos_menores_files", "tipo:Obras", "non ten columna"},
+	}
+	for _, tt := range tests {
+		_, err := expedientes(t, db, tt.table, tt.q)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: err = %v, want %q", tt.table, tt.q, err, tt.err)
+		}
+	}
+}
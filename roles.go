@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// ==== Roles de columna ====
+// Cada scrapper chama ás columnas á súa maneira ("Importe", "Importe_con_IVE"...).
+// Os handlers, a caché e a linguaxe de consulta non buscan nomes concretos senón
+// roles (importe, tipo, adxudicatario...), que se resolven aquí a partir dunhas
+// regras: para cada patrón de táboa, a lista de columnas candidatas de cada rol.
+//
+// As regras por defecto están abaixo; con --roles roles.json engádense outras diante:
+//
+//	[
+//	  {"match": "*_contratos_menores", "roles": {"data": ["Estado"]}},
+//	  {"match": "xunta_*", "roles": {"importe": ["Importe_total"], "adxudicatario": ["Empresa"]}}
+//	]
+//
+// Para cada rol vale a primeira regra que casa coa táboa e o define; o resto de
+// roles seguen caendo ás regras seguintes (e por último ás por defecto).
+
+const (
+	roleImporte    = "importe"
+	roleTipo       = "tipo"
+	roleAdx        = "adxudicatario"
+	roleObxecto    = "obxecto"
+	roleExpediente = "expediente"
+	roleData       = "data"
+)
+
+// orde na que se amosan os roles
+var roleNames = []string{roleImporte, roleTipo, roleAdx, roleObxecto, roleExpediente, roleData}
+
+type roleRule struct {
+	Match string              `json:"match"` // patrón de táboa (path.Match, sen distinguir maiúsculas); "" ou "*" = todas
+	Roles map[string][]string `json:"roles"` // rol -> columnas candidatas, por orde de preferencia
+}
+
+var defaultRoleRules = []roleRule{
+	// a data vai en texto libre en Estado (contratos menores) ou Fechas (licitacións), ver dates.go
+	{Match: "*_contratos_menores", Roles: map[string][]string{roleData: {"Estado"}}},
+	{Match: "*_licitacions", Roles: map[string][]string{roleData: {"Fechas"}}},
+	{Match: "*", Roles: map[string][]string{
+		roleImporte: {"Importe", "Importe_con_iva", "Importe_con_IVE", "Importe_sin_iva", "Importe_sen_IVE"},
+		roleTipo:    {"Tipo", "TipoContrato", "Tipo_licitacion", "Tipo_licitación"},
+		roleAdx: {"Adxudicatario", "Adjudicatario", "Empresa_adxudicataria",
+			"Proveedor", "Contratista", "Empresa"},
+		roleObxecto: {
+			"Objeto_del_contrato", "Objeto_del_Contrato", "ObjetoContrato",
+			"Obxecto", "Objeto", "Asunto",
+			"Descripcion", "Descripción",
+			"Concepto", "Titulo", "Título",
+		},
+		roleExpediente: {"Expediente"},
+	}},
+}
+
+// regras en uso: as de --roles diante das por defecto
+var roleRules = defaultRoleRules
+
+// loadRoles le o ficheiro de regras e pono diante das por defecto
+func loadRoles(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var rules []roleRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for i, r := range rules {
+		if _, err := path.Match(strings.ToLower(r.Match), ""); err != nil {
+			return fmt.Errorf("%s: regra %d: patrón %q: %w", file, i+1, r.Match, err)
+		}
+		for role := range r.Roles {
+			if !isRole(role) {
+				return fmt.Errorf("%s: regra %d: rol descoñecido %q (válidos: %s)", file, i+1, role, strings.Join(roleNames, ", "))
+			}
+		}
+	}
+	roleRules = append(rules, defaultRoleRules...)
+	return nil
+}
+
+func isRole(role string) bool {
+	for _, r := range roleNames {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (r roleRule) matches(table string) bool {
+	if r.Match == "" || r.Match == "*" {
+		return true
+	}
+	ok, _ := path.Match(strings.ToLower(r.Match), strings.ToLower(table))
+	return ok
+}
+
+// roleCandidates: columnas candidatas dun rol para unha táboa
+func roleCandidates(table, role string) []string {
+	for _, r := range roleRules {
+		if cands, ok := r.Roles[role]; ok && r.matches(table) {
+			return cands
+		}
+	}
+	return nil
+}
+
+// roleColumn: columna da táboa que fai de rol ("" se non hai ningunha)
+func roleColumn(table string, cols []Column, role string) string {
+	return pickFirstColumnName(cols, roleCandidates(table, role)...)
+}
+
+// tableRoles resolve todos os roles dunha táboa
+func tableRoles(table string, cols []Column) map[string]string {
+	out := make(map[string]string, len(roleNames))
+	for _, role := range roleNames {
+		out[role] = roleColumn(table, cols, role)
+	}
+	return out
+}
+
+// rolesFingerprint identifica as regras en uso; a caché gárdao para reconstruírse se cambian
+func rolesFingerprint() string {
+	b, _ := json.Marshal(roleRules)
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ==== /api/roles: roles resoltos para cada táboa do concello ====
+
+func (s *server) handleAPIRoles(w http.ResponseWriter, r *http.Request) {
+	c := s.concello(r)
+	bases, err := listBaseTables(c.DB)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	type tableRolesJSON struct {
+		Table   string              `json:"table"`
+		Roles   map[string]string   `json:"roles"`   // rol -> columna ("" se non hai)
+		Missing []string            `json:"missing"` // roles sen columna
+		Cands   map[string][]string `json:"candidates"`
+	}
+	out := struct {
+		Concello string           `json:"concello"`
+		Rules    []roleRule       `json:"rules"`
+		Tables   []tableRolesJSON `json:"tables"`
+	}{Concello: c.Name, Rules: roleRules}
+	for _, t := range bases {
+		cols, err := tableColumns(c.DB, t)
+		if err != nil {
+			continue
+		}
+		tr := tableRolesJSON{Table: t, Roles: tableRoles(t, cols), Missing: []string{}, Cands: map[string][]string{}}
+		for _, role := range roleNames {
+			tr.Cands[role] = roleCandidates(t, role)
+			if tr.Roles[role] == "" {
+				tr.Missing = append(tr.Missing, role)
+			}
+		}
+		out.Tables = append(out.Tables, tr)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
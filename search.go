@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ==== Busca de texto completo (FTS) ====
+// A caché garda, por cada táboa base, unha táboa virtual lb_fts_<táboa> co texto de todas
+// as columnas da fila (rowid = rowid orixinal) e un tokenizador que elimina acentos.
+// Usamos FTS5 se o binario o trae (-tags sqlite_fts5); se non, FTS4, que vén sempre
+// (un go build sen a etiqueta queda en FTS4: avísase ao arrancar).
+// Sen caché (ou sen índice para a táboa) volvemos ao LIKE de buildWhereLike.
+
+func ftsTableName(table string) string { return "lb_fts_" + table }
+
+var (
+	ftsOnce sync.Once
+	ftsMod  string
+)
+
+// ftsModule devolve o módulo FTS dispoñible neste binario: "fts5", "fts4" ou ""
+func ftsModule() string {
+	ftsOnce.Do(func() {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		for _, m := range []string{"fts5", "fts4"} {
+			if _, err := db.Exec(ftsCreateSQL(m, "probe")); err == nil {
+				ftsMod = m
+				return
+			}
+		}
+	})
+	return ftsMod
+}
+
+func ftsCreateSQL(mod, name string) string {
+	if mod == "fts5" {
+		return fmt.Sprintf(`CREATE VIRTUAL TABLE %s USING fts5(doc, tokenize="unicode61 remove_diacritics 2")`, quoteIdent(name))
+	}
+	return fmt.Sprintf(`CREATE VIRTUAL TABLE %s USING fts4(doc, tokenize=unicode61 "remove_diacritics=2")`, quoteIdent(name))
+}
+
+// buildFTSTable indexa o texto de todas as columnas dunha táboa base
+func buildFTSTable(src *sql.DB, tx *sql.Tx, table string, cols []Column, mod string) error {
+	ft := ftsTableName(table)
+	if _, err := tx.Exec(ftsCreateSQL(mod, ft)); err != nil {
+		return err
+	}
+	sel := make([]string, len(cols))
+	for i, c := range cols {
+		sel[i] = fmt.Sprintf("CAST(%s AS TEXT)", quoteIdent(c.Name))
+	}
+	rows, err := src.Query(fmt.Sprintf(`SELECT rowid, %s FROM %s`, strings.Join(sel, ", "), quoteIdent(table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ins, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s (rowid, doc) VALUES (?, ?)`, quoteIdent(ft)))
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	vals := make([]sql.NullString, len(cols))
+	ptrs := make([]any, len(cols)+1)
+	var rowid int64
+	ptrs[0] = &rowid
+	for i := range vals {
+		ptrs[i+1] = &vals[i]
+	}
+	parts := make([]string, 0, len(cols))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		parts = parts[:0]
+		for _, v := range vals {
+			if v.Valid && v.String != "" {
+				parts = append(parts, v.String)
+			}
+		}
+		if _, err := ins.Exec(rowid, strings.Join(parts, " ")); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ftsMatchExpr traduce a busca do usuario a unha expresión MATCH: cada palabra é un
+// prefixo e as palabras con signos ("2024/00", "1.234") buscan como frase; o que vai
+// entre comiñas ("obras menores") é unha frase exacta. Devolve "" se non queda ningún token.
+func ftsMatchExpr(mod, q string) string {
+	var terms []string
+	for _, w := range splitPhrases(asciiFold(q)) {
+		toks := strings.FieldsFunc(w.text, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if len(toks) == 0 {
+			continue
+		}
+		switch {
+		case w.phrase:
+			terms = append(terms, `"`+strings.Join(toks, " ")+`"`)
+		case mod == "fts5":
+			terms = append(terms, `"`+strings.Join(toks, " ")+`"*`)
+		default:
+			terms = append(terms, `"`+strings.Join(toks, " ")+`*"`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+type searchWord struct {
+	text   string
+	phrase bool
+}
+
+// splitPhrases separa q en palabras e frases entre comiñas (unha comiña sen pechar
+// colle o resto)
+func splitPhrases(q string) []searchWord {
+	var out []searchWord
+	for {
+		before, rest, found := strings.Cut(q, `"`)
+		for _, w := range strings.Fields(before) {
+			out = append(out, searchWord{text: w})
+		}
+		if !found {
+			return out
+		}
+		phrase, after, _ := strings.Cut(rest, `"`)
+		if strings.TrimSpace(phrase) != "" {
+			out = append(out, searchWord{text: phrase, phrase: true})
+		}
+		q = after
+	}
+}
+
+// tableFilter é o filtro dunha busca sobre unha táboa: a WHERE e, se se resolveu
+// con FTS, o JOIN para ordenar por relevancia cando non se pide outra orde
+type tableFilter struct {
+	Where    string
+	Args     []any
+	rankFrom string // JOIN á subconsulta FTS con lb_rank (menor = máis relevante)
+	rankArgs []any
+}
+
+// buildSearch resolve q contra o índice FTS da caché ou, se non o hai, con LIKE
+func buildSearch(db *sql.DB, table string, cols []Column, q string) tableFilter {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return tableFilter{}
+	}
+	m, ok := cacheMeta(db, table)
+	match := ftsMatchExpr(m.FTS, q)
+	if !ok || m.FTS == "" || match == "" {
+		where, args := buildWhereLike(ColNames(cols), strings.ReplaceAll(q, `"`, ""))
+		return tableFilter{Where: where, Args: args}
+	}
+
+	ft := cacheSchema + "." + quoteIdent(ftsTableName(table))
+	fn := quoteIdent(ftsTableName(table))
+	rank := fmt.Sprintf("bm25(%s)", fn)
+	if m.FTS != "fts5" {
+		rank = fmt.Sprintf("-lb_rank(matchinfo(%s, 'pcnx'))", fn)
+	}
+	return tableFilter{
+		Where: fmt.Sprintf("WHERE %s.rowid IN (SELECT rowid FROM %s WHERE %s MATCH ?)", quoteIdent(table), ft, fn),
+		Args:  []any{match},
+		rankFrom: fmt.Sprintf(" JOIN (SELECT rowid AS lb_rid, %s AS lb_rank FROM %s WHERE %s MATCH ?) lbr ON lbr.lb_rid = %s.rowid",
+			rank, ft, fn, quoteIdent(table)),
+		rankArgs: []any{match},
+	}
+}
+
+// ftsRank puntúa unha fila FTS4 a partir de matchinfo(..., 'pcnx'):
+// suma, por frase e columna, os acertos na fila ponderados pola rareza da frase
+func ftsRank(info []byte) float64 {
+	if len(info) < 12 {
+		return 0
+	}
+	u := func(i int) float64 { return float64(binary.NativeEndian.Uint32(info[i*4:])) }
+	p, c, n := int(u(0)), int(u(1)), u(2)
+	score := 0.0
+	for i := 0; i < p; i++ {
+		for j := 0; j < c; j++ {
+			k := 3 + 3*(i*c+j)
+			if (k+3)*4 > len(info) {
+				return score
+			}
+			hits, docs := u(k), u(k+2)
+			if hits > 0 && docs > 0 {
+				score += hits * math.Log(1+n/docs)
+			}
+		}
+	}
+	return score
+}
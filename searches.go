@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==== Buscas gardadas e alertas ====
+// Unha busca gardada é unha táboa, un filtro q (a mesma sintaxe da caixa de busca) e,
+// opcionalmente, un importe mínimo. Van nun ficheiro JSON (--searches) xunto cos notificadores:
+//
+//	{
+//	  "baseURL": "https://licitaberto.example.org",
+//	  "notifiers": [
+//	    {"name": "xornal", "type": "smtp", "addr": "smtp.example.org:587", "user": "u", "pass": "p",
+//	     "from": "alertas@example.org", "to": ["redaccion@example.org"]},
+//	    {"name": "hook", "type": "webhook", "url": "https://example.org/hook"}
+//	  ],
+//	  "searches": [
+//	    {"id": "obras-pleno", "concello": "ames", "table": "Pleno_licitacions", "q": "tipo:Obras", "importeMin": 100000}
+//	  ]
+//	}
+//
+// Cando o .db dun concello cambia (mírase cada minuto) avalíanse as súas buscas e as filas
+// novas mándanse aos notificadores da busca (notify; se non ten, a todos). A primeira vez
+// que se avalía unha busca só se apuntan as filas que xa había. O que xa se notificou
+// gárdase en <ficheiro>.state.json; se un aviso falla, tórnase mandar no seguinte minuto.
+
+type savedSearch struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name,omitempty"`
+	Concello   string   `json:"concello,omitempty"` // slug; "" = o concello por defecto
+	Table      string   `json:"table"`
+	Q          string   `json:"q,omitempty"`
+	ImporteMin float64  `json:"importeMin,omitempty"`
+	Notify     []string `json:"notify,omitempty"` // nomes de notificadores; baleiro = todos
+}
+
+// query: q co importe mínimo como un filtro máis
+func (ss savedSearch) query() string {
+	q := strings.TrimSpace(ss.Q)
+	if ss.ImporteMin > 0 {
+		q = strings.TrimSpace(q + " importe>=" + strconv.FormatFloat(ss.ImporteMin, 'f', -1, 64))
+	}
+	return q
+}
+
+func (ss savedSearch) title() string {
+	if ss.Name != "" {
+		return ss.Name
+	}
+	return ss.ID
+}
+
+type searchConfig struct {
+	BaseURL   string           `json:"baseURL,omitempty"` // para as ligazóns das mensaxes
+	Notifiers []notifierConfig `json:"notifiers"`
+	Searches  []savedSearch    `json:"searches"`
+}
+
+// alertMessage: o que recibe cada notificador (o webhook, tal cal en JSON)
+type alertMessage struct {
+	Search   savedSearch         `json:"search"`
+	Concello string              `json:"concello"`
+	Table    string              `json:"table"`
+	URL      string              `json:"url,omitempty"` // a busca no web
+	Rows     []map[string]string `json:"rows"`          // filas novas
+	Lines    []string            `json:"lines"`         // unha liña por fila: expediente · obxecto · importe
+}
+
+func (m alertMessage) Subject() string {
+	return fmt.Sprintf("licitaberto: %d novas en «%s» (%s)", len(m.Rows), m.Search.title(), m.Concello)
+}
+
+func (m alertMessage) Text() string {
+	var b strings.Builder
+	b.WriteString(m.Subject() + "\n" + m.Table + "\n\n")
+	for _, l := range m.Lines {
+		b.WriteString("- " + l + "\n")
+	}
+	if m.URL != "" {
+		b.WriteString("\n" + m.URL + "\n")
+	}
+	return b.String()
+}
+
+// searchStore: o ficheiro de buscas e o seu estado
+type searchStore struct {
+	mu        sync.Mutex
+	path      string
+	cfg       searchConfig
+	notifiers map[string]notifier
+	seen      map[string][]string            // busca → claves das filas xa vistas
+	pending   map[string]map[string][]string // busca → notificador → claves vistas que aínda non lle chegaron
+}
+
+// searchState: o que se garda en .state.json
+type searchState struct {
+	Seen    map[string][]string            `json:"seen"`
+	Pending map[string]map[string][]string `json:"pending,omitempty"`
+}
+
+func searchStatePath(path string) string { return stripExt(path) + ".state.json" }
+
+// writeState garda o estado ao lado do ficheiro de buscas
+func (st *searchStore) writeState() error {
+	return writeJSONFile(searchStatePath(st.path), searchState{Seen: st.seen, Pending: st.pending})
+}
+
+// loadSearches le o ficheiro (se non existe, empeza baleiro) e o seu estado
+func loadSearches(path string) (*searchStore, error) {
+	st := &searchStore{path: path, seen: map[string][]string{}, pending: map[string]map[string][]string{}}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &st.cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	st.notifiers = map[string]notifier{}
+	for _, nc := range st.cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		st.notifiers[nc.Name] = n
+	}
+	for _, ss := range st.cfg.Searches {
+		if err := st.validate(ss); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if b, err := os.ReadFile(searchStatePath(path)); err == nil {
+		// os estados vellos eran só o mapa de vistas: {"busca": [...]}
+		var raw map[string]json.RawMessage
+		err := json.Unmarshal(b, &raw)
+		if v := raw["seen"]; err == nil && len(v) > 0 && v[0] == '{' {
+			var ss searchState
+			if err = json.Unmarshal(b, &ss); err == nil {
+				if ss.Seen != nil {
+					st.seen = ss.Seen
+				}
+				if ss.Pending != nil {
+					st.pending = ss.Pending
+				}
+			}
+		} else if err == nil {
+			err = json.Unmarshal(b, &st.seen)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", searchStatePath(path), err)
+		}
+	}
+	return st, nil
+}
+
+func (st *searchStore) validate(ss savedSearch) error {
+	if ss.ID == "" || ss.Table == "" {
+		return fmt.Errorf("busca %q: fan falta id e table", ss.title())
+	}
+	if _, err := parseQuery(ss.query()); err != nil {
+		return fmt.Errorf("busca %q: %w", ss.ID, err)
+	}
+	for _, n := range ss.Notify {
+		if st.notifiers[n] == nil {
+			return fmt.Errorf("busca %q: notificador descoñecido %q", ss.ID, n)
+		}
+	}
+	return nil
+}
+
+// writeJSONFile escribe nun temporal e renomea, para non deixar o ficheiro a medias
+func writeJSONFile(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runSearches avalía as buscas dun concello (slug) contra o seu .db e notifica as filas novas
+func (st *searchStore) runSearches(slug, dbPath string, isDefault bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var todo []savedSearch
+	for _, ss := range st.cfg.Searches {
+		if ss.Concello == slug || (ss.Concello == "" && isDefault) {
+			todo = append(todo, ss)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+
+	// conexión nova: o scrapper pode ter substituído o ficheiro
+	if useCache {
+		if err := ensureCache(dbPath); err != nil {
+			log.Printf("WARN: non se puido construír a caché de %s: %v", dbPath, err)
+		}
+	}
+	db, err := openSQLite(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var notifyErrs []error
+	for _, ss := range todo {
+		keys, msg, err := st.matches(db, slug, ss)
+		if err != nil {
+			log.Printf("WARN: busca %s: %v", ss.ID, err)
+			continue
+		}
+		// as filas novas quedan pendentes para cada notificador ata que lle cheguen
+		names := st.notifierNames(ss)
+		pending := map[string]map[string]bool{}
+		for _, n := range names {
+			pending[n] = map[string]bool{}
+			for _, k := range st.pending[ss.ID][n] {
+				pending[n][k] = true
+			}
+		}
+		if prev, baseline := st.seen[ss.ID]; baseline {
+			old := map[string]bool{}
+			for _, k := range prev {
+				old[k] = true
+			}
+			for _, k := range keys {
+				if !old[k] {
+					for _, n := range names {
+						pending[n][k] = true
+					}
+				}
+			}
+		}
+		st.seen[ss.ID] = keys
+
+		delete(st.pending, ss.ID)
+		for _, n := range names {
+			m := msg
+			m.Rows, m.Lines = nil, nil
+			var left []string
+			for i, k := range keys {
+				if pending[n][k] { // as que xa non saen na busca deixan de estar pendentes
+					m.Rows, m.Lines = append(m.Rows, msg.Rows[i]), append(m.Lines, msg.Lines[i])
+					left = append(left, k)
+				}
+			}
+			if len(left) == 0 {
+				continue
+			}
+			if err := st.notify(n, m); err != nil {
+				// só a este: os que xa o recibiron non o volven recibir na seguinte volta
+				notifyErrs = append(notifyErrs, fmt.Errorf("busca %s: %s: %w", ss.ID, n, err))
+				if st.pending[ss.ID] == nil {
+					st.pending[ss.ID] = map[string][]string{}
+				}
+				st.pending[ss.ID][n] = left
+				continue
+			}
+			log.Printf("busca %s: %d filas novas notificadas a %s", ss.ID, len(left), n)
+		}
+	}
+	if err := st.writeState(); err != nil {
+		return err
+	}
+	// co erro, watchDBs non apunta a mtime e volve avaliar as buscas no seguinte minuto
+	return errors.Join(notifyErrs...)
+}
+
+// matches: todas as filas da busca, coas súas claves (o expediente, ou un hash da fila)
+func (st *searchStore) matches(db *sql.DB, slug string, ss savedSearch) ([]string, alertMessage, error) {
+	msg := alertMessage{Search: ss, Concello: slug, Table: ss.Table}
+	cols, err := tableColumns(db, ss.Table)
+	if err != nil {
+		return nil, msg, err
+	}
+	if len(cols) == 0 {
+		return nil, msg, fmt.Errorf("non existe a táboa %s", ss.Table)
+	}
+	flt, err := buildFilter(db, ss.Table, cols, ss.query())
+	if err != nil {
+		return nil, msg, err
+	}
+	rows, err := fetchPage(db, ss.Table, cols, flt, "", false, 1, 1_000_000)
+	if err != nil {
+		return nil, msg, err
+	}
+	roles := tableRoles(ss.Table, cols)
+	keys := make([]string, 0, len(rows))
+	for _, r := range rows {
+		m := make(map[string]string, len(cols))
+		for _, c := range cols {
+			if r[c.Name] != nil {
+				m[c.Name] = fmt.Sprint(r[c.Name])
+			}
+		}
+		k := m[roles[roleExpediente]]
+		if k == "" {
+			b, _ := json.Marshal(m)
+			sum := sha1.Sum(b)
+			k = "#" + hex.EncodeToString(sum[:8])
+		}
+		var parts []string
+		for _, role := range []string{roleExpediente, roleObxecto} {
+			if v := m[roles[role]]; v != "" {
+				parts = append(parts, v)
+			}
+		}
+		if v := m[roles[roleImporte]]; v != "" {
+			parts = append(parts, v+" €")
+		}
+		keys = append(keys, k)
+		msg.Rows = append(msg.Rows, m)
+		msg.Lines = append(msg.Lines, strings.Join(parts, " · "))
+	}
+	if st.cfg.BaseURL != "" {
+		msg.URL = strings.TrimRight(st.cfg.BaseURL, "/") + "/" + slug + "/table/" + url.PathEscape(ss.Table) + "?q=" + url.QueryEscape(ss.query())
+	}
+	return keys, msg, nil
+}
+
+// notifierNames: os notificadores da busca (todos se non di ningún)
+func (st *searchStore) notifierNames(ss savedSearch) []string {
+	if len(ss.Notify) > 0 {
+		return ss.Notify
+	}
+	var names []string
+	for _, nc := range st.cfg.Notifiers {
+		names = append(names, nc.Name)
+	}
+	return names
+}
+
+// notify manda a mensaxe ao notificador name
+func (st *searchStore) notify(name string, msg alertMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return st.notifiers[name].Notify(ctx, msg)
+}
+
+// buscas gardadas (--searches); nil se non hai
+var savedSearches *searchStore
+
+// /api/searches: GET lista (os notificadores sen segredos), POST engade, DELETE ?id= borra
+func (s *server) handleAPISearches(w http.ResponseWriter, r *http.Request) {
+	st := savedSearches
+	if st == nil {
+		http.Error(w, "sen buscas gardadas (--searches)", 404)
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var ss savedSearch
+		if err := json.NewDecoder(r.Body).Decode(&ss); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if ss.ID == "" && ss.Name != "" {
+			ss.ID = slugify(ss.Name)
+		} else if ss.ID == "" {
+			ss.ID = slugify(ss.Table + " " + ss.Q)
+		}
+		for _, o := range st.cfg.Searches {
+			if o.ID == ss.ID {
+				http.Error(w, "xa hai unha busca "+ss.ID, 409)
+				return
+			}
+		}
+		if err := st.validate(ss); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		st.cfg.Searches = append(st.cfg.Searches, ss)
+		if err := writeJSONFile(st.path, st.cfg); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		n := len(st.cfg.Searches)
+		for i, o := range st.cfg.Searches {
+			if o.ID == id {
+				st.cfg.Searches = append(st.cfg.Searches[:i], st.cfg.Searches[i+1:]...)
+				break
+			}
+		}
+		if len(st.cfg.Searches) == n {
+			http.Error(w, "non hai ningunha busca "+id, 404)
+			return
+		}
+		delete(st.seen, id)
+		delete(st.pending, id)
+		if err := writeJSONFile(st.path, st.cfg); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if err := st.writeState(); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	default:
+		http.Error(w, "método non permitido", 405)
+		return
+	}
+
+	// só nome e tipo: os tokens e contrasinais non saen da configuración
+	type notifierInfo struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	ns := []notifierInfo{}
+	for _, nc := range st.cfg.Notifiers {
+		ns = append(ns, notifierInfo{nc.Name, nc.Type})
+	}
+	searches := append([]savedSearch{}, st.cfg.Searches...)
+	sort.Slice(searches, func(i, j int) bool { return searches[i].ID < searches[j].ID })
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"searches": searches, "notifiers": ns})
+}
+
+// ==== subcomando alerts ====
+
+// runAlerts: licitaberto alerts --db ... --searches buscas.json [--test notificador]
+// Avalía unha vez todas as buscas (para un cron) ou manda unha mensaxe de proba.
+func runAlerts(args []string) error {
+	fs := flag.NewFlagSet("alerts", flag.ExitOnError)
+	dbPath := fs.String("db", "", "ficheiro SQLite, lista separada por comas ou directorio")
+	file := fs.String("searches", "", "ficheiro JSON coas buscas e os notificadores")
+	roles := fs.String("roles", "", "ficheiro JSON cos roles de columna por táboa (ver roles.go)")
+	test := fs.String("test", "", "manda unha mensaxe de proba a este notificador e sae")
+	_ = fs.Parse(args)
+	if *file == "" {
+		return fmt.Errorf("uso: licitaberto alerts --db ... --searches buscas.json [--test notificador]")
+	}
+	if *roles != "" {
+		if err := loadRoles(*roles); err != nil {
+			return err
+		}
+	}
+	st, err := loadSearches(*file)
+	if err != nil {
+		return err
+	}
+
+	if *test != "" {
+		n := st.notifiers[*test]
+		if n == nil {
+			return fmt.Errorf("non hai ningún notificador %q", *test)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		msg := alertMessage{
+			Search:   savedSearch{ID: "proba", Name: "Proba de licitaberto"},
+			Concello: "proba", Table: "proba",
+			Rows:  []map[string]string{{"Expediente": "2024/0001", "Objeto_del_contrato": "Mensaxe de proba"}},
+			Lines: []string{"2024/0001 · Mensaxe de proba"},
+		}
+		if err := n.Notify(ctx, msg); err != nil {
+			return err
+		}
+		log.Printf("mensaxe de proba enviada a %s", *test)
+		return nil
+	}
+
+	if *dbPath == "" {
+		return fmt.Errorf("falta --db")
+	}
+	paths, err := expandDBPaths([]string{*dbPath})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, p := range paths {
+		if isPostgresDSN(p) {
+			log.Printf("WARN: as buscas gardadas só son para SQLite, sáltase %s", p)
+			continue
+		}
+		if err := st.runSearches(slugify(stripExt(filepath.Base(p))), p, i == 0); err != nil {
+			// un aviso que falla non impide os dos demais concellos
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+		}
+	}
+	return errors.Join(errs...)
+}
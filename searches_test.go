@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hookServer: un webhook que apunta o que recibe e, mentres *fail, responde 503
+func hookServer(t *testing.T, fail *bool) (*httptest.Server, *[]alertMessage) {
+	var got []alertMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *fail {
+			http.Error(w, "caído", http.StatusServiceUnavailable)
+			return
+		}
+		var m alertMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		got = append(got, m)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &got
+}
+
+// un aviso que falla queda pendente só para ese notificador: mándaselle na seguinte volta
+// aínda que o .db non cambie, e os que xa o recibiron non o reciben outra vez
+func TestRunSearchesRetry(t *testing.T) {
+	dbPath := writeTestDB(t)
+	fail, never := true, false
+	srv, pGot := hookServer(t, &fail)
+	okSrv, pOK := hookServer(t, &never)
+
+	path := filepath.Join(t.TempDir(), "buscas.json")
+	b, _ := json.Marshal(searchConfig{
+		Notifiers: []notifierConfig{{Name: "hook", Type: "webhook", URL: srv.URL}, {Name: "ok", Type: "webhook", URL: okSrv.URL}},
+		Searches:  []savedSearch{{ID: "obras", Table: "Alcaldia_contratos_menores", Q: "tipo:Obras"}},
+	})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := loadSearches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a primeira vez só se apuntan as filas que hai
+	if err := st.runSearches("proba", dbPath, true); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec(`INSERT INTO Alcaldia_contratos_menores VALUES ('2024/005', 'Pintura do pavillón', 'Obras', '9.000,00', 'PINTURAS SUR SL', NULL)`)
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.runSearches("proba", dbPath, true); err == nil {
+		t.Fatal("aviso caído: want error")
+	}
+	if p := st.pending["obras"]; len(p) != 1 || len(p["hook"]) != 1 || p["hook"][0] != "2024/005" {
+		t.Errorf("pendentes %v despois do erro, want hook: [2024/005]", p)
+	}
+	if st2, err := loadSearches(path); err != nil || len(st2.pending["obras"]["hook"]) != 1 {
+		t.Errorf("pendentes gardadas: %v, %v", st2.pending, err)
+	}
+
+	fail = false
+	if err := st.runSearches("proba", dbPath, true); err != nil {
+		t.Fatal(err)
+	}
+	// xa mandada a todos: non se volve mandar
+	if err := st.runSearches("proba", dbPath, true); err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string][]alertMessage{"hook": *pGot, "ok": *pOK} {
+		if len(got) != 1 || len(got[0].Rows) != 1 || got[0].Rows[0]["Expediente"] != "2024/005" {
+			t.Errorf("avisos a %s = %+v, want un con 2024/005", name, got)
+		}
+	}
+	if st2, err := loadSearches(path); err != nil || len(st2.seen["obras"]) != 3 || len(st2.pending) != 0 {
+		t.Errorf("estado gardado: %v %v, %v", st2.seen, st2.pending, err)
+	}
+
+	// borrar a busca bórraa tamén do estado gardado
+	savedSearches = st
+	defer func() { savedSearches = nil }()
+	rec := httptest.NewRecorder()
+	(&server{}).handleAPISearches(rec, httptest.NewRequest(http.MethodDelete, "/api/searches?id=obras", nil))
+	if rec.Code != 200 {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body)
+	}
+	if st2, err := loadSearches(path); err != nil || len(st2.cfg.Searches) != 0 || st2.seen["obras"] != nil {
+		t.Errorf("despois de borrar: %v %v, %v", st2.cfg.Searches, st2.seen, err)
+	}
+}
+
+// os estados de antes (só o mapa de vistas) seguen a lerse
+func TestLoadSearchesOldState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buscas.json")
+	if err := os.WriteFile(searchStatePath(path), []byte(`{"obras": ["2024/001"], "seen": ["x"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := loadSearches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.seen) != 2 || st.seen["obras"][0] != "2024/001" || st.seen["seen"][0] != "x" {
+		t.Errorf("seen = %v", st.seen)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ==== Posible fraccionamento de contratos menores ====
+// Un contrato menor non pode pasar do límite da LCSP (art. 118: 40.000 € en obras, 15.000 € en
+// servizos e subministros; os límites saen das regras "menor" de thresholds.go). Buscamos nas táboas *_contratos_menores grupos de contratos:
+//
+//   - co mesmo adxudicatario (resolto a provedor, ver suppliers.go) e do mesmo tipo
+//   - cun obxecto parecido (as mesmas palabras, sen contar números nin artigos)
+//   - dentro de 12 meses
+//
+// que xuntos chegan ao límite (coma nos limiares: no límite xa non é menor). Cada táboa é un
+// órgano (Alcaldía, Xunta de Goberno...) e analízase á parte.
+
+const (
+	splitObras    = "obras"
+	splitServizos = "servizos e subministros"
+
+	splitWindow     = 12 // meses
+	splitSimilarity = 0.5
+)
+
+// categoría do grupo: a de tipoCategory, con servizos e subministros xuntos (o mesmo límite)
+func splitCategory(tipo string) string {
+	if tipoCategory(tipo) == tipoObras {
+		return splitObras
+	}
+	return splitServizos
+}
+
+// splitRule: a regra de contrato menor da categoría en vigor na data
+func splitRule(table, cat, date string) *thresholdRule {
+	tipo := tipoServizos
+	if cat == splitObras {
+		tipo = tipoObras
+	}
+	return thresholds.kindRule("menor", table, tipo, date)
+}
+
+// splitLimits: os límites en vigor hoxe para a táboa, por categoría
+func splitLimits(table string) map[string]float64 {
+	out := map[string]float64{}
+	for _, cat := range []string{splitObras, splitServizos} {
+		if r := splitRule(table, cat, time.Now().Format("2006-01-02")); r != nil {
+			out[cat] = r.Importe
+		}
+	}
+	return out
+}
+
+type splitContract struct {
+	Expediente string  `json:"expediente"`
+	Obxecto    string  `json:"obxecto"`
+	Adx        string  `json:"adxudicatario"` // texto orixinal
+	Importe    float64 `json:"importe"`
+	Data       string  `json:"data"`
+	URL        string  `json:"url"`
+	FichaURL   string  `json:"fichaUrl,omitempty"`
+}
+
+type splitFlag struct {
+	Table      string          `json:"table"`
+	Organo     string          `json:"organo"`
+	SupplierID string          `json:"supplierId"`
+	Supplier   string          `json:"supplier"`
+	Categoria  string          `json:"categoria"`
+	Limite     float64         `json:"limite"`
+	Total      float64         `json:"total"`
+	Desde      string          `json:"desde"`
+	Ata        string          `json:"ata"`
+	Contratos  []splitContract `json:"contratos"`
+}
+
+// splitTables: as táboas de contratos menores do concello
+func splitTables(db *sql.DB) ([]string, error) {
+	bases, err := listBaseTables(db)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, t := range bases {
+		if strings.HasSuffix(strings.ToLower(t), "_contratos_menores") {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// detectSplitting analiza as táboas dadas; base é o prefixo do concello para as ligazóns
+func detectSplitting(db *sql.DB, sup *supplierIndex, tables []string, base string) ([]splitFlag, error) {
+	flags := []splitFlag{}
+	for _, t := range tables {
+		cols, err := tableColumns(db, t)
+		if err != nil {
+			return nil, err
+		}
+		adxCol, impCol := roleColumn(t, cols, roleAdx), roleColumn(t, cols, roleImporte)
+		if adxCol == "" || impCol == "" {
+			continue
+		}
+		conIVE := importeConIVE(impCol)
+		src := tableSource(db, t, cols)
+		if src.Date == "NULL" {
+			continue // sen datas non hai xanela de 12 meses
+		}
+		colOrEmpty := func(role string) string {
+			if c := roleColumn(t, cols, role); c != "" {
+				return "CAST(" + quoteIdent(c) + " AS TEXT)"
+			}
+			return "''"
+		}
+		q := fmt.Sprintf(`SELECT %s, %s, %s, CAST(%s AS TEXT), %s, %s FROM %s %s`,
+			colOrEmpty(roleExpediente), colOrEmpty(roleObxecto), colOrEmpty(roleTipo), quoteIdent(adxCol),
+			src.Importe, src.Date, src.From,
+			andWhere("", fmt.Sprintf("%s IS NOT NULL AND %s IS NOT NULL AND %s > 0", src.Date, src.Importe, src.Importe)))
+
+		// grupos por provedor e categoría
+		type item struct {
+			c     splitContract
+			words map[string]bool
+			date  time.Time
+		}
+		type groupKey struct{ supplier, cat string }
+		groups := map[groupKey][]item{}
+		labels := map[string]string{}
+		err = queryEach(db, q, nil, func(rows *sql.Rows) error {
+			var exp, obj, tipo, adx sql.NullString
+			var imp float64
+			var data string
+			if err := rows.Scan(&exp, &obj, &tipo, &adx, &imp, &data); err != nil {
+				return err
+			}
+			d, err := time.Parse("2006-01-02", data)
+			if err != nil || strings.TrimSpace(adx.String) == "" {
+				return nil
+			}
+			sp := sup.resolve(adx.String)
+			labels[sp.ID] = sp.Label
+			it := item{
+				c: splitContract{
+					Expediente: strings.TrimSpace(exp.String),
+					Obxecto:    strings.TrimSpace(obj.String),
+					Adx:        strings.TrimSpace(adx.String),
+					Importe:    imp,
+					Data:       data,
+				},
+				words: objectWords(obj.String),
+				date:  d,
+			}
+			it.c.URL = expedienteURL(base, t, it.c.Expediente)
+			it.c.FichaURL = fichaURL(base, t, it.c.Expediente)
+			k := groupKey{sp.ID, splitCategory(tipo.String)}
+			groups[k] = append(groups[k], it)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+
+		for k, items := range groups {
+			if len(items) < 2 {
+				continue
+			}
+			// obxectos parecidos: compoñentes conexas da semellanza
+			parent := make([]int, len(items))
+			for i := range parent {
+				parent[i] = i
+			}
+			var find func(int) int
+			find = func(i int) int {
+				if parent[i] != i {
+					parent[i] = find(parent[i])
+				}
+				return parent[i]
+			}
+			for i := range items {
+				for j := i + 1; j < len(items); j++ {
+					if jaccard(items[i].words, items[j].words) >= splitSimilarity {
+						parent[find(j)] = find(i)
+					}
+				}
+			}
+			clusters := map[int][]item{}
+			for i, it := range items {
+				clusters[find(i)] = append(clusters[find(i)], it)
+			}
+
+			for _, cl := range clusters {
+				sort.Slice(cl, func(i, j int) bool { return cl[i].date.Before(cl[j].date) })
+				// xanelas de 12 meses dende cada contrato; as que chegan ao límite, sen solaparse
+				for i := 0; i < len(cl); i++ {
+					end := cl[i].date.AddDate(0, splitWindow, 0)
+					total, j := 0.0, i
+					for ; j < len(cl) && !cl[j].date.After(end); j++ {
+						total += cl[j].c.Importe
+					}
+					// o límite en vigor ao comezo da xanela
+					rule := splitRule(t, k.cat, cl[i].c.Data)
+					if j-i < 2 || rule == nil {
+						continue
+					}
+					limit := rule.Importe
+					if !thresholds.reaches(rule, total, conIVE) {
+						continue
+					}
+					f := splitFlag{
+						Table: t, Organo: organoFromTable(t),
+						SupplierID: k.supplier, Supplier: labels[k.supplier],
+						Categoria: k.cat, Limite: limit, Total: total,
+						Desde: cl[i].c.Data, Ata: cl[j-1].c.Data,
+					}
+					for _, it := range cl[i:j] {
+						f.Contratos = append(f.Contratos, it.c)
+					}
+					flags = append(flags, f)
+					i = j - 1
+				}
+			}
+		}
+	}
+	// os que máis pasan do límite primeiro
+	sort.Slice(flags, func(i, j int) bool {
+		ri, rj := flags[i].Total/flags[i].Limite, flags[j].Total/flags[j].Limite
+		if ri != rj {
+			return ri > rj
+		}
+		return flags[i].Desde < flags[j].Desde
+	})
+	return flags, nil
+}
+
+// palabras que non distinguen un obxecto doutro
+var objectStopwords = map[string]bool{
+	"de": true, "do": true, "da": true, "dos": true, "das": true, "del": true, "la": true, "las": true,
+	"el": true, "los": true, "o": true, "a": true, "os": true, "as": true, "e": true, "y": true,
+	"en": true, "no": true, "na": true, "nos": true, "nas": true, "con": true, "para": true, "por": true,
+	"un": true, "una": true, "unha": true, "al": true, "ao": true,
+}
+
+// objectWords: palabras do obxecto sen acentos, artigos nin números
+func objectWords(s string) map[string]bool {
+	out := map[string]bool{}
+	for _, w := range strings.FieldsFunc(asciiFold(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9')
+	}) {
+		if len(w) < 2 || objectStopwords[w] || strings.Trim(w, "0123456789") == "" {
+			continue
+		}
+		out[w] = true
+	}
+	return out
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	n := 0
+	for w := range a {
+		if b[w] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(a)+len(b)-n)
+}
+
+// ==== /flags/splitting e /api/flags/splitting ====
+
+// splittingFlags devolve tamén os límites de hoxe (os da primeira táboa) para amosalos
+func (s *server) splittingFlags(r *http.Request) ([]splitFlag, map[string]float64, error) {
+	c := s.concello(r)
+	tables, err := splitTables(c.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	limits := map[string]float64{}
+	if len(tables) > 0 {
+		limits = splitLimits(tables[0])
+	}
+	flags, err := detectSplitting(c.DB, s.suppliers(), tables, basePath(r))
+	return flags, limits, err
+}
+
+func (s *server) handleSplitting(w http.ResponseWriter, r *http.Request) {
+	flags, limits, err := s.splittingFlags(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	data := map[string]any{"Flags": flags, "Limits": limits, "Window": splitWindow}
+	if err := s.tpl.ExecuteTemplate(w, "flags_splitting.gohtml", s.pageData(r, data)); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (s *server) handleAPISplitting(w http.ResponseWriter, r *http.Request) {
+	flags, limits, err := s.splittingFlags(r)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"flags": flags, "limits": limits, "windowMonths": splitWindow})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"regexp"
@@ -33,9 +34,9 @@ func ColNames(cols []Column) []string {
 	return out
 }
 
-// Converte un campo numérico en formato "12.345,67" a REAL en SQLite
+// Converte un campo numérico en formato "12.345,67" a número
 func sqlToRealEuro(expr string) string {
-	return fmt.Sprintf("CAST(REPLACE(REPLACE(%s, '.', ''), ',', '.') AS REAL)", expr)
+	return dbDialect.ToReal(expr, true)
 }
 
 // asciiFold elimina diacríticos e pasa a minúsculas.
@@ -52,7 +53,8 @@ func asciiFold(s string) string {
 	return b.String()
 }
 
-// Rexistra unha función SQL chamada unaccent_lower(text) -> text
+// Rexistra unha función SQL chamada unaccent_lower(text) -> text nunha conexión dun *sql.DB
+// (para as bases abertas con openSQLite xa o fai o hook de cada conexión)
 func registerSQLiteFuncs(db *sql.DB) error {
 	conn, err := db.Conn(context.Background())
 	if err != nil {
@@ -65,78 +67,118 @@ func registerSQLiteFuncs(db *sql.DB) error {
 		if !ok {
 			return nil
 		}
-		return c.RegisterFunc("unaccent_lower", func(s any) any {
-			if s == nil {
-				return ""
-			}
-			switch v := s.(type) {
-			case string:
-				// log.Printf("unaccent_lower string: [%s] [%s]", v, asciiFold(v))
-				return asciiFold(v)
-			default:
-				// log.Printf("unaccent_lower string: [%s] [%s]", v, asciiFold(fmt.Sprint(v)))
-				return asciiFold(fmt.Sprint(v))
-			}
-		}, true) // pure=true
+		return registerConnFuncs(c)
 	})
 }
 
+func registerConnFuncs(c *sqlite3.SQLiteConn) error {
+	// relevancia para FTS4 (FTS5 xa trae bm25)
+	if err := c.RegisterFunc("lb_rank", ftsRank, true); err != nil {
+		return err
+	}
+	// data etiquetada dun campo Estado/Fechas (ver dates.go)
+	if err := c.RegisterFunc("lb_date", sqlDate, true); err != nil {
+		return err
+	}
+	return c.RegisterFunc("unaccent_lower", func(s any) any {
+		if s == nil {
+			return ""
+		}
+		switch v := s.(type) {
+		case string:
+			// log.Printf("unaccent_lower string: [%s] [%s]", v, asciiFold(v))
+			return asciiFold(v)
+		default:
+			// log.Printf("unaccent_lower string: [%s] [%s]", v, asciiFold(fmt.Sprint(v)))
+			return asciiFold(fmt.Sprint(v))
+		}
+	}, true) // pure=true
+}
+
 // --- Normalización simple ---
 
-func openSQLite(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+// sqliteConnector abre conexións co driver de go-sqlite3 e un ConnectHook propio,
+// para que funcións, caché anexada e query_only estean en todas as conexións do pool.
+// A caché anéxase aquí e non no hook porque depende do estado (ver cacheState).
+type sqliteConnector struct {
+	dsn string
+	drv *sqlite3.SQLiteDriver
+	st  *cacheState
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	attach, gen := c.st.snapshot()
+	dc, err := c.drv.Open(c.dsn)
 	if err != nil {
 		return nil, err
 	}
+	conn := dc.(*sqlite3.SQLiteConn)
+	if attach {
+		if _, err := conn.Exec("ATTACH DATABASE ? AS "+cacheSchema, []driver.Value{readOnlyURI(cachePath(c.dsn))}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	// Read-only reforzado a nivel de sesión
-	if _, err := db.Exec("PRAGMA query_only = ON"); err != nil {
+	if _, err := conn.Exec("PRAGMA query_only = ON", nil); err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return db, nil
+	return &cacheConn{SQLiteConn: conn, st: c.st, gen: gen}, nil
 }
 
-func listTables(db *sql.DB) ([]string, error) {
-	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	tables := []string{}
-	for rows.Next() {
-		var n string
-		rows.Scan(&n)
-		tables = append(tables, n)
+func (c sqliteConnector) Driver() driver.Driver { return cacheDriver{c.drv, c.st} }
+
+// cacheDriver leva o estado da caché, para atopalo dende o *sql.DB (cacheStateOf)
+type cacheDriver struct {
+	*sqlite3.SQLiteDriver
+	st *cacheState
+}
+
+// cacheConn: conexión anexada (ou non) á caché dunha xeración; cando a xeración cambia,
+// database/sql descártaa ao devolvela ou ao reutilizala
+type cacheConn struct {
+	*sqlite3.SQLiteConn
+	st  *cacheState
+	gen int64
+}
+
+func (c *cacheConn) IsValid() bool { return c.gen == c.st.gen.Load() }
+
+func (c *cacheConn) ResetSession(context.Context) error {
+	if !c.IsValid() {
+		return driver.ErrBadConn
 	}
-	return tables, nil
+	return nil
 }
 
-func tableColumns(db *sql.DB, table string) ([]Column, error) {
-	q := fmt.Sprintf("PRAGMA table_info(%s)", quoteIdent(table))
-	rows, err := db.Query(q)
-	if err != nil {
+func openSQLite(dbPath string) (*sql.DB, error) {
+	drv := &sqlite3.SQLiteDriver{ConnectHook: registerConnFuncs}
+	db := sql.OpenDB(sqliteConnector{dsn: dbPath, drv: drv, st: newCacheState(dbPath)})
+	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
-	defer rows.Close()
-	res := []Column{}
-	for rows.Next() {
-		var cid int
-		var name, ctype string
-		var notnull int
-		var dflt *string
-		var pk int
-		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
-			return nil, err
-		}
-		res = append(res, Column{Name: name, Type: ctype})
-	}
-	return res, nil
+	return db, nil
+}
+
+func listTables(db *sql.DB) ([]string, error) {
+	return dbDialect.ListTables(db)
+}
+
+func tableColumns(db *sql.DB, table string) ([]Column, error) {
+	return dbDialect.TableColumns(db, table)
 }
 
 // devolve true se existe a táboa
 func tableExists(db *sql.DB, name string) bool {
-	var n int
-	_ = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?`, name).Scan(&n)
-	return n > 0
+	tabs, _ := listTables(db)
+	for _, t := range tabs {
+		if t == name {
+			return true
+		}
+	}
+	return false
 }
 
 // devolve a táboa de anexos asociada (base+"_files" ou base+"_file"), ou "" se non existe
@@ -164,15 +206,12 @@ func pickFirstColumnName(cols []Column, candidates ...string) string {
 
 // lista de táboas "base" (non *_files/_file)
 func listBaseTables(db *sql.DB) ([]string, error) {
-	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	tabs, err := listTables(db)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 	var out []string
-	for rows.Next() {
-		var n string
-		_ = rows.Scan(&n)
+	for _, n := range tabs {
 		if strings.HasSuffix(n, "_files") || strings.HasSuffix(n, "_file") {
 			continue
 		}
@@ -185,40 +224,45 @@ func listBaseTables(db *sql.DB) ([]string, error) {
 
 // Detecta se existe unha columna nunha táboa
 func columnExists(db *sql.DB, table, col string) bool {
-	rows, err := db.Query("PRAGMA table_info(" + quoteIdent(table) + ")")
+	cols, err := tableColumns(db, table)
 	if err != nil {
 		return false
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var cid int
-		var name, ctype string
-		var notnull, pk int
-		var dflt sql.NullString
-		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err == nil {
-			if strings.EqualFold(name, col) {
-				return true
-			}
-		}
-	}
-	return false
+	return pickFirstColumnName(cols, col) != ""
 }
 
-// Devolve a columna correcta do adxudicatario para unha táboa
-func pickAdjCol(db *sql.DB, table string) string {
-	candidates := []string{
-		"Adjudicatario", "Adxudicatario",
-		"EMPRESA_ADXUDICATARIA", "Empresa_adxudicataria",
-	}
-	for _, c := range candidates {
-		if columnExists(db, table, c) {
-			return c
-		}
+// ==== expresións de agregación ====
+// Compartidas polos resumos (/summary_all) e pola comparación entre concellos (/compare).
+
+// tipo con etiqueta para os baleiros
+func tipoKeyExpr(col string) string {
+	return fmt.Sprintf("COALESCE(NULLIF(TRIM(%s),''),'(Sen tipo)')", quoteIdent(col))
+}
+
+// "YYYY-MM-DD" da data de publicación da columna (NULL se non se recoñece ningunha)
+func isoDateExpr(dateCol string) string {
+	return dbDialect.ISODate(quoteIdent(dateCol))
+}
+
+// "YYYY-MM" da data de publicación da columna
+func monthKeyExpr(dateCol string) string {
+	return fmt.Sprintf("SUBSTR(%s, 1, 7)", isoDateExpr(dateCol))
+}
+
+// chave normalizada do adxudicatario (sen acentos, minúsculas)
+func adxKeyExpr(col string) string {
+	return dbDialect.Fold(fmt.Sprintf("TRIM(CAST(%s AS TEXT))", quoteIdent(col)))
+}
+
+// engade unha condición a unha WHERE que pode vir baleira
+func andWhere(where, cond string) string {
+	if strings.TrimSpace(where) == "" {
+		return "WHERE " + cond
 	}
-	return "" // non hai columna coñecida
+	return where + " AND " + cond
 }
 
-// buildWhereLike crea unha WHERE con OR sobre as columnas, aplicando unaccent_lower, substitúe á anterior versión
+// buildWhereLike crea unha WHERE con OR sobre as columnas, sen acentos (dbDialect.Fold), substitúe á anterior versión
 func buildWhereLike(cols []string, q string) (string, []any) {
 	q = strings.TrimSpace(q)
 	if q == "" {
@@ -228,7 +272,7 @@ func buildWhereLike(cols []string, q string) (string, []any) {
 	parts := make([]string, 0, len(cols))
 	args := make([]any, 0, len(cols))
 	for _, c := range cols {
-		parts = append(parts, fmt.Sprintf("unaccent_lower(CAST(%s AS TEXT)) LIKE ?", quoteIdent(c)))
+		parts = append(parts, dbDialect.Fold(fmt.Sprintf("CAST(%s AS TEXT)", quoteIdent(c)))+" LIKE ?")
 		// parts = append(parts, fmt.Sprintf("unaccent_lower(%s) LIKE ?", quoteIdent(c)))
 		args = append(args, like)
 	}
@@ -245,60 +289,10 @@ func countRows(db *sql.DB, table string, where string, args []any) (int, error)
 	return n, nil
 }
 
-func fetchPage(db *sql.DB, table string, cols []Column, where string, orderBy string, desc bool, page, perPage int, args []any) ([]map[string]any, error) {
-	if page < 1 {
-		page = 1
-	}
-	if perPage <= 0 {
-		perPage = 50
-	}
-
-	ob := ""
-	if orderBy != "" {
-		// Detectar estilo numérico da columna (se aplica)
-		style := detectNumericStyle(db, table, orderBy, where, args)
-		if style != "" {
-			ob = fmt.Sprintf("ORDER BY %s %s", numericOrderExpr(orderBy, style), map[bool]string{true: "DESC", false: "ASC"}[desc])
-		} else {
-			ob = fmt.Sprintf("ORDER BY %s %s", quoteIdent(orderBy), map[bool]string{true: "DESC", false: "ASC"}[desc])
-		}
-	}
-
-	offset := (page - 1) * perPage
-	selectCols := make([]string, len(cols))
-	for i, c := range cols {
-		selectCols[i] = quoteIdent(c.Name)
-	}
-
-	q := fmt.Sprintf("SELECT %s FROM %s %s %s LIMIT %d OFFSET %d", strings.Join(selectCols, ","), quoteIdent(table), where, ob, perPage, offset)
-	rows, err := db.Query(q, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	out := []map[string]any{}
-	cNames := make([]string, len(cols))
-	for i, c := range cols {
-		cNames[i] = c.Name
-	}
-	for rows.Next() {
-		vals := make([]any, len(cols))
-		ptrs := make([]any, len(cols))
-		for i := range vals {
-			ptrs[i] = &vals[i]
-		}
-		if err := rows.Scan(ptrs...); err != nil {
-			return nil, err
-		}
-		m := map[string]any{}
-		for i, n := range cNames {
-			m[n] = vals[i]
-		}
-		out = append(out, m)
-	}
-
-	return out, nil
+// fetchPage devolve a páxina page (OFFSET); para ir de páxina en páxina mellor fetchKeyset
+func fetchPage(db *sql.DB, table string, cols []Column, f tableFilter, orderBy string, desc bool, page, perPage int) ([]map[string]any, error) {
+	res, err := fetchKeyset(db, table, cols, f, orderBy, desc, page, perPage, "")
+	return res.Rows, err
 }
 
 // Ordena os datos da gráfica segundo a dirección elixida no formulario.
@@ -310,17 +304,23 @@ func histogramCounts(db *sql.DB, table, col, where string, args []any, limit int
 		return nil, nil, errors.New("no column")
 	}
 
-	style := detectNumericStyle(db, table, col, where, args)
 	tname := quoteIdent(table)
 	orderDir := "ASC"
 	if desc {
 		orderDir = "DESC"
 	}
 
+	// importe tipado na caché; se non, detectar estilo numérico sobre o texto
+	style, key := "", ""
+	if tf, expr, ok := typedOrder(db, table, col); ok {
+		style, key, tname = "typed", expr, tf
+	} else if style = detectNumericStyle(db, table, col, where, args); style != "" {
+		key = numericOrderExpr(col, style)
+	}
+
 	var q string
 	if style != "" {
 		// Numérico → clave REAL, ordenar por valor
-		key := numericOrderExpr(col, style)
 		q = fmt.Sprintf(`
 			WITH vals AS (
 				SELECT %s AS k FROM %s %s
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ==== Motor de resumos ====
+// /summary, /summary_all e as súas APIs amosan os mesmos agregados (nº e importe por tipo,
+// top de adxudicatarios, cobertura de PDF, meses e maiores importes) sobre unha táboa ou sobre
+// todas. summaryEngine fai as consultas de cada táboa, suma os resultados e devolve un
+// summaryResult; os handlers só escollen as táboas e pintan o resultado en HTML ou JSON.
+// /compare non o usa: agrega varios concellos nunha consulta (ver compare.go).
+//
+// Para engadir unha métrica: unha función en summaryMetrics, o seu campo en summaryResult
+// (enchido en result) e as súas series en fields.
+
+type summaryOptions struct {
+	TopAdx    int            // adxudicatarios no top
+	TopLic    int            // licitacións de maior importe
+	Suppliers *supplierIndex // resolución de adxudicatarios (nil: só NIF e nome normalizado)
+}
+
+var defaultSummaryOptions = summaryOptions{TopAdx: 10, TopLic: 20}
+
+// summaryOpts: as opcións por defecto co índice de provedores do servidor
+func (s *server) summaryOpts() summaryOptions {
+	o := defaultSummaryOptions
+	o.Suppliers = s.suppliers()
+	return o
+}
+
+// summaryFilter: q da linguaxe de consulta e rango de datas (from/to)
+type summaryFilter struct {
+	Q, From, To string
+}
+
+type summaryEngine struct {
+	db   *sql.DB
+	opts summaryOptions
+}
+
+func newSummaryEngine(db *sql.DB, opts summaryOptions) *summaryEngine {
+	if opts.TopAdx <= 0 {
+		opts.TopAdx = defaultSummaryOptions.TopAdx
+	}
+	if opts.TopLic <= 0 {
+		opts.TopLic = defaultSummaryOptions.TopLic
+	}
+	return &summaryEngine{db: db, opts: opts}
+}
+
+// --- resultado ---
+
+// countChart: contas por etiqueta e o desglose por táboa (barras apiladas)
+type countChart struct {
+	Labels []string
+	Counts []int
+	Series []string // táboas que achegan datos, na orde de entrada
+	Stack  [][]int  // [serie][etiqueta]
+}
+
+type amountChart struct {
+	Labels []string
+	Totals []float64
+	Series []string
+	Stack  [][]float64
+}
+
+// monthChart: nº e importe por mes (YYYY-MM da data de publicación)
+type monthChart struct {
+	Labels   []string
+	Counts   []int
+	Importes []float64
+	Series   []string
+	Stack    [][]int // contas [serie][mes]
+}
+
+type topLicItem struct {
+	Table, Expediente, Obxecto, Adx string
+	Importe                         float64
+}
+
+// etiqueta: o obxecto do contrato ou, se non o hai, expediente, adxudicatario ou táboa
+func (it topLicItem) Label() string {
+	label := it.Obxecto
+	for _, s := range []string{it.Expediente, it.Adx, it.Table} {
+		if label == "" {
+			label = s
+		}
+	}
+	if utf8.RuneCountInString(label) > 50 {
+		label = string([]rune(label)[:50]) + "…"
+	}
+	return label
+}
+
+type summaryResult struct {
+	Tables  []string // táboas que entraron no resumo
+	QErr    error    // q non vale para ningunha das táboas
+	SinData int      // filas sen data recoñecible (fóra dos meses e de from/to)
+
+	Tipos    countChart  // nº por tipo
+	Importes amountChart // importe por tipo
+	Adx      countChart  // top adxudicatarios, por provedor
+	AdxIDs   []string    // ID de provedor de cada etiqueta de Adx
+	ConPDF   int         // filas con algún ficheiro
+	Total    int
+	Meses    monthChart
+	Top      []topLicItem // maiores importes
+}
+
+// --- execución ---
+
+// summaryTable: unha táboa xa filtrada, co que precisan as métricas
+type summaryTable struct {
+	name  string
+	src   typedSource
+	where string
+	args  []any
+	roles map[string]string // rol -> columna ("" se non hai)
+	files string            // táboa de ficheiros ("" se non hai)
+}
+
+type summaryMetric func(db *sql.DB, t *summaryTable, acc *summaryAcc) error
+
+var summaryMetrics = []summaryMetric{sumTipos, sumAdx, sumAnexos, sumMeses, sumTop}
+
+// Run agrega as táboas tables filtradas por f. As táboas que non entenden q (un campo que non
+// teñen) quedan fóra; só se ningunha o entende vai o erro en QErr.
+func (e *summaryEngine) Run(tables []string, f summaryFilter) (*summaryResult, error) {
+	acc := newSummaryAcc(e.opts)
+	var qErrs []error
+	for _, name := range tables {
+		cols, err := tableColumns(e.db, name)
+		if err != nil || len(cols) == 0 {
+			continue
+		}
+		flt, err := buildFilter(e.db, name, cols, withDateRange(name, cols, f.Q, f.From, f.To))
+		if err != nil {
+			qErrs = append(qErrs, err)
+			continue
+		}
+		if qf, err := buildFilter(e.db, name, cols, f.Q); err == nil {
+			acc.sinData += countUndated(e.db, name, cols, qf)
+		}
+		t := &summaryTable{
+			name:  name,
+			src:   tableSource(e.db, name, cols),
+			where: flt.Where,
+			args:  flt.Args,
+			roles: tableRoles(name, cols),
+			files: findFilesTable(e.db, name),
+		}
+		for _, m := range summaryMetrics {
+			if err := m(e.db, t, acc); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		acc.tables = append(acc.tables, name)
+	}
+	res := acc.result(e.opts)
+	if len(qErrs) > 0 && len(qErrs) == len(tables) {
+		res.QErr = qErrs[0]
+	}
+	return res, nil
+}
+
+// --- métricas ---
+
+// importe para SUM: 0 se a táboa non ten (SUM(NULL) dá problemas de tipo en Postgres)
+func (t *summaryTable) importeOr0() string {
+	if t.src.Importe == "NULL" {
+		return "0"
+	}
+	return t.src.Importe
+}
+
+// nº e importe por tipo
+func sumTipos(db *sql.DB, t *summaryTable, acc *summaryAcc) error {
+	col := t.roles[roleTipo]
+	if col == "" {
+		return nil
+	}
+	q := fmt.Sprintf(`SELECT %s, COUNT(*), COALESCE(SUM(%s),0) FROM %s %s GROUP BY 1`,
+		tipoKeyExpr(col), t.importeOr0(), t.src.From, t.where)
+	return queryEach(db, q, t.args, func(rows *sql.Rows) error {
+		var k string
+		var n int
+		var imp float64
+		if err := rows.Scan(&k, &n, &imp); err != nil {
+			return err
+		}
+		acc.tipos.add(t.name, k, k, float64(n))
+		if t.roles[roleImporte] != "" {
+			acc.importes.add(t.name, k, k, imp)
+		}
+		return nil
+	})
+}
+
+// adxudicatarios resoltos a provedor (suppliers.go): "CONSTRUCCIONES X, S.L." e
+// "B12345678 - Construcciones X" contan xuntos
+func sumAdx(db *sql.DB, t *summaryTable, acc *summaryAcc) error {
+	col := t.roles[roleAdx]
+	if col == "" {
+		return nil
+	}
+	q := fmt.Sprintf(`SELECT COALESCE(TRIM(CAST(%s AS TEXT)), ''), COUNT(*) FROM %s %s GROUP BY 1`,
+		quoteIdent(col), t.src.From, t.where)
+	return queryEach(db, q, t.args, func(rows *sql.Rows) error {
+		var name string
+		var n int
+		if err := rows.Scan(&name, &n); err != nil {
+			return err
+		}
+		sp := acc.suppliers.resolve(name)
+		acc.adx.add(t.name, sp.ID, sp.Label, float64(n))
+		return nil
+	})
+}
+
+// filas totais e filas cuxo expediente ten ficheiros
+func sumAnexos(db *sql.DB, t *summaryTable, acc *summaryAcc) error {
+	var n int
+	q := fmt.Sprintf(`SELECT COUNT(*) FROM %s %s`, t.src.From, t.where)
+	if err := db.QueryRow(q, t.args...).Scan(&n); err != nil {
+		return err
+	}
+	acc.total += n
+	exp := t.roles[roleExpediente]
+	if t.files == "" || exp == "" {
+		return nil
+	}
+	q = fmt.Sprintf(`SELECT COUNT(*) FROM %s %s`, t.src.From,
+		andWhere(t.where, quoteIdent(exp)+` IN (SELECT "Expediente" FROM `+quoteIdent(t.files)+")"))
+	if err := db.QueryRow(q, t.args...).Scan(&n); err != nil {
+		return err
+	}
+	acc.conPDF += n
+	return nil
+}
+
+// nº e importe por mes de publicación
+func sumMeses(db *sql.DB, t *summaryTable, acc *summaryAcc) error {
+	if t.src.Month == "NULL" {
+		return nil
+	}
+	q := fmt.Sprintf(`SELECT %[1]s, COUNT(*), COALESCE(SUM(%[2]s),0) FROM %[3]s %[4]s GROUP BY 1`,
+		t.src.Month, t.importeOr0(), t.src.From, andWhere(t.where, t.src.Month+" IS NOT NULL"))
+	return queryEach(db, q, t.args, func(rows *sql.Rows) error {
+		var mes string
+		var n int
+		var imp float64
+		if err := rows.Scan(&mes, &n, &imp); err != nil {
+			return err
+		}
+		acc.meses.add(t.name, mes, mes, float64(n))
+		acc.mesesImp.add(t.name, mes, mes, imp)
+		return nil
+	})
+}
+
+// as licitacións de maior importe desta táboa; Run queda coas maiores de todas
+func sumTop(db *sql.DB, t *summaryTable, acc *summaryAcc) error {
+	if t.roles[roleImporte] == "" {
+		return nil
+	}
+	// columnas auxiliares (se non existen, cadea baleira para non romper o Scan)
+	colOrEmpty := func(role string) string {
+		if t.roles[role] == "" {
+			return "''"
+		}
+		return "CAST(" + quoteIdent(t.roles[role]) + " AS TEXT)"
+	}
+	q := fmt.Sprintf(`SELECT %s, %s, %s, %s FROM %s %s ORDER BY 4 DESC LIMIT %d`,
+		colOrEmpty(roleExpediente), colOrEmpty(roleObxecto), colOrEmpty(roleAdx), t.src.Importe,
+		t.src.From, andWhere(t.where, t.src.Importe+" IS NOT NULL"), acc.topLimit)
+	return queryEach(db, q, t.args, func(rows *sql.Rows) error {
+		var exp, obj, adx sql.NullString
+		var imp float64
+		if err := rows.Scan(&exp, &obj, &adx, &imp); err != nil {
+			return err
+		}
+		acc.top = append(acc.top, topLicItem{
+			Table:      t.name,
+			Expediente: strings.TrimSpace(exp.String),
+			Obxecto:    strings.TrimSpace(obj.String),
+			Adx:        strings.TrimSpace(adx.String),
+			Importe:    imp,
+		})
+		return nil
+	})
+}
+
+func queryEach(db *sql.DB, q string, args []any, fn func(*sql.Rows) error) error {
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// --- acumulación ---
+
+// stackAcc suma valores por chave, en total e por táboa
+type stackAcc struct {
+	tables  []string // táboas na orde na que achegan datos
+	byTable map[string]map[string]float64
+	totals  map[string]float64
+	labels  map[string]string // chave -> etiqueta (a primeira vista)
+}
+
+func newStackAcc() *stackAcc {
+	return &stackAcc{byTable: map[string]map[string]float64{}, totals: map[string]float64{}, labels: map[string]string{}}
+}
+
+func (a *stackAcc) add(table, key, label string, v float64) {
+	m, ok := a.byTable[table]
+	if !ok {
+		m = map[string]float64{}
+		a.byTable[table] = m
+		a.tables = append(a.tables, table)
+	}
+	m[key] += v
+	a.totals[key] += v
+	if _, ok := a.labels[key]; !ok {
+		a.labels[key] = label
+	}
+}
+
+// keys: chaves de maior a menor valor (byValue) ou por orde alfabética; limit 0 = todas
+func (a *stackAcc) keys(byValue bool, limit int) []string {
+	keys := make([]string, 0, len(a.totals))
+	for k := range a.totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if byValue && a.totals[keys[i]] != a.totals[keys[j]] {
+			return a.totals[keys[i]] > a.totals[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+func (a *stackAcc) countChart(keys []string) countChart {
+	ch := countChart{Labels: []string{}, Counts: []int{}, Series: []string{}, Stack: [][]int{}}
+	for _, k := range keys {
+		ch.Labels = append(ch.Labels, a.labels[k])
+		ch.Counts = append(ch.Counts, int(a.totals[k]))
+	}
+	for _, t := range a.tables {
+		row := make([]int, len(keys))
+		for i, k := range keys {
+			row[i] = int(a.byTable[t][k])
+		}
+		ch.Series = append(ch.Series, t)
+		ch.Stack = append(ch.Stack, row)
+	}
+	return ch
+}
+
+func (a *stackAcc) amountChart(keys []string) amountChart {
+	ch := amountChart{Labels: []string{}, Totals: []float64{}, Series: []string{}, Stack: [][]float64{}}
+	for _, k := range keys {
+		ch.Labels = append(ch.Labels, a.labels[k])
+		ch.Totals = append(ch.Totals, a.totals[k])
+	}
+	for _, t := range a.tables {
+		row := make([]float64, len(keys))
+		for i, k := range keys {
+			row[i] = a.byTable[t][k]
+		}
+		ch.Series = append(ch.Series, t)
+		ch.Stack = append(ch.Stack, row)
+	}
+	return ch
+}
+
+type summaryAcc struct {
+	tables                 []string
+	sinData, conPDF, total int
+	tipos, importes, adx   *stackAcc
+	meses, mesesImp        *stackAcc
+	top                    []topLicItem
+	topLimit               int
+	suppliers              *supplierIndex
+}
+
+func newSummaryAcc(opts summaryOptions) *summaryAcc {
+	return &summaryAcc{
+		tipos: newStackAcc(), importes: newStackAcc(), adx: newStackAcc(),
+		meses: newStackAcc(), mesesImp: newStackAcc(),
+		topLimit: opts.TopLic, suppliers: opts.Suppliers,
+	}
+}
+
+func (acc *summaryAcc) result(opts summaryOptions) *summaryResult {
+	res := &summaryResult{
+		Tables:  append([]string{}, acc.tables...),
+		SinData: acc.sinData,
+		ConPDF:  acc.conPDF,
+		Total:   acc.total,
+	}
+	res.Tipos = acc.tipos.countChart(acc.tipos.keys(true, 0))
+	res.Importes = acc.importes.amountChart(acc.importes.keys(true, 0))
+	adx := acc.adx.keys(true, opts.TopAdx)
+	res.Adx, res.AdxIDs = acc.adx.countChart(adx), adx
+
+	meses := acc.meses.keys(false, 0)
+	mc := acc.meses.countChart(meses)
+	res.Meses = monthChart{Labels: mc.Labels, Counts: mc.Counts, Importes: acc.mesesImp.amountChart(meses).Totals, Series: mc.Series, Stack: mc.Stack}
+
+	sort.SliceStable(acc.top, func(i, j int) bool { return acc.top[i].Importe > acc.top[j].Importe })
+	if len(acc.top) > opts.TopLic {
+		acc.top = acc.top[:opts.TopLic]
+	}
+	res.Top = append([]topLicItem{}, acc.top...)
+	return res
+}
+
+// --- presentación ---
+
+// summaryField: unha serie do resultado co seu nome no JSON e no template
+type summaryField struct {
+	json, tpl string
+	v         any
+}
+
+// fields: as series que pintan os templates e devolven /api/summary e /api/summary_all
+// (base: prefixo do concello para as ligazóns do top)
+func (res *summaryResult) fields(base string) []summaryField {
+	top := struct {
+		labels, urls, objects []string
+		amounts               []float64
+	}{[]string{}, []string{}, []string{}, []float64{}}
+	for _, it := range res.Top {
+		u := ""
+		if it.Expediente != "" {
+			u = base + "/table/" + it.Table + "?q=" + url.QueryEscape(it.Expediente)
+		}
+		top.labels = append(top.labels, it.Label())
+		top.amounts = append(top.amounts, it.Importe)
+		top.urls = append(top.urls, u)
+		top.objects = append(top.objects, it.Obxecto)
+	}
+	return []summaryField{
+		{"tiposLabels", "TiposLabels", res.Tipos.Labels},
+		{"tiposCounts", "TiposCounts", res.Tipos.Counts},
+		{"tiposSeries", "TiposSeries", res.Tipos.Series},
+		{"tiposCountsStack", "TiposCountsStack", res.Tipos.Stack},
+		{"impLabels", "ImpLabels", res.Importes.Labels},
+		{"impTotals", "ImpTotals", res.Importes.Totals},
+		{"impSeries", "ImpSeries", res.Importes.Series},
+		{"impTotalsStack", "ImpTotalsStack", res.Importes.Stack},
+		{"adxLabels", "AdxLabels", res.Adx.Labels},
+		{"adxCounts", "AdxCounts", res.Adx.Counts},
+		{"adxIds", "AdxIDs", res.AdxIDs},
+		{"adxSeries", "AdxSeries", res.Adx.Series},
+		{"adxCountsStack", "AdxCountsStack", res.Adx.Stack},
+		{"anexosLabels", "AnexosLabels", []string{"Con PDF", "Sen PDF"}},
+		{"anexosCounts", "AnexosCounts", []int{res.ConPDF, res.Total - res.ConPDF}},
+		{"adxMesLabels", "AdxMesLabels", res.Meses.Labels},
+		{"adxMesCounts", "AdxMesCounts", res.Meses.Counts},
+		{"adxMesImportes", "AdxMesImportes", res.Meses.Importes},
+		{"adxMesSeries", "AdxMesSeries", res.Meses.Series},
+		{"adxMesCountsStack", "AdxMesCountsStack", res.Meses.Stack},
+		{"topLicLabels", "TopLicLabels", top.labels},
+		{"topLicAmounts", "TopLicAmounts", top.amounts},
+		{"topLicUrls", "TopLicURLs", top.urls},
+		{"topLicObjects", "TopLicObjects", top.objects},
+	}
+}
+
+// jsonData: mapa para a API (engádense q, from, to...)
+func (res *summaryResult) jsonData(base string) map[string]any {
+	out := map[string]any{"sinData": res.SinData}
+	for _, f := range res.fields(base) {
+		out[f.json] = f.v
+	}
+	return out
+}
+
+// templateData: as mesmas series xa en JSON para os <script> dos templates
+func (res *summaryResult) templateData(base string) map[string]any {
+	out := map[string]any{"SinData": res.SinData}
+	for _, f := range res.fields(base) {
+		b, _ := json.Marshal(f.v)
+		out[f.tpl] = template.JS(b)
+	}
+	return out
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==== Provedores (resolución de adxudicatarios) ====
+// O mesmo adxudicatario aparece escrito de moitas maneiras: "CONSTRUCCIONES X, S.L.",
+// "Construcciones X SL", "B12345678 - Construcciones X"... Para agregalos resolvemos cada
+// texto a un provedor:
+//
+//  1. o NIF/CIF/NIE que vaia no texto (B12345678, 12345678Z, X1234567L)
+//  2. o nome sen acentos, puntuación, NIF nin forma xurídica (S.L., S.A.U., Sociedade Limitada...)
+//  3. nomes case iguais (erros ao teclear) xúntanse por semellanza, se non teñen NIFs distintos
+//
+// O índice constrúese coa primeira consulta que o precisa, cos adxudicatarios de todos os
+// concellos (o mesmo provedor traballa para varios). Os erros corríxense cun ficheiro
+// (--suppliers suppliers.json):
+//
+//	{
+//	  "merge": [["B12345678", "Construcións Xerais do Barbanza"]],
+//	  "split": ["Construcciones XY SL"]
+//	}
+//
+// merge: cada lista é un só provedor (NIFs ou nomes); split: nomes que nunca se xuntan con
+// outros por NIF nin por semellanza (as variantes do mesmo nome si).
+
+type supplier struct {
+	ID    string         `json:"id"`    // NIF se o hai; se non, o nome normalizado con guións
+	Label string         `json:"label"` // o texto máis frecuente
+	NIF   string         `json:"nif,omitempty"`
+	Count int            `json:"count"` // filas en todos os concellos
+	Names []supplierName `json:"names"` // textos que se resolven a este provedor
+}
+
+type supplierName struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type supplierOverrides struct {
+	Merge [][]string `json:"merge"`
+	Split []string   `json:"split"`
+}
+
+// correccións en uso (--suppliers)
+var supplierRules supplierOverrides
+
+// loadSupplierOverrides le o ficheiro de correccións
+func loadSupplierOverrides(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var o supplierOverrides
+	if err := json.Unmarshal(b, &o); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for i, g := range o.Merge {
+		if len(g) < 2 {
+			return fmt.Errorf("%s: merge %d: fan falta polo menos dous nomes ou NIFs", file, i+1)
+		}
+	}
+	supplierRules = o
+	return nil
+}
+
+// --- NIF e nome normalizado ---
+
+var (
+	// CIF (letra, 7 díxitos e control), DNI (8 díxitos e letra) e NIE (X/Y/Z, 7 díxitos e letra),
+	// con ou sen guión/espazo; o texto xa vén en maiúsculas
+	cifRe = regexp.MustCompile(`\b([ABCDEFGHJNPQRSUVW])[- ]?(\d{7})[- ]?([0-9A-J])\b`)
+	dniRe = regexp.MustCompile(`\b(\d{8})[- ]?([A-Z])\b`)
+	nieRe = regexp.MustCompile(`\b([XYZ])[- ]?(\d{7})[- ]?([A-Z])\b`)
+)
+
+const dniLetters = "TRWAGMYFPDXBNJZSQVHLCKE"
+
+// extractNIF devolve o primeiro NIF do texto, sen separadores ("" se non hai).
+// DNI e NIE compróbanse coa letra; do CIF só o formato, que o control vén mal a miúdo.
+func extractNIF(s string) string {
+	up := strings.ToUpper(asciiFold(s))
+	if m := nieRe.FindStringSubmatch(up); m != nil {
+		// o NIE compróbase coma un DNI con X=0, Y=1, Z=2 diante
+		n, _ := strconv.Atoi(strconv.Itoa(strings.Index("XYZ", m[1])) + m[2])
+		if dniLetters[n%23] == m[3][0] {
+			return m[1] + m[2] + m[3]
+		}
+	}
+	if m := dniRe.FindStringSubmatch(up); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if dniLetters[n%23] == m[2][0] {
+			return m[1] + m[2]
+		}
+	}
+	if m := cifRe.FindStringSubmatch(up); m != nil {
+		return m[1] + m[2] + m[3]
+	}
+	return ""
+}
+
+// formas xurídicas ao final do nome (xa sen puntos: "S.L." -> "sl", "S. L." -> "s l")
+var legalForms = [][]string{
+	{"sociedad", "limitada", "unipersonal"}, {"sociedade", "limitada", "unipersonal"},
+	{"sociedad", "limitada", "laboral"}, {"sociedade", "limitada", "laboral"},
+	{"sociedad", "limitada"}, {"sociedade", "limitada"},
+	{"sociedad", "anonima", "unipersonal"}, {"sociedade", "anonima", "unipersonal"},
+	{"sociedad", "anonima"}, {"sociedade", "anonima"},
+	{"sociedad", "cooperativa", "galega"}, {"sociedade", "cooperativa", "galega"},
+	{"sociedad", "cooperativa"}, {"sociedade", "cooperativa"},
+	{"comunidad", "de", "bienes"}, {"comunidade", "de", "bens"},
+	{"s", "l", "u"}, {"s", "l", "l"}, {"s", "l", "p"}, {"s", "l"}, {"s", "a", "u"}, {"s", "a"},
+	{"s", "coop", "g"}, {"s", "coop"}, {"c", "b"},
+	{"slu"}, {"sll"}, {"slp"}, {"slne"}, {"sl"}, {"sau"}, {"sa"}, {"srl"},
+	{"scoopg"}, {"scoop"}, {"coop"}, {"scg"}, {"sc"}, {"cb"},
+}
+
+// supplierNorm: nome sen acentos, NIF, puntuación nin forma xurídica ("construcciones x")
+func supplierNorm(s string) string {
+	up := strings.ToUpper(asciiFold(s))
+	for _, re := range []*regexp.Regexp{cifRe, dniRe, nieRe} {
+		up = re.ReplaceAllString(up, " ")
+	}
+	low := strings.ReplaceAll(strings.ToLower(up), ".", "")
+	low = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return ' '
+	}, low)
+	toks := strings.Fields(low)
+	for trimmed := true; trimmed && len(toks) > 1; {
+		trimmed = false
+		for _, lf := range legalForms {
+			if len(lf) < len(toks) && equalTokens(toks[len(toks)-len(lf):], lf) {
+				toks = toks[:len(toks)-len(lf)]
+				trimmed = true
+				break
+			}
+		}
+	}
+	return strings.Join(toks, " ")
+}
+
+func equalTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// --- semellanza ---
+
+// nomes tan parecidos coma "construcciones x" e "construccions x": Levenshtein sobre a lonxitude,
+// só para nomes longos e cos mesmos números ("obras 1" e "obras 2" son distintos)
+const supplierSimilarity = 0.9
+
+var digitsRe = regexp.MustCompile(`\d+`)
+
+func similarSupplierNames(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < 8 || len(rb) < 8 {
+		return false
+	}
+	if strings.Join(digitsRe.FindAllString(a, -1), " ") != strings.Join(digitsRe.FindAllString(b, -1), " ") {
+		return false
+	}
+	n := max(len(ra), len(rb))
+	if float64(n-abs(len(ra)-len(rb))) < supplierSimilarity*float64(n) {
+		return false // só coa diferenza de lonxitude xa non chega
+	}
+	return 1-float64(levenshtein(ra, rb))/float64(n) >= supplierSimilarity
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// --- índice ---
+
+type supplierIndex struct {
+	byKey  map[string]*supplier // adxNormKey(texto) -> provedor
+	byNorm map[string]*supplier
+	byNIF  map[string]*supplier
+	list   []*supplier // de máis a menos filas
+}
+
+// nodo: cada texto distinto (adxNormKey) cos seus textos orixinais e filas
+type supplierNode struct {
+	key, norm, nif string
+	raw            map[string]int
+	count          int
+}
+
+// buildSupplierIndex le os adxudicatarios de todas as táboas base dos concellos e agrúpaos
+func buildSupplierIndex(cs []*concelloDB) *supplierIndex {
+	start := time.Now()
+	nodes := map[string]*supplierNode{}
+	for _, c := range cs {
+		bases, err := listBaseTables(c.DB)
+		if err != nil {
+			continue
+		}
+		for _, t := range bases {
+			cols, err := tableColumns(c.DB, t)
+			if err != nil {
+				continue
+			}
+			col := roleColumn(t, cols, roleAdx)
+			if col == "" {
+				continue
+			}
+			q := fmt.Sprintf(`SELECT TRIM(CAST(%[1]s AS TEXT)), COUNT(*) FROM %[2]s WHERE %[1]s IS NOT NULL GROUP BY 1`,
+				quoteIdent(col), quoteIdent(t))
+			err = queryEach(c.DB, q, nil, func(rows *sql.Rows) error {
+				var raw string
+				var n int
+				if err := rows.Scan(&raw, &n); err != nil {
+					return err
+				}
+				key := adxNormKey(raw)
+				if key == "" {
+					return nil
+				}
+				nd, ok := nodes[key]
+				if !ok {
+					nd = &supplierNode{key: key, norm: supplierNorm(raw), nif: extractNIF(raw), raw: map[string]int{}}
+					nodes[key] = nd
+				}
+				nd.raw[raw] += n
+				nd.count += n
+				return nil
+			})
+			if err != nil {
+				log.Printf("WARN: provedores: %s/%s: %v", c.Name, t, err)
+			}
+		}
+	}
+	ix := groupSuppliers(nodes, supplierRules)
+	log.Printf("provedores: %d textos de adxudicatario en %d provedores (%s)", len(nodes), len(ix.list), time.Since(start).Round(time.Millisecond))
+	return ix
+}
+
+// groupSuppliers xunta os nodos (union-find) e fai un provedor por grupo
+func groupSuppliers(nodes map[string]*supplierNode, o supplierOverrides) *supplierIndex {
+	keys := make([]string, 0, len(nodes))
+	for k := range nodes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	idx := make(map[string]int, len(keys))
+	for i, k := range keys {
+		idx[k] = i
+	}
+
+	parent := make([]int, len(keys))
+	nif := make([]string, len(keys)) // NIF de cada raíz
+	for i, k := range keys {
+		parent[i] = i
+		nif[i] = nodes[k].nif
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	// force: as correccións do ficheiro xuntan aínda que os NIFs sexan distintos
+	union := func(a, b int, force bool) {
+		ra, rb := find(a), find(b)
+		if ra == rb {
+			return
+		}
+		if !force && nif[ra] != "" && nif[rb] != "" && nif[ra] != nif[rb] {
+			return
+		}
+		if rb < ra {
+			ra, rb = rb, ra
+		}
+		parent[rb] = ra
+		if nif[ra] == "" {
+			nif[ra] = nif[rb]
+		}
+	}
+
+	split := map[string]bool{}
+	for _, s := range o.Split {
+		split[supplierNorm(s)] = true
+	}
+
+	// 1) mesmo nome normalizado; 2) mesmo NIF
+	byNorm := map[string]int{}
+	byNIF := map[string]int{}
+	for i, k := range keys {
+		nd := nodes[k]
+		if nd.norm != "" {
+			if j, ok := byNorm[nd.norm]; ok {
+				union(j, i, false)
+			} else {
+				byNorm[nd.norm] = i
+			}
+		}
+		if nd.nif != "" && !split[nd.norm] {
+			if j, ok := byNIF[nd.nif]; ok {
+				union(j, i, false)
+			} else {
+				byNIF[nd.nif] = i
+			}
+		}
+	}
+
+	// 3) semellanza entre nomes normalizados distintos, por bloques coas tres primeiras letras
+	blocks := map[string][]string{}
+	for n := range byNorm {
+		if split[n] {
+			continue
+		}
+		r := []rune(n)
+		blocks[string(r[:min(3, len(r))])] = append(blocks[string(r[:min(3, len(r))])], n)
+	}
+	for _, b := range blocks {
+		sort.Strings(b)
+		for i := range b {
+			for j := i + 1; j < len(b); j++ {
+				if similarSupplierNames(b[i], b[j]) {
+					union(byNorm[b[i]], byNorm[b[j]], false)
+				}
+			}
+		}
+	}
+
+	// 4) correccións: cada lista de merge é un provedor
+	for _, g := range o.Merge {
+		first := -1
+		for _, name := range g {
+			var hits []int
+			if n := extractNIF(name); n != "" && supplierNorm(name) == "" {
+				for i, k := range keys {
+					if nodes[k].nif == n {
+						hits = append(hits, i)
+					}
+				}
+			} else if i, ok := byNorm[supplierNorm(name)]; ok {
+				hits = append(hits, i)
+			}
+			if len(hits) == 0 {
+				log.Printf("WARN: provedores: merge: %q non aparece en ningún adxudicatario", name)
+			}
+			for _, i := range hits {
+				if first < 0 {
+					first = i
+				}
+				union(first, i, true)
+			}
+		}
+	}
+
+	// un provedor por raíz
+	groups := map[int][]*supplierNode{}
+	var roots []int
+	for i, k := range keys {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], nodes[k])
+	}
+	ix := &supplierIndex{byKey: map[string]*supplier{}, byNorm: map[string]*supplier{}, byNIF: map[string]*supplier{}}
+	ids := map[string]bool{}
+	for _, r := range roots {
+		sp := newSupplier(groups[r], nif[r])
+		for base, n := sp.ID, 2; ids[sp.ID]; n++ {
+			sp.ID = fmt.Sprintf("%s-%d", base, n)
+		}
+		ids[sp.ID] = true
+		for _, nd := range groups[r] {
+			ix.byKey[nd.key] = sp
+			if nd.norm != "" {
+				if _, ok := ix.byNorm[nd.norm]; !ok {
+					ix.byNorm[nd.norm] = sp
+				}
+			}
+			if nd.nif != "" {
+				if _, ok := ix.byNIF[nd.nif]; !ok {
+					ix.byNIF[nd.nif] = sp
+				}
+			}
+		}
+		ix.list = append(ix.list, sp)
+	}
+	sort.SliceStable(ix.list, func(i, j int) bool { return ix.list[i].Count > ix.list[j].Count })
+	return ix
+}
+
+func newSupplier(nodes []*supplierNode, nif string) *supplier {
+	sp := &supplier{NIF: nif}
+	var best *supplierNode
+	for _, nd := range nodes {
+		sp.Count += nd.count
+		for raw, n := range nd.raw {
+			sp.Names = append(sp.Names, supplierName{Name: raw, Count: n})
+		}
+		if best == nil || nd.count > best.count || (nd.count == best.count && nd.key < best.key) {
+			best = nd
+		}
+	}
+	sort.Slice(sp.Names, func(i, j int) bool {
+		if sp.Names[i].Count != sp.Names[j].Count {
+			return sp.Names[i].Count > sp.Names[j].Count
+		}
+		return sp.Names[i].Name < sp.Names[j].Name
+	})
+	sp.Label = sp.Names[0].Name
+	sp.ID = supplierID(best.norm, nif)
+	return sp
+}
+
+func supplierID(norm, nif string) string {
+	if nif != "" {
+		return nif
+	}
+	return strings.ReplaceAll(norm, " ", "-")
+}
+
+// resolve devolve o provedor dun texto de adxudicatario. Os textos que non estaban no índice
+// (ou sen índice) resólvense polo NIF e o nome normalizado, sen semellanza.
+func (ix *supplierIndex) resolve(name string) *supplier {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return &supplier{Label: "(Sen adxudicatario)"}
+	}
+	norm, nif := supplierNorm(name), extractNIF(name)
+	if ix != nil {
+		if sp, ok := ix.byKey[adxNormKey(name)]; ok {
+			return sp
+		}
+		if sp, ok := ix.byNIF[nif]; ok && nif != "" {
+			return sp
+		}
+		if sp, ok := ix.byNorm[norm]; ok && norm != "" {
+			return sp
+		}
+	}
+	id := supplierID(norm, nif)
+	if id == "" {
+		id = adxNormKey(name)
+	}
+	return &supplier{ID: id, Label: name, NIF: nif}
+}
+
+// suppliers: o índice de provedores, construído coa primeira petición que o precisa e de
+// novo despois de que watchDBs vise que cambiou algún .db
+func (s *server) suppliers() *supplierIndex {
+	s.supMu.Lock()
+	defer s.supMu.Unlock()
+	if s.sup == nil || s.supStale {
+		s.sup, s.supStale = buildSupplierIndex(s.reg.list), false
+	}
+	return s.sup
+}
+
+// invalidateSuppliers: o índice vólvese construír na seguinte petición
+func (s *server) invalidateSuppliers() {
+	s.supMu.Lock()
+	s.supStale = true
+	s.supMu.Unlock()
+}
+
+// ==== /api/suppliers: provedores resoltos e os textos de cada un ====
+// ?multi=1: só os que xuntan máis dun texto (os que convén revisar)
+
+func (s *server) handleAPISuppliers(w http.ResponseWriter, r *http.Request) {
+	multi := r.URL.Query().Get("multi") != ""
+	out := []*supplier{}
+	for _, sp := range s.suppliers().list {
+		if !multi || len(sp.Names) > 1 {
+			out = append(out, sp)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"suppliers": out, "overrides": supplierRules})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestExtractNIF(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"CONSTRUCCIONES X, S.L. B12345678", "B12345678"},
+		{"Construcciones X (CIF: b-1234567-8)", "B12345678"},
+		{"A 1234567 J obras", "A1234567J"},
+		{"Pérez López, Xoán 12345678Z", "12345678Z"},
+		{"12345678-Z", "12345678Z"},
+		{"12345678A", ""}, // letra do DNI mal
+		{"X1234567L", "X1234567L"},
+		{"Y-1234567-X", "Y1234567X"},
+		{"X1234567A", ""}, // letra do NIE mal
+		{"CONSTRUCCIONES X SL", ""},
+		{"Expediente 2024/001", ""},
+		{"I1234567A", ""}, // I non é letra de CIF
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := extractNIF(tt.in); got != tt.want {
+			t.Errorf("extractNIF(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSupplierNorm(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"CONSTRUCCIONES X, S.L.", "construcciones x"},
+		{"Construcciones X SL", "construcciones x"},
+		{"Construcciones X, S. L. U.", "construcciones x"},
+		{"CONSTRUCCIÓNS XERAIS DO BARBANZA SOCIEDADE LIMITADA UNIPERSONAL", "construccions xerais do barbanza"},
+		{"Papelería Y Sociedad Anónima", "papeleria y"},
+		{"Obras Norte, S.A. B12345678", "obras norte"},
+		{"Cooperativa Leiteira S. Coop. G.", "cooperativa leiteira"},
+		{"Irmáns Pérez C.B.", "irmans perez"},
+		{"Comunidad de Bienes Pérez", "comunidad de bienes perez"},
+		{"Reformas SL SL", "reformas"},
+		{"S.L.", "sl"}, // a forma soa non se quita
+		{"SL", "sl"},
+		{"Pérez López, Xoán 12345678Z", "perez lopez xoan"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := supplierNorm(tt.in); got != tt.want {
+			t.Errorf("supplierNorm(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"abc", "abc", 0},
+		{"kitten", "sitting", 3},
+		{"construcciones", "construccions", 1},
+		{"xoán", "xoan", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarSupplierNames(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"construcciones xerais", "construccions xerais", true},
+		{"construcciones xerais", "construcciones xerais", true},
+		{"obras 1 galicia", "obras 2 galicia", false}, // números distintos
+		{"obras ab", "obras ac", false},               // curtos
+		{"construcciones xerais", "construcciones lugo", false},
+		{"reformas do norte sl", "reformas do norte", false}, // o 10 % son 2 letras
+	}
+	for _, tt := range tests {
+		if got := similarSupplierNames(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarSupplierNames(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// supplierNodes fai os nodos coma buildSupplierIndex, unha fila por texto
+func supplierNodes(names ...string) map[string]*supplierNode {
+	nodes := map[string]*supplierNode{}
+	for _, raw := range names {
+		key := adxNormKey(raw)
+		nd, ok := nodes[key]
+		if !ok {
+			nd = &supplierNode{key: key, norm: supplierNorm(raw), nif: extractNIF(raw), raw: map[string]int{}}
+			nodes[key] = nd
+		}
+		nd.raw[raw]++
+		nd.count++
+	}
+	return nodes
+}
+
+func TestGroupSuppliers(t *testing.T) {
+	names := []string{
+		"CONSTRUCCIONES X, S.L.",
+		"Construcciones X SL",
+		"construcciones x sl",
+		"CONSTRUCCIONES XERAIS SL",
+		"CONSTRUCCIONS XERAIS S.L.",
+		"OBRAS NORTE SL B12345678",
+		"Norte Obras B-12345678",
+		"PINTURAS SUR SL B11111111",
+		"PINTURAS SUR SL B22222222",
+		"REFORMAS LUGO",
+		"Reformas Ourense SL",
+		"Electricidade Rial SL",
+		"Electricidade Riai SL",
+	}
+	type pair struct {
+		a, b string
+		same bool
+	}
+	tests := []struct {
+		name  string
+		o     supplierOverrides
+		pairs []pair
+	}{
+		{"sen correccións", supplierOverrides{}, []pair{
+			{"CONSTRUCCIONES X, S.L.", "Construcciones X SL", true},           // mesmo nome normalizado
+			{"CONSTRUCCIONES X, S.L.", "construcciones x sl", true},           // mesmo texto sen maiúsculas
+			{"CONSTRUCCIONES XERAIS SL", "CONSTRUCCIONS XERAIS S.L.", true},   // semellanza
+			{"OBRAS NORTE SL B12345678", "Norte Obras B-12345678", true},      // mesmo NIF
+			{"PINTURAS SUR SL B11111111", "PINTURAS SUR SL B22222222", false}, // NIFs distintos
+			{"CONSTRUCCIONES X, S.L.", "CONSTRUCCIONES XERAIS SL", false},
+			{"REFORMAS LUGO", "Norte Obras B-12345678", false},
+			{"Electricidade Rial SL", "Electricidade Riai SL", true},
+		}},
+		{"merge e split", supplierOverrides{
+			Merge: [][]string{{"B12345678", "Reformas Lugo"}, {"Reformas Ourense", "Construcciones X"}},
+			Split: []string{"Electricidade Rial SL", "Construcciones Xerais"},
+		}, []pair{
+			{"REFORMAS LUGO", "OBRAS NORTE SL B12345678", true},
+			{"REFORMAS LUGO", "Norte Obras B-12345678", true},
+			{"Reformas Ourense SL", "Construcciones X SL", true},
+			{"Electricidade Rial SL", "Electricidade Riai SL", false},
+			{"CONSTRUCCIONES XERAIS SL", "CONSTRUCCIONS XERAIS S.L.", false},
+			{"CONSTRUCCIONES X, S.L.", "Construcciones X SL", true}, // o split non separa variantes do mesmo nome
+			{"PINTURAS SUR SL B11111111", "PINTURAS SUR SL B22222222", false},
+		}},
+		{"merge forza NIFs distintos", supplierOverrides{
+			Merge: [][]string{{"B11111111", "B22222222"}},
+		}, []pair{
+			{"PINTURAS SUR SL B11111111", "PINTURAS SUR SL B22222222", true},
+		}},
+	}
+	for _, tt := range tests {
+		ix := groupSuppliers(supplierNodes(names...), tt.o)
+		total := 0
+		for _, sp := range ix.list {
+			total += sp.Count
+		}
+		if total != len(names) {
+			t.Errorf("%s: %d filas nos provedores, want %d", tt.name, total, len(names))
+		}
+		for _, p := range tt.pairs {
+			a, b := ix.resolve(p.a), ix.resolve(p.b)
+			if (a == b) != p.same {
+				t.Errorf("%s: %q (%s) e %q (%s): same = %v, want %v", tt.name, p.a, a.ID, p.b, b.ID, a == b, p.same)
+			}
+		}
+	}
+}
+
+func TestGroupSuppliersIDs(t *testing.T) {
+	ix := groupSuppliers(supplierNodes("OBRAS NORTE SL B12345678", "Obras Norte SL", "Obras Norte SL", "Reformas Lugo"), supplierOverrides{})
+	tests := []struct {
+		name, id, label, nif string
+		count                int
+	}{
+		{"Obras Norte SL", "B12345678", "Obras Norte SL", "B12345678", 3},
+		{"Reformas Lugo", "reformas-lugo", "Reformas Lugo", "", 1},
+		// un texto que non estaba no índice resólvese polo nome normalizado ou o NIF
+		{"OBRAS NORTE, S.A.", "B12345678", "Obras Norte SL", "B12345678", 3},
+		{"Outra B12345678", "B12345678", "Obras Norte SL", "B12345678", 3},
+		{"Descoñecida SL", "desconecida", "Descoñecida SL", "", 0},
+		{"", "", "(Sen adxudicatario)", "", 0},
+	}
+	for _, tt := range tests {
+		sp := ix.resolve(tt.name)
+		if sp.ID != tt.id || sp.Label != tt.label || sp.NIF != tt.nif || sp.Count != tt.count {
+			t.Errorf("resolve(%q) = %s %q %s %d, want %s %q %s %d", tt.name, sp.ID, sp.Label, sp.NIF, sp.Count, tt.id, tt.label, tt.nif, tt.count)
+		}
+	}
+}
+
+// cando cambia un .db (a tarefa "provedores" de watchDBs) o índice constrúese de novo
+func TestSuppliersRebuild(t *testing.T) {
+	path := writeTestDB(t)
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := &concelloDB{Slug: "proba", DBPath: path, DB: db}
+	s := &server{reg: &registry{list: []*concelloDB{c}, bySlug: map[string]*concelloDB{"proba": c}}}
+
+	if sp := s.suppliers().resolve("CONSTRUCCIONES X SL"); sp.NIF != "" || sp.Count != 2 {
+		t.Fatalf("antes: %+v", sp)
+	}
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec(`INSERT INTO Alcaldia_contratos_menores VALUES ('2024/005', 'Pintura', 'Obras', '900,00', 'Construcciones X SL B12345678', NULL)`)
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sen aviso segue o índice vello
+	if sp := s.suppliers().resolve("CONSTRUCCIONES X SL"); sp.NIF != "" {
+		t.Errorf("sen reconstruír: NIF %q", sp.NIF)
+	}
+	for _, task := range s.watchTasks() {
+		if task.name == "provedores" {
+			if err := task.run(c, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sp := s.suppliers().resolve("CONSTRUCCIONES X SL")
+	if sp.NIF != "B12345678" || sp.Count != 3 || s.suppliers().resolve("Construcciones X SL B12345678") != sp {
+		t.Errorf("despois: %+v, want B12345678 con 3 filas", sp)
+	}
+}
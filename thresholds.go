@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ==== Limiares legais ====
+// Os límites de contratación (contrato menor, SARA...) cambian co tempo e co tipo de contrato,
+// así que van como datos: un conxunto de regras con versión, cada unha coa súa vixencia.
+// As por defecto están abaixo; --thresholds limiares.json substitúeas enteiras:
+//
+//	{
+//	  "version": "2024",
+//	  "near": 0.95,
+//	  "iva": 0.21,
+//	  "rules": [
+//	    {"id": "menor_obras", "name": "Contrato menor de obras", "kind": "menor", "match": "*_contratos_menores",
+//	     "tipos": ["obras"], "importe": 40000, "desde": "2018-03-09"}
+//	  ]
+//	}
+//
+// Cada fila queda, para cada regra en vigor na súa data, "dentro", "preto" (entre near e o
+// límite) ou "supera" (no límite ou por riba). Os límites da LCSP son sen IVE ("ive": false);
+// se a columna de importe é con IVE (Importe_con_iva...) quítase antes de comparar.
+
+type thresholdRule struct {
+	ID      string   `json:"id"` // o mesmo id en varias versións do límite (cambia só a vixencia)
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind,omitempty"`  // "menor", "sara"...
+	Match   string   `json:"match,omitempty"` // patrón de táboa (path.Match); "" = todas
+	Tipos   []string `json:"tipos,omitempty"` // obras, servizos, subministros; baleiro = todos
+	Importe float64  `json:"importe"`
+	IVE     bool     `json:"ive,omitempty"`   // o límite inclúe IVE
+	Desde   string   `json:"desde,omitempty"` // AAAA-MM-DD, incluído
+	Ata     string   `json:"ata,omitempty"`   // AAAA-MM-DD, incluído
+}
+
+type thresholdSet struct {
+	Version string          `json:"version"`
+	Near    float64         `json:"near"`          // "preto" dende esta fracción do límite
+	IVA     float64         `json:"iva"`           // tipo xeral para pasar de con IVE a sen IVE
+	ConIVE  bool            `json:"importeConIVE"` // columnas "Importe" a secas: con IVE?
+	Rules   []thresholdRule `json:"rules"`
+}
+
+var defaultThresholds = thresholdSet{
+	Version: "lcsp-2024",
+	Near:    0.95,
+	IVA:     0.21,
+	Rules: []thresholdRule{
+		// contrato menor: TRLCSP ata o 8/3/2018, LCSP (art. 118) despois
+		{ID: "menor_obras", Name: "Contrato menor de obras", Kind: "menor", Match: "*_contratos_menores", Tipos: []string{"obras"}, Importe: 50000, Ata: "2018-03-08"},
+		{ID: "menor_obras", Name: "Contrato menor de obras", Kind: "menor", Match: "*_contratos_menores", Tipos: []string{"obras"}, Importe: 40000, Desde: "2018-03-09"},
+		{ID: "menor_servizos", Name: "Contrato menor de servizos e subministros", Kind: "menor", Match: "*_contratos_menores", Tipos: []string{"servizos", "subministros"}, Importe: 18000, Ata: "2018-03-08"},
+		{ID: "menor_servizos", Name: "Contrato menor de servizos e subministros", Kind: "menor", Match: "*_contratos_menores", Tipos: []string{"servizos", "subministros"}, Importe: 15000, Desde: "2018-03-09"},
+
+		// regulación harmonizada (SARA), entidades locais; revísanse cada dous anos
+		{ID: "sara_obras", Name: "Obras SARA", Kind: "sara", Tipos: []string{"obras"}, Importe: 5548000, Desde: "2018-01-01", Ata: "2019-12-31"},
+		{ID: "sara_obras", Name: "Obras SARA", Kind: "sara", Tipos: []string{"obras"}, Importe: 5350000, Desde: "2020-01-01", Ata: "2021-12-31"},
+		{ID: "sara_obras", Name: "Obras SARA", Kind: "sara", Tipos: []string{"obras"}, Importe: 5382000, Desde: "2022-01-01", Ata: "2023-12-31"},
+		{ID: "sara_obras", Name: "Obras SARA", Kind: "sara", Tipos: []string{"obras"}, Importe: 5538000, Desde: "2024-01-01"},
+		{ID: "sara_servizos", Name: "Servizos e subministros SARA", Kind: "sara", Tipos: []string{"servizos", "subministros"}, Importe: 221000, Desde: "2018-01-01", Ata: "2019-12-31"},
+		{ID: "sara_servizos", Name: "Servizos e subministros SARA", Kind: "sara", Tipos: []string{"servizos", "subministros"}, Importe: 214000, Desde: "2020-01-01", Ata: "2021-12-31"},
+		{ID: "sara_servizos", Name: "Servizos e subministros SARA", Kind: "sara", Tipos: []string{"servizos", "subministros"}, Importe: 215000, Desde: "2022-01-01", Ata: "2023-12-31"},
+		{ID: "sara_servizos", Name: "Servizos e subministros SARA", Kind: "sara", Tipos: []string{"servizos", "subministros"}, Importe: 221000, Desde: "2024-01-01"},
+	},
+}
+
+// limiares en uso
+var thresholds = defaultThresholds
+
+// loadThresholds le o ficheiro de limiares, que substitúe aos por defecto
+func loadThresholds(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	ts := thresholdSet{Near: defaultThresholds.Near, IVA: defaultThresholds.IVA}
+	if err := json.Unmarshal(b, &ts); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if ts.Near <= 0 || ts.Near >= 1 {
+		return fmt.Errorf("%s: near ten que estar entre 0 e 1", file)
+	}
+	for i, r := range ts.Rules {
+		if r.ID == "" || r.Importe <= 0 {
+			return fmt.Errorf("%s: regra %d: fan falta id e importe", file, i+1)
+		}
+		if _, err := path.Match(strings.ToLower(r.Match), ""); err != nil {
+			return fmt.Errorf("%s: regra %d: patrón %q: %w", file, i+1, r.Match, err)
+		}
+		for _, d := range []string{r.Desde, r.Ata} {
+			if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+				return fmt.Errorf("%s: regra %d: data %q non é AAAA-MM-DD", file, i+1, d)
+			}
+		}
+		for _, t := range r.Tipos {
+			if t != tipoObras && t != tipoServizos && t != tipoSubministros {
+				return fmt.Errorf("%s: regra %d: tipo descoñecido %q (válidos: obras, servizos, subministros)", file, i+1, t)
+			}
+		}
+	}
+	thresholds = ts
+	return nil
+}
+
+// categorías de tipo de contrato
+const (
+	tipoObras        = "obras"
+	tipoServizos     = "servizos"
+	tipoSubministros = "subministros"
+)
+
+// tipoCategory: categoría polo texto do tipo ("Obras", "Servicios", "Suministros"...). Un tipo
+// baleiro ou descoñecido vai con servizos: a LCSP só separa as obras, e o resto de contratos
+// ten os límites de servizos e subministros. Úsana os limiares e o fraccionamento.
+func tipoCategory(tipo string) string {
+	t := asciiFold(tipo)
+	switch {
+	case strings.Contains(t, "obra"):
+		return tipoObras
+	case strings.Contains(t, "sumin"), strings.Contains(t, "submin"):
+		return tipoSubministros
+	}
+	return tipoServizos
+}
+
+// importeConIVE: se a columna de importe leva IVE, polo nome (sen pista, o que diga o ficheiro)
+func importeConIVE(col string) bool {
+	c := asciiFold(col)
+	switch {
+	case strings.Contains(c, "sin_iva"), strings.Contains(c, "sen_ive"), strings.Contains(c, "sin iva"), strings.Contains(c, "sen ive"):
+		return false
+	case strings.Contains(c, "iva"), strings.Contains(c, "ive"):
+		return true
+	}
+	return thresholds.ConIVE
+}
+
+func (r thresholdRule) applies(table, cat, date string) bool {
+	if r.Match != "" && r.Match != "*" {
+		if ok, _ := path.Match(strings.ToLower(r.Match), strings.ToLower(table)); !ok {
+			return false
+		}
+	}
+	if len(r.Tipos) > 0 {
+		found := false
+		for _, t := range r.Tipos {
+			found = found || t == cat
+		}
+		if !found {
+			return false
+		}
+	}
+	// sen data recoñecible, as regras vixentes hoxe
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	}
+	return (r.Desde == "" || date >= r.Desde) && (r.Ata == "" || date <= r.Ata)
+}
+
+// etiquetas dunha fila respecto dun limiar
+const (
+	thresholdWithin = "dentro"
+	thresholdNear   = "preto"
+	thresholdOver   = "supera"
+)
+
+type thresholdLabel struct {
+	Rule   string  `json:"rule"`
+	Name   string  `json:"name"`
+	Kind   string  `json:"kind"`
+	Label  string  `json:"label"`
+	Limite float64 `json:"limite"`
+	Pct    float64 `json:"pct"` // importe / límite, en %
+}
+
+// kindRule: a primeira regra dun tipo (kind) en vigor
+func (ts thresholdSet) kindRule(kind, table, cat, date string) *thresholdRule {
+	for i := range ts.Rules {
+		if r := &ts.Rules[i]; r.Kind == kind && r.applies(table, cat, date) {
+			return r
+		}
+	}
+	return nil
+}
+
+// compareImporte pasa o importe á base da regra (con ou sen IVE)
+func (ts thresholdSet) compareImporte(r *thresholdRule, importe float64, conIVE bool) float64 {
+	switch {
+	case conIVE && !r.IVE:
+		return importe / (1 + ts.IVA)
+	case !conIVE && r.IVE:
+		return importe * (1 + ts.IVA)
+	}
+	return importe
+}
+
+// reaches indica se o importe chega ao límite da regra. O contrato menor é "inferior a" o
+// límite (LCSP art. 118): no límite xa non o é. Úsano os limiares e o fraccionamento.
+func (ts thresholdSet) reaches(r *thresholdRule, importe float64, conIVE bool) bool {
+	return ts.compareImporte(r, importe, conIVE) >= r.Importe
+}
+
+// evaluate etiqueta unha fila con todas as regras en vigor (unha por id)
+func (ts thresholdSet) evaluate(table, tipo string, importe float64, conIVE bool, date string) []thresholdLabel {
+	cat := tipoCategory(tipo)
+	var out []thresholdLabel
+	seen := map[string]bool{}
+	for _, r := range ts.Rules {
+		if seen[r.ID] || !r.applies(table, cat, date) {
+			continue
+		}
+		seen[r.ID] = true
+		imp := ts.compareImporte(&r, importe, conIVE)
+		l := thresholdLabel{Rule: r.ID, Name: r.Name, Kind: r.Kind, Label: thresholdWithin, Limite: r.Importe, Pct: imp / r.Importe * 100}
+		switch {
+		case ts.reaches(&r, importe, conIVE):
+			l.Label = thresholdOver
+		case imp >= ts.Near*r.Importe:
+			l.Label = thresholdNear
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// columna engadida ás filas de /api/table
+const thresholdsColumn = "lb_limiares"
+
+// thresholdColumn: valor da columna lb_limiares de /api/table ("menor_servizos=preto sara_servizos=dentro")
+func thresholdColumn(labels []thresholdLabel) string {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.Rule + "=" + l.Label
+	}
+	return strings.Join(parts, " ")
+}
+
+// rowThresholds: avaliador para as filas (texto) dunha táboa; nil se a táboa non ten importe
+func rowThresholds(table string, cols []Column) func(row map[string]any) []thresholdLabel {
+	impCol := roleColumn(table, cols, roleImporte)
+	if impCol == "" {
+		return nil
+	}
+	tipoCol, dateCol := roleColumn(table, cols, roleTipo), roleColumn(table, cols, roleData)
+	conIVE := importeConIVE(impCol)
+	text := func(row map[string]any, col string) string {
+		if col == "" || row[col] == nil {
+			return ""
+		}
+		return fmt.Sprint(row[col])
+	}
+	return func(row map[string]any) []thresholdLabel {
+		imp, ok := parseEuroNumber(text(row, impCol))
+		if !ok {
+			return nil
+		}
+		date := ""
+		if dateCol != "" {
+			date = pickDate(extractDates(text(row, dateCol)), datePub)
+		}
+		return thresholds.evaluate(table, text(row, tipoCol), imp, conIVE, date)
+	}
+}
+
+// ==== /api/thresholds: os limiares en uso ====
+
+func (s *server) handleAPIThresholds(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(thresholds)
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+// limiares e fraccionamento teñen que coincidir no límite exacto
+func TestThresholdsAtLimit(t *testing.T) {
+	ts := defaultThresholds
+	rule := ts.kindRule("menor", "Alcaldia_contratos_menores", tipoServizos, "2024-05-01")
+	if rule == nil || rule.Importe != 15000 {
+		t.Fatalf("regra menor de servizos en 2024: %+v", rule)
+	}
+	tests := []struct {
+		importe float64
+		conIVE  bool
+		label   string
+	}{
+		{14000, false, thresholdWithin},
+		{14250, false, thresholdNear},
+		{14999.99, false, thresholdNear},
+		{15000, false, thresholdOver},
+		{15000.01, false, thresholdOver},
+		{18150, true, thresholdOver}, // 15.000 + 21 %
+		{18149, true, thresholdNear},
+	}
+	for _, tt := range tests {
+		labels := ts.evaluate("Alcaldia_contratos_menores", "Servizos", tt.importe, tt.conIVE, "2024-05-01")
+		var got string
+		for _, l := range labels {
+			if l.Rule == "menor_servizos" {
+				got = l.Label
+			}
+		}
+		if got != tt.label {
+			t.Errorf("evaluate(%v, conIVE=%v) = %q, want %q", tt.importe, tt.conIVE, got, tt.label)
+		}
+		if reaches := ts.reaches(rule, tt.importe, tt.conIVE); reaches != (tt.label == thresholdOver) {
+			t.Errorf("reaches(%v, conIVE=%v) = %v, evaluate %q", tt.importe, tt.conIVE, reaches, got)
+		}
+	}
+}
+
+// limiares e fraccionamento collen a mesma categoría; sen tipo ou cun descoñecido, servizos
+func TestTipoCategory(t *testing.T) {
+	tests := []struct {
+		tipo, cat, split string
+	}{
+		{"Obras", tipoObras, splitObras},
+		{"Concesión de obras", tipoObras, splitObras},
+		{"Servicios", tipoServizos, splitServizos},
+		{"Servizos", tipoServizos, splitServizos},
+		{"Suministros", tipoSubministros, splitServizos},
+		{"Subministración", tipoSubministros, splitServizos},
+		{"", tipoServizos, splitServizos},
+		{"Administrativo especial", tipoServizos, splitServizos},
+	}
+	for _, tt := range tests {
+		if got := tipoCategory(tt.tipo); got != tt.cat {
+			t.Errorf("tipoCategory(%q) = %q, want %q", tt.tipo, got, tt.cat)
+		}
+		if got := splitCategory(tt.tipo); got != tt.split {
+			t.Errorf("splitCategory(%q) = %q, want %q", tt.tipo, got, tt.split)
+		}
+		// a fila ten regra de contrato menor, e é a mesma ca a do fraccionamento
+		var rule string
+		for _, l := range defaultThresholds.evaluate("Alcaldia_contratos_menores", tt.tipo, 15000, false, "2024-05-01") {
+			if l.Kind == "menor" {
+				rule = l.Rule
+			}
+		}
+		if r := splitRule("Alcaldia_contratos_menores", tt.split, "2024-05-01"); r == nil || r.ID != rule {
+			t.Errorf("%q: regra %q, fraccionamento %+v", tt.tipo, rule, r)
+		}
+	}
+}
@@ -177,8 +177,12 @@ func (m *tuiModel) loadTable() (tuiModel, tea.Cmd) {
 		return *m, nil
 	}
 	m.cols = cols
-	where, args := buildWhereLike(ColNames(cols), m.q)
-	rows, err := fetchPage(m.db, m.table, cols, where, m.order, m.desc, m.page, m.perPage, args)
+	flt, err := buildFilter(m.db, m.table, cols, m.q)
+	if err != nil {
+		m.status = "q: " + err.Error()
+		return *m, nil
+	}
+	rows, err := fetchPage(m.db, m.table, cols, flt, m.order, m.desc, m.page, m.perPage)
 	if err != nil {
 		m.status = err.Error()
 	} else {
@@ -223,8 +227,11 @@ func (m *tuiModel) renderHistogram() string {
 	if m.table == "" || m.chartBy == "" {
 		return ""
 	}
-	where, args := buildWhereLike(ColNames(m.cols), m.q)
-	labels, counts, err := histogramCounts(m.db, m.table, m.chartBy, where, args, 20, m.desc, true)
+	flt, err := buildFilter(m.db, m.table, m.cols, m.q)
+	if err != nil {
+		return "(sen datos)"
+	}
+	labels, counts, err := histogramCounts(m.db, m.table, m.chartBy, flt.Where, flt.Args, 20, m.desc, true)
 	if err != nil || len(labels) == 0 {
 		return "(sen datos)"
 	}
@@ -255,8 +262,11 @@ func (m *tuiModel) exportCSV() (string, error) {
 		return "", errors.New("sen táboa")
 	}
 	cols := m.cols
-	where, args := buildWhereLike(ColNames(cols), m.q)
-	rows, err := fetchPage(m.db, m.table, cols, where, m.order, m.desc, 1, 1_000_000, args)
+	flt, err := buildFilter(m.db, m.table, cols, m.q)
+	if err != nil {
+		return "", err
+	}
+	rows, err := fetchPage(m.db, m.table, cols, flt, m.order, m.desc, 1, 1_000_000)
 	if err != nil {
 		return "", err
 	}
@@ -288,8 +298,11 @@ func (m *tuiModel) exportXLSX() (string, error) {
 		return "", errors.New("sen táboa")
 	}
 	cols := m.cols
-	where, args := buildWhereLike(ColNames(cols), m.q)
-	rows, err := fetchPage(m.db, m.table, cols, where, m.order, m.desc, 1, 1_000_000, args)
+	flt, err := buildFilter(m.db, m.table, cols, m.q)
+	if err != nil {
+		return "", err
+	}
+	rows, err := fetchPage(m.db, m.table, cols, flt, m.order, m.desc, 1, 1_000_000)
 	if err != nil {
 		return "", err
 	}